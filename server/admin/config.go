@@ -24,6 +24,7 @@ import (
 	"log"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -33,11 +34,25 @@ const (
 	configFileDataError                string = "Error reading data from configuration file, please follow the format specified"
 	configOperationMissingParams       string = "Config is missing variables for these operation(s): %s"
 	configOperationMissingDependencies string = "Config has invalid dependencies for these common parameter(s) and operation(s): %s"
+	configInvalidRdpOperations         string = "Config has invalid settings for these RDP operation(s): %s"
 	operationNotFoundError             string = "%s operation was not found in the config"
 	missingParamsError                 string = "Missing parameters defined in config file for this operation: %s"
 	missingDependenciesError           string = "These parameters are required due to the dependencies for this operation: %s"
 	missingInstanceParamsError         string = "Missing parameters in the instance needed for this operation: %s, use Admin Operations instead for this operation"
 	captureParamRegex                  string = `\${{(?s)([a-z0-9A-Z]+_*[a-z0-9A-Z]+)}}(?s)`
+	// EndReasonParam and SessionDurationParam are filled in for post RDP operations
+	EndReasonParam       string = "END_REASON"
+	SessionDurationParam string = "SESSION_DURATION"
+)
+
+// on_failure values of RDP operations
+const (
+	// OnFailureContinue runs the next operation
+	OnFailureContinue string = "continue"
+	// OnFailureSkipRemaining skips the operations after the failed one but still connects
+	OnFailureSkipRemaining string = "skip_remaining"
+	// OnFailureAbort ends the session, after a session it is the same as OnFailureSkipRemaining
+	OnFailureAbort string = "abort"
 )
 
 type osFeatures struct {
@@ -87,10 +102,29 @@ type ConfigAdminOperation struct {
 	RealtimeOutput bool                   `mapstructure:"realtime_output"`
 }
 
-type preRdpOperation struct {
+// RdpOperation is an instance operation that runs before or after an RDP or port forward session, it is
+// skipped unless the session's params match its dependencies
+type RdpOperation struct {
 	Name         string            `json:"name"`
 	Operation    string            `json:"operation"`
 	Dependencies map[string]string `json:"dependencies"`
+	// Timeout limits each attempt, Retries is how many more attempts are made after a failure
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+	Retries int           `mapstructure:"retries" json:"retries"`
+	// Required operations abort the session when they fail, otherwise OnFailure decides what happens next
+	Required  bool   `mapstructure:"required" json:"required"`
+	OnFailure string `mapstructure:"on_failure" json:"on_failure"`
+}
+
+// FailureAction returns what happens when the operation still fails after its retries
+func (operation RdpOperation) FailureAction() string {
+	if operation.Required {
+		return OnFailureAbort
+	}
+	if operation.OnFailure == "" {
+		return OnFailureContinue
+	}
+	return operation.OnFailure
 }
 
 type configWorkflow struct {
@@ -106,11 +140,64 @@ type Config struct {
 	CommonParams             map[string]configParam `json:"common_params"`
 	ProjectOperation         string                 `json:"project_operation"`
 	ValidateProjectOperation string                 `json:"validate_project_operation"`
-	PreRDPOperations         []preRdpOperation      `json:"pre_rdp_operations"`
+	PreRDPOperations         []RdpOperation         `json:"pre_rdp_operations"`
+	PostRDPOperations        []RdpOperation         `json:"post_rdp_operations"`
 	Workflows                []configWorkflow       `json:"workflows"`
+	RDP                      RDPConfig              `json:"rdp"`
 	ProjectOperationRegex    string
 }
 
+// RDPConfig holds the settings for private RDP and port forward sessions
+type RDPConfig struct {
+	Tunnel       string        `mapstructure:"tunnel" json:"tunnel"`
+	RelayURL     string        `mapstructure:"relay_url" json:"relay_url"`
+	ReadyTimeout time.Duration `mapstructure:"ready_timeout" json:"ready_timeout"`
+	ProbeRDP     bool          `mapstructure:"probe_rdp" json:"probe_rdp"`
+	// Launcher picks the profile in Launchers used by start-rdp
+	Launcher  string                    `mapstructure:"launcher" json:"launcher"`
+	Launchers map[string]LauncherConfig `mapstructure:"launchers" json:"launchers"`
+	// RdpFileCert and RdpFileKey sign downloaded .rdp files when set
+	RdpFileCert string `mapstructure:"rdp_file_cert" json:"rdp_file_cert"`
+	RdpFileKey  string `mapstructure:"rdp_file_key" json:"rdp_file_key"`
+	// SessionTimeout is how long sessions stay open unless extended, up to MaxSessionTimeout
+	SessionTimeout    time.Duration   `mapstructure:"session_timeout" json:"session_timeout"`
+	MaxSessionTimeout time.Duration   `mapstructure:"max_session_timeout" json:"max_session_timeout"`
+	ExtendBy          time.Duration   `mapstructure:"extend_by" json:"extend_by"`
+	SessionWarnings   []time.Duration `mapstructure:"session_warnings" json:"session_warnings"`
+	FirewallTimeout   time.Duration   `mapstructure:"firewall_timeout" json:"firewall_timeout"`
+	// IdleTimeout closes sessions without traffic for that long, a negative value never closes them
+	IdleTimeout   time.Duration `mapstructure:"idle_timeout" json:"idle_timeout"`
+	StatsInterval time.Duration `mapstructure:"stats_interval" json:"stats_interval"`
+	// ResumeGrace is how long a session waits for a lost socket to resume, a negative value ends it right away
+	ResumeGrace time.Duration `mapstructure:"resume_grace" json:"resume_grace"`
+	// HealthInterval is how often a ready RDP tunnel is probed through IAP when ProbeRDP is set, a negative
+	// value or ProbeRDP unset only watches the tunnel process
+	HealthInterval    time.Duration `mapstructure:"health_interval" json:"health_interval"`
+	RestartAttempts   int           `mapstructure:"restart_attempts" json:"restart_attempts"`
+	RestartMaxBackoff time.Duration `mapstructure:"restart_max_backoff" json:"restart_max_backoff"`
+	// LocalPorts is the range local ports are picked from when the client doesn't ask for one
+	LocalPorts PortRange `mapstructure:"local_ports" json:"local_ports"`
+	// StartStoppedInstances offers to start or resume instances that aren't running before connecting
+	StartStoppedInstances bool          `mapstructure:"start_stopped_instances" json:"start_stopped_instances"`
+	InstanceStartTimeout  time.Duration `mapstructure:"instance_start_timeout" json:"instance_start_timeout"`
+	// SkipPermissionCheck turns off checking the caller's IAM permissions before a session changes anything
+	SkipPermissionCheck bool `mapstructure:"skip_permission_check" json:"skip_permission_check"`
+	// JitIapGrant grants the tunnel role on the instance for each session instead of relying on standing access
+	JitIapGrant bool `mapstructure:"jit_iap_grant" json:"jit_iap_grant"`
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min int `mapstructure:"min" json:"min"`
+	Max int `mapstructure:"max" json:"max"`
+}
+
+// LauncherConfig overrides the program path of an RDP client profile and adds arguments to it
+type LauncherConfig struct {
+	Path string   `mapstructure:"path" json:"path"`
+	Args []string `mapstructure:"args" json:"args"`
+}
+
 // OperationToFill is sent by the extension detailing a operation and the variables to be filled
 type OperationToFill struct {
 	Name   string            `json:"name"`
@@ -201,28 +288,37 @@ func checkConfigForMissingParams(config Config) map[string][]string {
 	}
 
 	for _, operation := range config.PreRDPOperations {
-		// Get all variables in the operation
-		matches := r.FindAllStringSubmatch(operation.Operation, -1)
-		instanceParams := []string{"NAME", "ZONE", "PROJECT", "NETWORKIP"}
-		for _, match := range matches {
+		checkRdpOperationParams(config, operation, []string{"NAME", "ZONE", "PROJECT", "NETWORKIP"}, missingParams)
+	}
 
-			isInstanceParam := false
+	for _, operation := range config.PostRDPOperations {
+		checkRdpOperationParams(config, operation, []string{"NAME", "ZONE", "PROJECT", "NETWORKIP", EndReasonParam, SessionDurationParam}, missingParams)
+	}
 
-			for _, param := range instanceParams {
-				if param == match[1] {
-					isInstanceParam = true
-					break
-				}
-			}
+	return missingParams
+}
 
-			// Check if variable is defined in common variables
-			if _, inCommonParams := config.CommonParams[match[1]]; !inCommonParams && !isInstanceParam {
-				missingParams[operation.Name] = append(missingParams[operation.Name], match[1])
+// checkRdpOperationParams adds the variables of the operation that are neither instance nor common params to missingParams
+func checkRdpOperationParams(config Config, operation RdpOperation, instanceParams []string, missingParams map[string][]string) {
+	r := regexp.MustCompile(captureParamRegex)
+	// Get all variables in the operation
+	matches := r.FindAllStringSubmatch(operation.Operation, -1)
+	for _, match := range matches {
+
+		isInstanceParam := false
+
+		for _, param := range instanceParams {
+			if param == match[1] {
+				isInstanceParam = true
+				break
 			}
 		}
-	}
 
-	return missingParams
+		// Check if variable is defined in common variables
+		if _, inCommonParams := config.CommonParams[match[1]]; !inCommonParams && !isInstanceParam {
+			missingParams[operation.Name] = append(missingParams[operation.Name], match[1])
+		}
+	}
 }
 
 func validateConfigDependencies(config Config) map[string][]string {
@@ -259,6 +355,16 @@ func validateConfigDependencies(config Config) map[string][]string {
 		}
 	}
 
+	// Post RDP operations can also depend on how the session ended
+	for _, operation := range config.PostRDPOperations {
+		for dependency, _ := range operation.Dependencies {
+			dependency = strings.ToUpper(dependency)
+			if _, inCommonParams := config.CommonParams[dependency]; !inCommonParams && dependency != EndReasonParam {
+				missingDependencies[operation.Name] = append(missingDependencies[operation.Name], dependency)
+			}
+		}
+	}
+
 	return missingDependencies
 }
 
@@ -312,9 +418,29 @@ func LoadConfig(configPath *string) (*Config, error) {
 		return &Config{}, fmt.Errorf(configOperationMissingDependencies, strings.Join(errorStrings, ". "))
 	}
 
+	if invalidOperations := validateRdpOperations(config); len(invalidOperations) > 0 {
+		return &Config{}, fmt.Errorf(configInvalidRdpOperations, strings.Join(invalidOperations, ". "))
+	}
+
 	return &config, nil
 }
 
+// validateRdpOperations returns a description of each pre or post RDP operation with invalid settings
+func validateRdpOperations(config Config) []string {
+	var invalid []string
+	for _, operation := range append(append([]RdpOperation(nil), config.PreRDPOperations...), config.PostRDPOperations...) {
+		switch operation.FailureAction() {
+		case OnFailureContinue, OnFailureSkipRemaining, OnFailureAbort:
+		default:
+			invalid = append(invalid, fmt.Sprintf("%s: unknown on_failure %q", operation.Name, operation.OnFailure))
+		}
+		if operation.Timeout < 0 || operation.Retries < 0 {
+			invalid = append(invalid, fmt.Sprintf("%s: timeout and retries can't be negative", operation.Name))
+		}
+	}
+	return invalid
+}
+
 func checkIfParamInChoices(value string, variableName string, variablesToCheck map[string]configParam) bool {
 	for _, choice := range variablesToCheck[variableName].Choices {
 		if choice == value {
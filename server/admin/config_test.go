@@ -73,9 +73,9 @@ func buildTestConfig() Config {
 
 	configInstanceOperation := ConfigAdminOperation{Name: "test-instance", Operation: "${{NAME}} ${{ZONE}} ${{NETWORKIP}} ${{PROJECT}}"}
 
-	configPreRDPOperation := preRdpOperation{Name: "test-rdp", Operation: "hello"}
+	configPreRDPOperation := RdpOperation{Name: "test-rdp", Operation: "hello"}
 
-	return Config{Operations: []ConfigAdminOperation{configOperation}, CommonParams: commonParams, InstanceOperations: []ConfigAdminOperation{configInstanceOperation}, PreRDPOperations: []preRdpOperation{configPreRDPOperation}}
+	return Config{Operations: []ConfigAdminOperation{configOperation}, CommonParams: commonParams, InstanceOperations: []ConfigAdminOperation{configInstanceOperation}, PreRDPOperations: []RdpOperation{configPreRDPOperation}}
 }
 
 func TestCheckConfigForMissingParams(t *testing.T) {
@@ -101,6 +101,34 @@ func TestCheckConfigForMissingParams(t *testing.T) {
 	}
 }
 
+func TestCheckPostRdpOperationParams(t *testing.T) {
+	config := buildTestConfig()
+	config.PreRDPOperations[0].Operation = "${{NAME}} ${{END_REASON}}"
+	config.PostRDPOperations = []RdpOperation{{Name: "test-post-rdp", Operation: "${{NAME}} ${{END_REASON}} ${{SESSION_DURATION}}", Dependencies: map[string]string{"end_reason": "error"}}}
+
+	expected := map[string][]string{"test-rdp": {EndReasonParam}}
+	if missing := checkConfigForMissingParams(config); !reflect.DeepEqual(expected, missing) {
+		t.Errorf("checkConfigForMissingParams didn't only allow the end params after RDP, got %v, expected %v", missing, expected)
+	}
+	if missing := validateConfigDependencies(config); len(missing) != 0 {
+		t.Errorf("validateConfigDependencies didn't allow a dependency on the end reason, got %v", missing)
+	}
+}
+
+func TestValidateRdpOperations(t *testing.T) {
+	config := buildTestConfig()
+	config.PostRDPOperations = []RdpOperation{{Name: "test-post-rdp", OnFailure: "retry"}, {Name: "test-required", OnFailure: "retry", Required: true}}
+	config.PreRDPOperations[0].Retries = -1
+
+	expected := []string{`test-rdp: timeout and retries can't be negative`, `test-post-rdp: unknown on_failure "retry"`}
+	if invalid := validateRdpOperations(config); !reflect.DeepEqual(invalid, expected) {
+		t.Errorf("validateRdpOperations got %v, expected %v", invalid, expected)
+	}
+	if action := config.PostRDPOperations[1].FailureAction(); action != OnFailureAbort {
+		t.Errorf("FailureAction didn't abort for a required operation, got %v", action)
+	}
+}
+
 func TestValidateConfigDependencies(t *testing.T) {
 	config := buildTestConfig()
 
@@ -9,6 +9,8 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
 )
 
 const (
@@ -18,6 +20,10 @@ const (
 	operationRunning        string        = "operation with hash %v already running"
 	operationEnded          string        = "operation with hash %v ended"
 	serverReceivedOperation string        = "server received operation: %v"
+	operationPhaseRunning   string        = "running"
+	operationPhaseEnded     string        = "ended"
+	operationEndedReason    string        = "ended"
+	operationTimedOutReason string        = "timed_out"
 )
 
 type shell interface {
@@ -43,6 +49,9 @@ type socketMessage struct {
 	Stdout        string `json:"stdout"`
 	Stderr        string `json:"stderr"`
 	Err           string `json:"error"`
+	// err and ended are only sent in the versioned protocol, as the error's code and the end reason
+	err   error
+	ended string
 }
 
 // newSocketMessage creates a socketMessage struct
@@ -56,7 +65,23 @@ func newSocketMessage(message, stdout, stderr string, err error) *socketMessage
 		Stdout:        stdout,
 		Stderr:        stderr,
 		Err:           errorMessage,
+		err:           err,
+	}
+}
+
+// Envelope returns the type and payload the message is sent with in the versioned protocol
+func (m *socketMessage) Envelope() (string, interface{}) {
+	switch {
+	case m.Err != "":
+		return protocol.TypeError, protocol.Error{Code: protocol.ErrorCode(m.err), Message: m.Err}
+	case m.ended != "":
+		return protocol.TypeEnded, protocol.Ended{Reason: m.ended, Message: m.ServerMessage}
+	case m.Stdout != "":
+		return protocol.TypeOutput, protocol.Output{Stream: protocol.StreamStdout, Line: m.Stdout}
+	case m.Stderr != "":
+		return protocol.TypeOutput, protocol.Output{Stream: protocol.StreamStderr, Line: m.Stderr}
 	}
+	return protocol.TypeProgress, protocol.Progress{Message: m.ServerMessage}
 }
 
 // WriteToSocket is a wrapper that is used to write JSON to the websocket
@@ -87,6 +112,7 @@ func (adminExecutor *AdminExecutor) RunOperation(ws conn, operationToRun *Operat
 	ctx, cancel := context.WithTimeout(context.Background(), operationContextTimeout)
 	endOperationChan := make(chan bool)
 
+	protocol.SetPhase(ws, operationPhaseRunning)
 	if err := WriteToSocket(ws, fmt.Sprintf(serverReceivedOperation, operationToRun.Operation), "", "", nil); err != nil {
 		cancel()
 		return
@@ -101,8 +127,18 @@ func (adminExecutor *AdminExecutor) RunOperation(ws conn, operationToRun *Operat
 		go adminExecutor.executeOperationInstant(ctx, ws, operationToRun, endOperationChan)
 	}
 	<-endOperationChan
+	reason := operationEndedReason
+	if ctx.Err() == context.DeadlineExceeded {
+		reason = operationTimedOutReason
+	}
 	cancel()
-	WriteToSocket(ws, fmt.Sprintf(operationEnded, operationToRun.Hash), "", "", nil)
+
+	protocol.SetPhase(ws, operationPhaseEnded)
+	message := newSocketMessage(fmt.Sprintf(operationEnded, operationToRun.Hash), "", "", nil)
+	message.ended = reason
+	if err := ws.WriteJSON(message); err != nil {
+		log.Println(err)
+	}
 	return
 }
 
@@ -250,7 +286,7 @@ func ReadOperationHashFromConn(ws conn, operationPool *[]OperationToRun) (*Opera
 		for _, operation := range *operationPool {
 			if operation.Hash == reqBody.Hash {
 				if operation.Status == "running" {
-					return nil, fmt.Errorf(operationRunning, reqBody.Hash)
+					return nil, protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf(operationRunning, reqBody.Hash))
 				}
 				operation.Status = "running"
 				log.Println(operation)
@@ -258,6 +294,6 @@ func ReadOperationHashFromConn(ws conn, operationPool *[]OperationToRun) (*Opera
 			}
 		}
 
-		return nil, fmt.Errorf(operationNotFound, reqBody.Hash)
+		return nil, protocol.WithCode(protocol.CodeNotFound, fmt.Errorf(operationNotFound, reqBody.Hash))
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
 	"github.com/gorilla/websocket"
 )
 
@@ -423,3 +424,27 @@ func TestRunOperation(t *testing.T) {
 		t.Errorf("RunOperation didn't write proper error to socket, expected %v", "stdout")
 	}
 }
+
+func TestSocketMessageEnvelope(t *testing.T) {
+	ended := newSocketMessage("operation with hash hash ended", "", "", nil)
+	ended.ended = operationTimedOutReason
+
+	tests := []struct {
+		message         *socketMessage
+		expectedType    string
+		expectedPayload interface{}
+	}{
+		{newSocketMessage("server received operation: echo", "", "", nil), protocol.TypeProgress, protocol.Progress{Message: "server received operation: echo"}},
+		{newSocketMessage("", "hello", "", nil), protocol.TypeOutput, protocol.Output{Stream: protocol.StreamStdout, Line: "hello"}},
+		{newSocketMessage("", "", "warning", nil), protocol.TypeOutput, protocol.Output{Stream: protocol.StreamStderr, Line: "warning"}},
+		{newSocketMessage("", "", "", protocol.WithCode(protocol.CodeNotFound, errors.New(testErr))), protocol.TypeError,
+			protocol.Error{Code: protocol.CodeNotFound, Message: testErr}},
+		{ended, protocol.TypeEnded, protocol.Ended{Reason: operationTimedOutReason, Message: "operation with hash hash ended"}},
+	}
+	for _, test := range tests {
+		messageType, payload := test.message.Envelope()
+		if messageType != test.expectedType || !reflect.DeepEqual(payload, test.expectedPayload) {
+			t.Errorf("Envelope got %v %+v, expected %v %+v", messageType, payload, test.expectedType, test.expectedPayload)
+		}
+	}
+}
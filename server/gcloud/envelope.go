@@ -0,0 +1,73 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// session phases sent with each message to clients that negotiated the envelope
+const (
+	phaseStarting  string = "starting"
+	phasePreRdp    string = "pre_rdp_operations"
+	phaseAccess    string = "access"
+	phaseTunnel    string = "tunnel"
+	phaseConnected string = "connected"
+	phaseEnding    string = "ending"
+)
+
+// envelope events, legacy clients get them as events on the usual messages
+const (
+	readyForCommandEvent string = "ready_for_command"
+	sessionEndedEvent    string = "session_ended"
+)
+
+// Envelope returns the type and payload the message is sent with in the versioned protocol
+func (m *socketMessage) Envelope() (string, interface{}) {
+	if m.Err != "" {
+		code := protocol.ErrorCode(m.err)
+		if code == protocol.CodeUnknown && m.Event != nil && m.Event.Type == tunnelFailedEvent {
+			code = protocol.CodeTunnelFailed
+		}
+		errorPayload := protocol.Error{Code: code, Message: m.Err}
+		if m.Event != nil {
+			errorPayload.Detail = m.Event
+		}
+		return protocol.TypeError, errorPayload
+	}
+	if m.Credentials != nil {
+		return protocol.TypeCredentials, m.Credentials
+	}
+	if m.Event == nil {
+		return protocol.TypeProgress, protocol.Progress{Message: m.Message}
+	}
+
+	switch m.Event.Type {
+	case tunnelReadyEvent:
+		return protocol.TypeTunnelReady, protocol.TunnelReady{Message: m.Message, Port: m.Event.Port, ElapsedMs: m.Event.ElapsedMs}
+	case readyForCommandEvent:
+		return protocol.TypeReady, protocol.Progress{Message: m.Message}
+	case sessionEndedEvent:
+		return protocol.TypeEnded, protocol.Ended{Reason: m.Event.Detail, Message: m.Message}
+	}
+	return protocol.TypeEvent, protocol.Event{Message: m.Message, Detail: m.Event}
+}
+
+// writeReadyForCommand tells the client the session takes commands such as start-rdp
+func writeReadyForCommand(ws conn) error {
+	return writeEventToSocket(ws, readyForCommandOutput, nil, &tunnelEvent{Type: readyForCommandEvent})
+}
@@ -0,0 +1,92 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestSocketMessageEnvelope(t *testing.T) {
+	tests := []struct {
+		message         *socketMessage
+		expectedType    string
+		expectedPayload interface{}
+	}{
+		{newSocketMessage("Server received instance vm", nil), protocol.TypeProgress, protocol.Progress{Message: "Server received instance vm"}},
+		{newSocketMessage("", protocol.WithCode(protocol.CodePermissionDenied, errors.New("missing"))), protocol.TypeError,
+			protocol.Error{Code: protocol.CodePermissionDenied, Message: "missing"}},
+		{&socketMessage{Message: "started", Event: &tunnelEvent{Type: tunnelReadyEvent, Port: 5000, ElapsedMs: 20}}, protocol.TypeTunnelReady,
+			protocol.TunnelReady{Message: "started", Port: 5000, ElapsedMs: 20}},
+		{&socketMessage{Message: readyForCommandOutput, Event: &tunnelEvent{Type: readyForCommandEvent}}, protocol.TypeReady,
+			protocol.Progress{Message: readyForCommandOutput}},
+		{&socketMessage{Message: "shut down", Event: &tunnelEvent{Type: sessionEndedEvent, Detail: endReasonIdle}}, protocol.TypeEnded,
+			protocol.Ended{Reason: endReasonIdle, Message: "shut down"}},
+		{&socketMessage{Credentials: &credentials{Username: "user", Password: "pass"}}, protocol.TypeCredentials,
+			&credentials{Username: "user", Password: "pass"}},
+	}
+	for _, test := range tests {
+		messageType, payload := test.message.Envelope()
+		if messageType != test.expectedType || !reflect.DeepEqual(payload, test.expectedPayload) {
+			t.Errorf("Envelope got %v %+v, expected %v %+v", messageType, payload, test.expectedType, test.expectedPayload)
+		}
+	}
+
+	failed := &socketMessage{Err: "could not start", Event: &tunnelEvent{Type: tunnelFailedEvent}}
+	if _, payload := failed.Envelope(); payload.(protocol.Error).Code != protocol.CodeTunnelFailed {
+		t.Errorf("Envelope didn't give a failed tunnel its code, got %+v", payload)
+	}
+}
+
+func TestTunnelSessionEnvelopes(t *testing.T) {
+	reads := []string{`{"cmd": "hello", "versions": [1, 2]}`, `{"name": "vm", "project": "test-project", "zone": "us-west1-b", "dry_run": true}`}
+	var written []*protocol.Envelope
+	ws := newMockWebSocket(func() (int, []byte, error) {
+		if len(reads) == 0 {
+			return 0, nil, errors.New("closed")
+		}
+		read := reads[0]
+		reads = reads[1:]
+		return websocket.TextMessage, []byte(read), nil
+	}, func(v interface{}) error {
+		written = append(written, v.(*protocol.Envelope))
+		return nil
+	}, func() error { return nil })
+
+	g := NewGcloudExecutor(&noRunShell{t})
+	g.runTunnelSession(protocol.NewConn(ws), nil, false)
+
+	if len(written) < 3 || written[0].Type != protocol.TypeHello {
+		t.Fatalf("runTunnelSession didn't answer the hello first, got %v messages", len(written))
+	}
+	for i, envelope := range written {
+		if envelope.Seq != uint64(i+1) || envelope.Version != protocol.VersionEnvelope {
+			t.Errorf("envelope %v has seq %v and version %v", i, envelope.Seq, envelope.Version)
+		}
+	}
+	last := written[len(written)-1]
+	if last.Type != protocol.TypeEnded || last.Phase != phaseEnding || last.Payload.(protocol.Ended).Reason != endReasonEnded {
+		t.Errorf("runTunnelSession didn't end with the reason, got %+v", last)
+	}
+	if written[1].Phase != phaseStarting {
+		t.Errorf("runTunnelSession sent %v as the starting phase", written[1].Phase)
+	}
+}
@@ -25,16 +25,25 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // NewGcloudExecutor creates a new gcloudExecutor struct with a struct that implements shell.
 func NewGcloudExecutor(shell shell) *GcloudExecutor {
 	return &GcloudExecutor{
-		shell: shell,
+		shell:    shell,
+		settings: newRdpSettings(nil),
 	}
 }
 
+// SetOwner records the account that starts sessions with this executor
+func (gcloudExecutor *GcloudExecutor) SetOwner(owner string) {
+	gcloudExecutor.owner = owner
+}
+
 // GetComputeInstances runs the gCloud instances command, parses the output to the Instances struct and returns
 func (gcloudExecutor *GcloudExecutor) GetComputeInstances(projectName string) ([]Instance, error) {
 	instanceOutput, err := gcloudExecutor.shell.ExecuteCmd(getComputeInstancesForProjectPrefix + projectName)
@@ -65,7 +74,8 @@ func (gcloudExecutor *GcloudExecutor) createFirewall(ws conn, instance *Instance
 		return errors.New(multipleNetworksError)
 	}
 
-	cmd := fmt.Sprintf(iapFirewallCreateCmd, instance.Name, instance.Name, instance.ProjectName, instance.NetworkInterfaces[0].Network)
+	expires := firewallDescription(timeNow().Add(gcloudExecutor.settings.firewallTimeout))
+	cmd := fmt.Sprintf(iapFirewallCreateCmd, firewallRuleSuffix(instance), instance.remotePort(), instance.Name, instance.ProjectName, instance.NetworkInterfaces[0].Network, expires)
 
 	instanceOutput, err := gcloudExecutor.shell.ExecuteCmd(cmd)
 
@@ -81,7 +91,7 @@ func (gcloudExecutor *GcloudExecutor) createFirewall(ws conn, instance *Instance
 		} else if strings.Contains(stringOutput, projectCmdError) {
 			output = fmt.Sprintf(didntCreateFirewallOutput, instance.Name)
 			returnErr = errors.New(SdkProjectError)
-		} else if strings.Contains(stringOutput, fmt.Sprintf(firewallRuleExistsCmdOutput, instance.ProjectName, instance.Name)) {
+		} else if strings.Contains(stringOutput, fmt.Sprintf(firewallRuleExistsCmdOutput, instance.ProjectName, firewallRuleSuffix(instance))) {
 			output = fmt.Sprintf(firewallRuleAlreadyExistsOutput, instance.Name)
 			returnErr = nil
 		} else {
@@ -89,7 +99,7 @@ func (gcloudExecutor *GcloudExecutor) createFirewall(ws conn, instance *Instance
 			returnErr = err
 		}
 	} else {
-		output = fmt.Sprintf(createdFirewallOutput, instance.Name, firewallContextTimeout)
+		output = fmt.Sprintf(createdFirewallOutput, instance.Name, gcloudExecutor.settings.firewallTimeout)
 		returnErr = nil
 	}
 	log.Println(output)
@@ -110,30 +120,97 @@ func (gcloudExecutor *GcloudExecutor) deleteFirewall(ws conn, instance *Instance
 	log.Println("Deleting firewall for ", instance.Name)
 	writeToSocket(ws, fmt.Sprintf(deletingFirewall, instance.Name), nil)
 
-	cmd := fmt.Sprintf(firewallDeleteCmd, instance.Name, instance.ProjectName)
+	cmd := fmt.Sprintf(firewallDeleteCmd, firewallRuleSuffix(instance), instance.ProjectName)
 	instanceOutput, err := gcloudExecutor.shell.ExecuteCmd(cmd)
 	log.Println(string(instanceOutput))
 	if err != nil {
 		if stringOutput := strings.ToLower(string(instanceOutput)); strings.Contains(stringOutput, gcloudAuthError) {
-			writeToSocket(ws, "", fmt.Errorf(deleteFirewallAuthError, instance.Name))
+			writeToSocket(ws, "", fmt.Errorf(deleteFirewallAuthError, firewallRuleSuffix(instance)))
 		} else if strings.Contains(stringOutput, projectCmdError) {
-			writeToSocket(ws, "", fmt.Errorf(deleteFirewallProjectError, instance.Name))
+			writeToSocket(ws, "", fmt.Errorf(deleteFirewallProjectError, firewallRuleSuffix(instance)))
 		} else {
 			writeToSocket(ws, "", err)
 		}
+
+		if sweeper.enqueue(firewallDeletionKind, instance.ProjectName, firewallRulePrefix+firewallRuleSuffix(instance)) {
+			writeToSocket(ws, fmt.Sprintf(queuedFirewallDeletion, firewallRuleSuffix(instance)), nil)
+		}
+	}
+}
+
+// acquireFirewall takes a lease on the instance's firewall rule, creating the rule if no other session holds one
+func (gcloudExecutor *GcloudExecutor) acquireFirewall(ws conn, instance *Instance) (*firewallLease, error) {
+	lease, shared, err := firewallLeases.acquire(firewallLeaseKey(instance), gcloudExecutor.settings.firewallTimeout, func() error {
+		return gcloudExecutor.createFirewall(ws, instance)
+	}, func() {
+		gcloudExecutor.deleteFirewall(ws, instance)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sweeper.trackProject(instance.ProjectName)
+	if shared > 0 {
+		writeToSocket(ws, fmt.Sprintf(sharedFirewallOutput, instance.Name, shared), nil)
+	}
+	return lease, nil
+}
+
+// leaseFirewall takes a lease on the instance's firewall rule unless a rule the server doesn't manage already
+// allows IAP, the lease is nil when there is nothing to release. A rule other sessions lease is always shared
+// so it isn't mistaken for an existing one and deleted under this session.
+func (gcloudExecutor *GcloudExecutor) leaseFirewall(ws conn, instance *Instance) (*firewallLease, error) {
+	if !firewallLeases.leased(firewallLeaseKey(instance)) && gcloudExecutor.checkExistingFirewall(ws, instance, instance.RemotePort) {
+		return nil, nil
+	}
+	return gcloudExecutor.acquireFirewall(ws, instance)
+}
+
+// releaseFirewall gives up the session's lease and deletes the firewall rule if it was the last one
+func (gcloudExecutor *GcloudExecutor) releaseFirewall(ws conn, instance *Instance, lease *firewallLease) {
+	remaining := firewallLeases.release(lease, func() {
+		gcloudExecutor.deleteFirewall(ws, instance)
+	})
+	if remaining > 0 {
+		writeToSocket(ws, fmt.Sprintf(firewallStillLeasedOutput, instance.Name, remaining), nil)
 	}
 }
 
-// readIapTunnelOutput is used as an helper to parse the output from starting the IAP tunnel
-func readIapTunnelOutput(scanner *bufio.Scanner, tunnelCreated *bool, cmdOutput *[]string, iapOutputChan chan<- iapResult) {
+// tunnelOutput collects the lines printed by the tunnel command on both of its pipes. If bound is set it is
+// closed once the command prints the listening line, which it only does after binding the port itself.
+type tunnelOutput struct {
+	mu        sync.Mutex
+	lines     []string
+	listening string
+	bound     chan struct{}
+}
+
+func (output *tunnelOutput) add(line string) {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	output.lines = append(output.lines, line)
+	if output.bound != nil && strings.Contains(line, output.listening) {
+		close(output.bound)
+		output.bound = nil
+	}
+}
+
+func (output *tunnelOutput) get() []string {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	return append([]string(nil), output.lines...)
+}
+
+// readIapTunnelOutput is used as an helper to collect the output from starting the IAP tunnel,
+// gcloud errors are sent on failed without blocking as only the first failure matters.
+func readIapTunnelOutput(scanner *bufio.Scanner, output *tunnelOutput, failed chan<- error) {
 	for scanner.Scan() {
 		line := scanner.Text()
-		*cmdOutput = append(*cmdOutput, line)
-		if strings.Contains(line, tunnelCreatedOutput) {
-			*tunnelCreated = true
-			iapOutputChan <- iapResult{*tunnelCreated, *cmdOutput, nil}
-		} else if strings.Contains(line, gcloudErrorOutput) {
-			iapOutputChan <- iapResult{*tunnelCreated, *cmdOutput, nil}
+		output.add(line)
+		if strings.Contains(line, gcloudErrorOutput) {
+			select {
+			case failed <- errors.New(line):
+			default:
+			}
 		}
 	}
 }
@@ -141,46 +218,172 @@ func readIapTunnelOutput(scanner *bufio.Scanner, tunnelCreated *bool, cmdOutput
 // startIapTunnel is used run the start iap tunnel command and return the appropriate output
 func (gcloudExecutor *GcloudExecutor) startIapTunnel(ctx context.Context, ws conn, instance *Instance, portListener *net.TCPListener, outputChan chan<- iapResult) {
 	log.Println("Starting IAP tunnel for ", instance.Name)
+	started := time.Now()
 	port := portListener.Addr().(*net.TCPAddr).Port
-	cmd := fmt.Sprintf(iapTunnelCmd, instance.Name, instance.ProjectName, port, instance.Zone)
+	cmd := fmt.Sprintf(iapTunnelCmd, instance.Name, instance.remotePort(), instance.ProjectName, port, instance.Zone)
 	portListener.Close()
+
+	// The port is free again once the listener is closed, so it is only probed once gcloud reports it bound
+	// it. Anything else that took the port in between makes gcloud fail instead of receiving the traffic.
+	bound := make(chan struct{})
+	cmdOutput := tunnelOutput{listening: fmt.Sprintf(iapTunnelListening, port), bound: bound}
+	failed := make(chan error, 1)
+	exited := make(chan struct{})
+
 	output, cmdCancel, err := gcloudExecutor.shell.ExecuteCmdReader(cmd)
 	if err != nil {
 		log.Println(err)
+		failed <- err
+	} else {
+		stdoutScanner, stderrScanner := bufio.NewScanner(output[0]), bufio.NewScanner(output[1])
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			readIapTunnelOutput(stdoutScanner, &cmdOutput, failed)
+			wg.Done()
+		}()
+		go func() {
+			readIapTunnelOutput(stderrScanner, &cmdOutput, failed)
+			wg.Done()
+		}()
+		go func() {
+			// Both pipes closing means the command exited
+			wg.Wait()
+			select {
+			case failed <- errors.New(tunnelExited):
+			default:
+			}
+			close(exited)
+		}()
 	}
 
-	stdoutScanner, stderrScanner := bufio.NewScanner(output[0]), bufio.NewScanner(output[1])
+	probeRDP, timeout := tunnelReadiness(instance, gcloudExecutor.settings)
+	err = waitForTunnel(ctx, port, probeRDP, timeout, bound, failed)
+	result := reportTunnelReadiness(ws, instance, port, started, gcloudExecutor.settings.sessionTimeout, cmdOutput.get(), err)
+	result.exited = exited
+	outputChan <- result
 
-	var cmdOutput []string
-	tunnelCreated := false
-	iapOutputChan := make(chan iapResult)
+	if result.tunnelCreated {
+		<-ctx.Done()
+	}
+	log.Println("calling cancel func")
+	if cmdCancel != nil {
+		cmdCancel()
+	}
+}
 
-	go readIapTunnelOutput(stdoutScanner, &tunnelCreated, &cmdOutput, iapOutputChan)
-	go readIapTunnelOutput(stderrScanner, &tunnelCreated, &cmdOutput, iapOutputChan)
+// tunnelReadiness returns whether the readiness probe of the instance's tunnel sends an RDP request and how
+// long it waits. An instance that was just started is probed with RDP until its guest has had time to boot.
+func tunnelReadiness(instance *Instance, settings rdpSettings) (bool, time.Duration) {
+	probeRDP, timeout := settings.probeRDP, settings.readyTimeout
+	if instance.bootWait > 0 {
+		probeRDP = true
+		if timeout < instance.bootWait {
+			timeout = instance.bootWait
+		}
+	}
+	return instance.Protocol == rdpProtocol && probeRDP, timeout
+}
 
-	iapResult := <-iapOutputChan
-	if !iapResult.tunnelCreated {
-		if err := writeToSocket(ws, strings.Join(iapResult.cmdOutput, "\n"), fmt.Errorf(iapTunnelError, instance.Name)); err != nil {
-			iapResult.err = err
+// waitForTunnel probes the local port until it accepts connections, optionally sending an X.224 connection
+// request through it, and fails early if the tunnel reports a failure or the timeout passes. The port isn't
+// probed until bound is closed, a nil bound means the tunnel already holds the port.
+func waitForTunnel(ctx context.Context, port int, probeRDP bool, timeout time.Duration, bound <-chan struct{}, failed <-chan error) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(tunnelProbeInterval)
+	defer ticker.Stop()
+
+	listening := bound == nil
+	for {
+		if !listening {
+			select {
+			case <-bound:
+				listening = true
+			default:
+			}
 		}
-	} else {
-		if err := writeToSocket(ws, fmt.Sprintf(iapTunnelStarted, instance.Name, port, rdpContextTimeout), nil); err != nil {
-			iapResult.err = err
+
+		lastErr := fmt.Errorf(tunnelNotListening, port)
+		if listening {
+			if lastErr = probeTunnelPort(port, probeRDP); lastErr == nil {
+				return nil
+			}
+		}
+
+		select {
+		case err := <-failed:
+			return err
+		case <-deadline.C:
+			return fmt.Errorf(tunnelNotReady, port, timeout, lastErr)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
+}
 
-	outputChan <- iapResult
+// probeTunnelPort connects to the local end of the tunnel
+func probeTunnelPort(port int, probeRDP bool) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(tunnelHost, strconv.Itoa(port)), tunnelDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	<-ctx.Done()
-	log.Println("calling cancel func")
-	cmdCancel()
+	if probeRDP {
+		return probeX224(conn, tunnelDialTimeout)
+	}
+	return nil
+}
+
+// reportTunnelReadiness writes the tunnel_ready or tunnel_failed event to the socket and returns the result
+func reportTunnelReadiness(ws conn, instance *Instance, port int, started time.Time, closesIn time.Duration, cmdOutput []string, err error) iapResult {
+	if instance.proxyPort != 0 {
+		port = instance.proxyPort
+	}
+	event := &tunnelEvent{Port: port, ElapsedMs: time.Since(started).Milliseconds()}
+	result := iapResult{tunnelCreated: err == nil, cmdOutput: cmdOutput}
+
+	var writeErr error
+	if err != nil {
+		event.Type = tunnelFailedEvent
+		event.Detail = err.Error()
+		writeErr = writeEventToSocket(ws, strings.Join(cmdOutput, "\n"), fmt.Errorf(iapTunnelError, instance.Name), event)
+	} else {
+		event.Type = tunnelReadyEvent
+		writeErr = writeEventToSocket(ws, fmt.Sprintf(iapTunnelStarted, instance.Name, port, closesIn), nil, event)
+	}
+	if writeErr != nil {
+		result.err = writeErr
+	}
+	return result
 }
 
 // startRdpProgram starts the RDP program if the command is sent to the server
 func (gcloudExecutor *GcloudExecutor) startRdpProgram(ws conn, creds *credentials, port int, quit chan<- bool) {
-	log.Println("Starting xfreerdp for ", creds.Username)
-	cmd := fmt.Sprintf(rdpProgramCmd, port, creds.Username, creds.Password)
-	instanceOutput, err := gcloudExecutor.shell.ExecuteCmd(cmd)
+	launcher, err := newRdpLauncher(gcloudExecutor.settings)
+	if err != nil {
+		writeToSocket(ws, "", err)
+		return
+	}
+	launch, err := launcher.launch(creds, port)
+	if err != nil {
+		writeToSocket(ws, "", err)
+		return
+	}
+	if launch.cleanup != nil {
+		defer launch.cleanup()
+	}
+
+	log.Printf("Starting %v for %v", gcloudExecutor.settings.launcher, creds.Username)
+	var started func(int)
+	if session := gcloudExecutor.session; session != nil {
+		started = session.setClientPid
+		defer session.setClientPid(0)
+	}
+	instanceOutput, err := gcloudExecutor.shell.ExecuteCmdWithStdin(launch.args, launch.stdin, started)
 
 	if err != nil {
 		writeToSocket(ws, "", fmt.Errorf(rdpProgramError, creds.Username))
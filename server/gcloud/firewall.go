@@ -0,0 +1,234 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// firewallProtocol is an allowed or denied entry of a firewall rule
+type firewallProtocol struct {
+	IPProtocol string   `json:"IPProtocol"`
+	Ports      []string `json:"ports"`
+}
+
+// firewallRule is used as a structure for gcloud compute firewall-rules.
+type firewallRule struct {
+	Name                  string             `json:"name"`
+	Description           string             `json:"description"`
+	Network               string             `json:"network"`
+	Direction             string             `json:"direction"`
+	Disabled              bool               `json:"disabled"`
+	Priority              int                `json:"priority"`
+	SourceRanges          []string           `json:"sourceRanges"`
+	TargetTags            []string           `json:"targetTags"`
+	TargetServiceAccounts []string           `json:"targetServiceAccounts"`
+	Allowed               []firewallProtocol `json:"allowed"`
+	Denied                []firewallProtocol `json:"denied"`
+}
+
+// remotePort returns the port on the instance that is forwarded, sessions without one use RDP
+func (instance *Instance) remotePort() int {
+	if instance.RemotePort == 0 {
+		return rdpPort
+	}
+	return instance.RemotePort
+}
+
+// firewallRuleSuffix returns the name of the instance's IAP firewall rule after the prefix, RDP rules
+// only use the instance name while other ports also include the port.
+func firewallRuleSuffix(instance *Instance) string {
+	if instance.remotePort() == rdpPort {
+		return instance.Name
+	}
+	return fmt.Sprintf("%s-%d", instance.Name, instance.remotePort())
+}
+
+// listFirewallRules runs the gcloud firewall-rules list command for the project and parses the output
+func (gcloudExecutor *GcloudExecutor) listFirewallRules(projectName string) ([]firewallRule, error) {
+	output, err := gcloudExecutor.shell.ExecuteCmd(fmt.Sprintf(firewallListCmd, projectName))
+	if err != nil {
+		if stringOutput := strings.ToLower(string(output)); strings.Contains(stringOutput, gcloudAuthError) {
+			return nil, errors.New(SdkAuthError)
+		} else if strings.Contains(stringOutput, projectCmdError) {
+			return nil, errors.New(SdkProjectError)
+		}
+		return nil, fmt.Errorf("%v: %s", err, string(output))
+	}
+
+	var rules []firewallRule
+	if err := json.Unmarshal(output, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// findIapFirewallRule looks for an enabled ingress rule on the instance's network that already lets
+// IAP reach the instance on the port, it returns nil if no such rule exists.
+func (gcloudExecutor *GcloudExecutor) findIapFirewallRule(instance *Instance, port int) (*firewallRule, error) {
+	if len(instance.NetworkInterfaces) != 1 {
+		return nil, fmt.Errorf(multipleNetworksError, instance.Name)
+	}
+
+	rules, err := gcloudExecutor.listFirewallRules(instance.ProjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	return matchIapFirewallRule(rules, instance, port), nil
+}
+
+// matchIapFirewallRule returns the highest priority allow rule that lets IAP reach the instance on the port
+// and is not overridden by a deny rule with the same or higher priority.
+func matchIapFirewallRule(rules []firewallRule, instance *Instance, port int) *firewallRule {
+	network := path.Base(instance.NetworkInterfaces[0].Network)
+
+	var allow, deny *firewallRule
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Disabled || !strings.EqualFold(rule.Direction, "INGRESS") || path.Base(rule.Network) != network {
+			continue
+		}
+		if !ruleTargetsInstance(rule, instance) {
+			continue
+		}
+
+		// An allow rule has to cover all of IAP's range, a deny rule blocks IAP if it covers any of it
+		if protocolsMatchPort(rule.Allowed, port) && ruleMatchesIapSource(rule, false) && (allow == nil || rule.Priority < allow.Priority) {
+			allow = rule
+		}
+		if protocolsMatchPort(rule.Denied, port) && ruleMatchesIapSource(rule, true) && (deny == nil || rule.Priority < deny.Priority) {
+			deny = rule
+		}
+	}
+
+	if allow == nil || (deny != nil && deny.Priority <= allow.Priority) {
+		return nil
+	}
+	return allow
+}
+
+// ruleMatchesIapSource checks if any of the source ranges of the rule covers the whole IAP range, or with
+// overlap set if any of them shares an address with it
+func ruleMatchesIapSource(rule *firewallRule, overlap bool) bool {
+	_, iapNet, _ := net.ParseCIDR(iapSourceRange)
+	iapBits, _ := iapNet.Mask.Size()
+
+	for _, sourceRange := range rule.SourceRanges {
+		if !strings.Contains(sourceRange, "/") {
+			sourceRange += "/32"
+		}
+		_, sourceNet, err := net.ParseCIDR(sourceRange)
+		if err != nil {
+			continue
+		}
+		if bits, _ := sourceNet.Mask.Size(); bits <= iapBits && sourceNet.Contains(iapNet.IP) {
+			return true
+		}
+		if overlap && iapNet.Contains(sourceNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleTargetsInstance checks if the rule applies to the instance through its tags or service accounts
+func ruleTargetsInstance(rule *firewallRule, instance *Instance) bool {
+	if len(rule.TargetTags) == 0 && len(rule.TargetServiceAccounts) == 0 {
+		return true
+	}
+
+	for _, tag := range rule.TargetTags {
+		for _, instanceTag := range instance.Tags.Items {
+			if tag == instanceTag {
+				return true
+			}
+		}
+	}
+
+	for _, account := range rule.TargetServiceAccounts {
+		for _, instanceAccount := range instance.ServiceAccounts {
+			if account == instanceAccount.Email {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protocolsMatchPort checks if any of the protocol entries covers tcp traffic on the port
+func protocolsMatchPort(protocols []firewallProtocol, port int) bool {
+	for _, protocol := range protocols {
+		if p := strings.ToLower(protocol.IPProtocol); p != "tcp" && p != "all" && p != "6" {
+			continue
+		}
+		if len(protocol.Ports) == 0 {
+			return true
+		}
+		for _, ports := range protocol.Ports {
+			if portInRange(ports, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portInRange checks if the port is equal to a single port or inside a range such as 3000-4000
+func portInRange(ports string, port int) bool {
+	bounds := strings.SplitN(ports, "-", 2)
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(bounds[1]); err != nil {
+			log.Println(err)
+			return false
+		}
+	}
+	return port >= low && port <= high
+}
+
+// checkExistingFirewall is the preflight run before creating a firewall rule, it reports any rule that
+// already allows IAP to the instance and returns true if creating one can be skipped.
+func (gcloudExecutor *GcloudExecutor) checkExistingFirewall(ws conn, instance *Instance, port int) bool {
+	rule, err := gcloudExecutor.findIapFirewallRule(instance, port)
+	if err != nil {
+		log.Println(err)
+		writeToSocket(ws, fmt.Sprintf(firewallListError, instance.Name), nil)
+		return false
+	}
+
+	if rule == nil {
+		writeToSocket(ws, fmt.Sprintf(noExistingFirewallRuleOutput, instance.Name, port), nil)
+		return false
+	}
+
+	log.Printf("Firewall rule %v matches %v", rule.Name, instance.Name)
+	writeToSocket(ws, fmt.Sprintf(existingFirewallRuleOutput, rule.Name, instance.Name, port), nil)
+	return true
+}
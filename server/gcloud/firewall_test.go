@@ -0,0 +1,151 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+var firewallListOutput = []byte(`[
+  {
+    "name": "allow-iap-rdp",
+    "network": "https://www.googleapis.com/compute/v1/projects/valid/global/networks/default",
+    "direction": "INGRESS",
+    "disabled": false,
+    "priority": 1000,
+    "sourceRanges": ["35.235.240.0/20"],
+    "targetTags": ["rdp"],
+    "allowed": [{"IPProtocol": "tcp", "ports": ["22", "3000-4000"]}]
+  }
+]`)
+
+func TestMatchIapFirewallRule(t *testing.T) {
+	var instanceToUse Instance
+	json.Unmarshal(instance, &instanceToUse)
+	instanceToUse.Tags.Items = []string{"rdp"}
+
+	var rules []firewallRule
+	if err := json.Unmarshal(firewallListOutput, &rules); err != nil {
+		t.Fatal(err)
+	}
+
+	if rule := matchIapFirewallRule(rules, &instanceToUse, rdpPort); rule == nil || rule.Name != "allow-iap-rdp" {
+		t.Errorf("matchIapFirewallRule didn't match rule allowing port range, got %v", rule)
+	}
+
+	if rule := matchIapFirewallRule(rules, &instanceToUse, 5986); rule != nil {
+		t.Errorf("matchIapFirewallRule matched rule on a port it doesn't allow")
+	}
+
+	instanceToUse.Tags.Items = nil
+	if rule := matchIapFirewallRule(rules, &instanceToUse, rdpPort); rule != nil {
+		t.Errorf("matchIapFirewallRule matched rule that doesn't target the instance")
+	}
+
+	rules[0].TargetTags = nil
+	rules[0].TargetServiceAccounts = []string{"vm@project.iam.gserviceaccount.com"}
+	instanceToUse.ServiceAccounts = []serviceAccount{{Email: "vm@project.iam.gserviceaccount.com"}}
+	if rule := matchIapFirewallRule(rules, &instanceToUse, rdpPort); rule == nil {
+		t.Errorf("matchIapFirewallRule didn't match rule targeting the instance's service account")
+	}
+
+	rules[0].SourceRanges = []string{"35.235.241.0/24"}
+	if rule := matchIapFirewallRule(rules, &instanceToUse, rdpPort); rule != nil {
+		t.Errorf("matchIapFirewallRule matched rule that only covers part of the IAP range")
+	}
+
+	rules[0].SourceRanges = []string{"0.0.0.0/0"}
+	deny := firewallRule{Name: "deny-all", Network: "default", Direction: "INGRESS", Priority: 100, SourceRanges: []string{"0.0.0.0/0"}, Denied: []firewallProtocol{{IPProtocol: "all"}}}
+	if rule := matchIapFirewallRule(append(rules, deny), &instanceToUse, rdpPort); rule != nil {
+		t.Errorf("matchIapFirewallRule matched rule overridden by a higher priority deny rule")
+	}
+
+	deny.SourceRanges = []string{"35.235.240.0/24"}
+	if rule := matchIapFirewallRule(append(rules, deny), &instanceToUse, rdpPort); rule != nil {
+		t.Errorf("matchIapFirewallRule matched rule overridden by a deny rule on part of the IAP range")
+	}
+	deny.SourceRanges = []string{"10.0.0.0/8"}
+	if rule := matchIapFirewallRule(append(rules, deny), &instanceToUse, rdpPort); rule == nil {
+		t.Errorf("matchIapFirewallRule didn't match rule with a deny rule outside the IAP range")
+	}
+
+	rules[0].Disabled = true
+	if rule := matchIapFirewallRule(rules, &instanceToUse, rdpPort); rule != nil {
+		t.Errorf("matchIapFirewallRule matched a disabled rule")
+	}
+}
+
+func TestCheckExistingFirewall(t *testing.T) {
+	var socketOutput socketMessage
+
+	readMessage := func() (messageType int, p []byte, err error) {
+		return websocket.TextMessage, nil, nil
+	}
+
+	writeJSON := func(v interface{}) error {
+		socketOutput = *(v.(*socketMessage))
+		return nil
+	}
+
+	closeFunc := func() error {
+		return nil
+	}
+
+	ws := newMockWebSocket(readMessage, writeJSON, closeFunc)
+
+	var instanceToUse Instance
+	json.Unmarshal(instance, &instanceToUse)
+	g := NewGcloudExecutor(&mockShell{})
+
+	instanceToUse.ProjectName = "valid"
+	instanceToUse.Tags.Items = []string{"rdp"}
+	if !g.checkExistingFirewall(ws, &instanceToUse, rdpPort) {
+		t.Errorf("checkExistingFirewall didn't skip creation with a matching rule")
+	}
+	if expected := fmt.Sprintf(existingFirewallRuleOutput, "allow-iap-rdp", instanceToUse.Name, rdpPort); socketOutput.Message != expected {
+		t.Errorf("checkExistingFirewall didn't report matching rule, got %v, expected %v", socketOutput.Message, expected)
+	}
+
+	instanceToUse.Tags.Items = nil
+	if g.checkExistingFirewall(ws, &instanceToUse, rdpPort) {
+		t.Errorf("checkExistingFirewall skipped creation without a matching rule")
+	}
+
+	instanceToUse.ProjectName = "auth-error"
+	if g.checkExistingFirewall(ws, &instanceToUse, rdpPort) {
+		t.Errorf("checkExistingFirewall skipped creation when listing rules failed")
+	}
+	if expected := fmt.Sprintf(firewallListError, instanceToUse.Name); socketOutput.Message != expected {
+		t.Errorf("checkExistingFirewall didn't report list error, got %v, expected %v", socketOutput.Message, expected)
+	}
+}
+
+func TestFirewallRuleSuffix(t *testing.T) {
+	rdpInstance := Instance{Name: "vm"}
+	if suffix := firewallRuleSuffix(&rdpInstance); suffix != "vm" {
+		t.Errorf("firewallRuleSuffix changed name of RDP rule, got %v", suffix)
+	}
+
+	sshInstance := Instance{Name: "vm", RemotePort: 22}
+	if suffix := firewallRuleSuffix(&sshInstance); suffix != "vm-22" {
+		t.Errorf("firewallRuleSuffix didn't include port, got %v, expected %v", suffix, "vm-22")
+	}
+}
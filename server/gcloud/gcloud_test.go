@@ -23,9 +23,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -113,6 +115,16 @@ var (
 ]`)
 )
 
+const tunnelListeningOutput = "Listening on port [9999]."
+
+var testTime = time.Date(2020, time.June, 20, 0, 0, 0, 0, time.UTC)
+
+func init() {
+	timeNow = func() time.Time {
+		return testTime
+	}
+}
+
 type mockShell struct{}
 
 func (*mockShell) ExecuteCmd(cmd string) ([]byte, error) {
@@ -125,24 +137,45 @@ func (*mockShell) ExecuteCmd(cmd string) ([]byte, error) {
 	if cmd == fmt.Sprintf("%s%s", getComputeInstancesForProjectPrefix, "invalidProject") {
 		return invalidProjectOutput, errors.New("error")
 	}
-	if cmd == fmt.Sprintf(rdpProgramCmd, 9999, "quit", "password") {
-		return []byte("output"), nil
-	}
-	if cmd == fmt.Sprintf(rdpProgramCmd, 9999, "error", "password") {
-		return []byte("output"), errors.New("error")
-	}
-	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", "test-project", "auth-error", "default") {
+	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", rdpPort, "test-project", "auth-error", "default", firewallDescription(testTime.Add(firewallContextTimeout))) {
 		return []byte(gcloudAuthError), errors.New("error")
 	}
-	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", "test-project", "project-error", "default") {
+	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", rdpPort, "test-project", "project-error", "default", firewallDescription(testTime.Add(firewallContextTimeout))) {
 		return []byte(projectCmdError), errors.New("error")
 	}
-	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", "test-project", "exists", "default") {
+	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", rdpPort, "test-project", "exists", "default", firewallDescription(testTime.Add(firewallContextTimeout))) {
 		return []byte(fmt.Sprintf(firewallRuleExistsCmdOutput, "exists", "test-project")), errors.New("error")
 	}
-	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", "test-project", "valid", "default") {
+	if cmd == fmt.Sprintf(iapFirewallCreateCmd, "test-project", rdpPort, "test-project", "valid", "default", firewallDescription(testTime.Add(firewallContextTimeout))) {
 		return []byte(""), nil
 	}
+	if cmd == fmt.Sprintf(firewallListCmd, "valid") {
+		return firewallListOutput, nil
+	}
+	if cmd == fmt.Sprintf(resetPasswordCmd, "valid", "quit", "us-west1-b", "test-project") {
+		return []byte("WARNING: Instance creation may take a few minutes\n" + resetPasswordJSON), nil
+	}
+	if cmd == fmt.Sprintf(resetPasswordCmd, "auth-error", "quit", "us-west1-b", "test-project") {
+		return []byte(gcloudAuthError), errors.New("error")
+	}
+	if cmd == accessTokenCmd {
+		return []byte("test-token\n"), nil
+	}
+	if cmd == gcloudAccountCmd {
+		return []byte("user@example.com\n"), nil
+	}
+	if cmd == fmt.Sprintf(firewallListCmd, "sweep") {
+		return sweepFirewallListOutput, nil
+	}
+	if cmd == fmt.Sprintf(firewallDeleteByNameCmd, "admin-extension-private-rdp-expired", "sweep") {
+		return []byte(""), nil
+	}
+	if cmd == fmt.Sprintf(firewallDeleteByNameCmd, "admin-extension-private-rdp-failing", "sweep") {
+		return []byte(gcloudAuthError), errors.New("error")
+	}
+	if cmd == fmt.Sprintf(firewallListCmd, "auth-error") {
+		return []byte(gcloudAuthError), errors.New("error")
+	}
 
 	return nil, nil
 }
@@ -151,14 +184,38 @@ func (*mockShell) ExecuteCmdWithContext(_ context.Context, _ string) ([]byte, er
 	return nil, nil
 }
 
+func (*mockShell) ExecuteCmdWithStdin(args []string, stdin []byte, started func(int)) ([]byte, error) {
+	if reflect.DeepEqual(args, []string{"xfreerdp", "/v:localhost", "/port:9999", "/u:quit", "/from-stdin", "/cert-ignore", "/sec:nla"}) && string(stdin) == "password\n" {
+		if started != nil {
+			started(4242)
+		}
+		return []byte("output"), nil
+	}
+	if reflect.DeepEqual(args, []string{"xfreerdp", "/v:localhost", "/port:9999", "/u:error", "/from-stdin", "/cert-ignore"}) {
+		return []byte("output"), errors.New("error")
+	}
+	return nil, nil
+}
+
 func (*mockShell) ExecuteCmdReader(cmd string) ([]io.ReadCloser, context.CancelFunc, error) {
 	var instanceToUse Instance
 	json.Unmarshal(instance, &instanceToUse)
-	if cmd == fmt.Sprintf(iapTunnelCmd, "test-project", "invalid", 9999, instanceToUse.Zone) {
+	if cmd == fmt.Sprintf(iapTunnelCmd, "test-project", rdpPort, "invalid", 9999, instanceToUse.Zone) {
 		return []io.ReadCloser{ioutil.NopCloser(strings.NewReader("")), ioutil.NopCloser(strings.NewReader(gcloudErrorOutput))}, nil, nil
 	}
-	if cmd == fmt.Sprintf(iapTunnelCmd, "test-project", "valid", 9999, instanceToUse.Zone) {
-		return []io.ReadCloser{ioutil.NopCloser(strings.NewReader("")), ioutil.NopCloser(strings.NewReader(tunnelCreatedOutput))}, nil, nil
+	if cmd == fmt.Sprintf(iapTunnelCmd, "test-project", rdpPort, "valid", 9999, instanceToUse.Zone) {
+		// Bind the local port like gcloud would so the readiness probe succeeds
+		listener, err := net.Listen("tcp", "127.0.0.1:9999")
+		if err != nil {
+			return nil, nil, err
+		}
+		// Keep stderr open like the running gcloud command until it is cancelled
+		stderr, stderrWriter := io.Pipe()
+		go io.WriteString(stderrWriter, tunnelListeningOutput+"\n")
+		return []io.ReadCloser{ioutil.NopCloser(strings.NewReader("")), stderr}, func() {
+			listener.Close()
+			stderrWriter.Close()
+		}, nil
 	}
 	return nil, nil, nil
 }
@@ -0,0 +1,255 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// just in time IAP grant consts
+const (
+	iapTunnelRole         string = "roles/iap.tunnelResourceAccessor"
+	iapGrantTitlePrefix   string = "admin-extension-jit-"
+	iapGrantDescription   string = "admin-extension-jit-expires=%s"
+	iapGrantExpression    string = `request.time < timestamp("%s") && destination.port == %d`
+	gcloudAccountCmd      string = "gcloud config get-value account"
+	iamPolicyVersion      int    = 3
+	iamPolicyAttempts     int    = 3
+	iapGrantedEvent       string = "access_granted"
+	iapGrantedOutput      string = "Granted %v IAP tunnel access to %v until %v, it can take a minute to apply"
+	iapRevokedOutput      string = "Removed the IAP tunnel access granted to %v for %v"
+	iapGrantError         string = "Could not grant IAP tunnel access to %v: %v"
+	iapRevokeError        string = "Could not remove the IAP tunnel access to %v, it still expires with the session: %v"
+	iapRenewError         string = "Could not extend the IAP tunnel access to %v, new connections fail after the old deadline: %v"
+	noGcloudAccount       string = "No gcloud account is set, run gcloud auth login"
+	serviceAccountSuffix  string = ".gserviceaccount.com"
+	iapGrantNotFoundError string = "binding %v is no longer in the policy"
+)
+
+// iamCondition restricts when a binding applies
+type iamCondition struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Expression  string `json:"expression"`
+}
+
+// iamBinding gives the members a role, only while the condition holds if it has one
+type iamBinding struct {
+	Role      string        `json:"role"`
+	Members   []string      `json:"members"`
+	Condition *iamCondition `json:"condition,omitempty"`
+}
+
+// iamPolicy is the IAM policy of a resource, the etag makes writes fail if it changed since it was read
+type iamPolicy struct {
+	Version  int          `json:"version,omitempty"`
+	Bindings []iamBinding `json:"bindings,omitempty"`
+	Etag     string       `json:"etag,omitempty"`
+}
+
+// iapGrant is a conditional binding of the tunnel role added for one session
+type iapGrant struct {
+	project  string
+	resource string
+	member   string
+	title    string
+	port     int
+}
+
+// iapTunnelResource returns the name of the IAP tunnel resource of the instance
+func iapTunnelResource(instance *Instance) string {
+	return fmt.Sprintf("projects/%v/iap_tunnel/zones/%v/instances/%v", instance.ProjectName, instance.Zone, instance.Name)
+}
+
+// iamMember returns the IAM member of a gcloud account
+func iamMember(account string) string {
+	if strings.HasSuffix(account, serviceAccountSuffix) {
+		return "serviceAccount:" + account
+	}
+	return "user:" + account
+}
+
+// grantCondition returns the condition of a grant that expires at the deadline
+func grantCondition(title string, port int, expires time.Time) *iamCondition {
+	expiry := expires.UTC().Format(time.RFC3339)
+	return &iamCondition{
+		Title:       title,
+		Description: fmt.Sprintf(iapGrantDescription, expiry),
+		Expression:  fmt.Sprintf(iapGrantExpression, expiry, port),
+	}
+}
+
+// setGrant adds or replaces the binding of a grant, replace only changes a binding that is already there
+func (policy *iamPolicy) setGrant(member string, condition *iamCondition, replace bool) bool {
+	for i, binding := range policy.Bindings {
+		if binding.Role == iapTunnelRole && binding.Condition != nil && binding.Condition.Title == condition.Title {
+			policy.Bindings[i] = iamBinding{Role: iapTunnelRole, Members: []string{member}, Condition: condition}
+			return true
+		}
+	}
+	if replace {
+		return false
+	}
+	policy.Bindings = append(policy.Bindings, iamBinding{Role: iapTunnelRole, Members: []string{member}, Condition: condition})
+	return true
+}
+
+// removeGrant removes the member from the bindings with the grant's title, it returns false if there were none
+func (policy *iamPolicy) removeGrant(member, title string) bool {
+	removed := false
+	var bindings []iamBinding
+	for _, binding := range policy.Bindings {
+		if binding.Role == iapTunnelRole && binding.Condition != nil && binding.Condition.Title == title {
+			var members []string
+			for _, m := range binding.Members {
+				if m != member {
+					members = append(members, m)
+				}
+			}
+			removed = removed || len(members) != len(binding.Members)
+			if len(members) == 0 {
+				continue
+			}
+			binding.Members = members
+		}
+		bindings = append(bindings, binding)
+	}
+	policy.Bindings = bindings
+	return removed
+}
+
+// modifyIapPolicy reads the policy of the IAP tunnel resource, applies change and writes it back if change
+// returns true. Writes that race another change to the policy are retried with the new policy.
+func modifyIapPolicy(shell shell, resource string, change func(*iamPolicy) bool) error {
+	token, err := gcloudAccessToken(shell)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%v/v1/%v", iapURL, resource)
+	for attempt := 1; ; attempt++ {
+		var policy iamPolicy
+		options := map[string]interface{}{"options": map[string]int{"requestedPolicyVersion": iamPolicyVersion}}
+		if err := postIam(url+":getIamPolicy", token, options, &policy); err != nil {
+			return err
+		}
+		if !change(&policy) {
+			return nil
+		}
+
+		// Conditional bindings are only kept by version 3 policies
+		policy.Version = iamPolicyVersion
+		err := postIam(url+":setIamPolicy", token, map[string]interface{}{"policy": policy}, &iamPolicy{})
+		if err == nil || !errors.Is(err, errIamConflict) || attempt == iamPolicyAttempts {
+			return err
+		}
+	}
+}
+
+// gcloudAccount returns the account gcloud uses, which is the one IAP sees opening the tunnel
+func (gcloudExecutor *GcloudExecutor) gcloudAccount() (string, error) {
+	output, err := gcloudExecutor.shell.ExecuteCmd(gcloudAccountCmd)
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, string(output))
+	}
+	account := strings.TrimSpace(string(output))
+	if account == "" {
+		return "", errors.New(noGcloudAccount)
+	}
+	return account, nil
+}
+
+// grantIapAccess adds a binding of the tunnel role for the gcloud account on the instance that expires at
+// the deadline. The grant is recorded with the sweeper so it is removed even if the server stops.
+func (gcloudExecutor *GcloudExecutor) grantIapAccess(ws conn, instance *Instance, deadline time.Time) (*iapGrant, error) {
+	account, err := gcloudExecutor.gcloudAccount()
+	if err != nil {
+		return nil, fmt.Errorf(iapGrantError, instance.Name, err)
+	}
+
+	grant := &iapGrant{
+		project:  instance.ProjectName,
+		resource: iapTunnelResource(instance),
+		member:   iamMember(account),
+		title:    iapGrantTitlePrefix + newSessionID(),
+		port:     instance.remotePort(),
+	}
+	condition := grantCondition(grant.title, grant.port, deadline)
+	if err := modifyIapPolicy(gcloudExecutor.shell, grant.resource, func(policy *iamPolicy) bool {
+		return policy.setGrant(grant.member, condition, false)
+	}); err != nil {
+		return nil, fmt.Errorf(iapGrantError, instance.Name, err)
+	}
+
+	sweeper.schedule(grant.pendingDeletion(deadline))
+	writeEventToSocket(ws, fmt.Sprintf(iapGrantedOutput, account, instance.Name, deadline.Format(time.RFC3339)), nil,
+		&tunnelEvent{Type: iapGrantedEvent, Detail: grant.title})
+	return grant, nil
+}
+
+// renewIapGrant moves the expiry of the grant to the new deadline of its session
+func (gcloudExecutor *GcloudExecutor) renewIapGrant(grant *iapGrant, deadline time.Time) error {
+	condition := grantCondition(grant.title, grant.port, deadline)
+	found := true
+	err := modifyIapPolicy(gcloudExecutor.shell, grant.resource, func(policy *iamPolicy) bool {
+		found = policy.setGrant(grant.member, condition, true)
+		return found
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf(iapGrantNotFoundError, grant.title)
+	}
+	sweeper.schedule(grant.pendingDeletion(deadline))
+	return nil
+}
+
+// revokeIapGrant removes the grant's binding, if that fails the sweeper retries until it is gone
+func (gcloudExecutor *GcloudExecutor) revokeIapGrant(ws conn, instance *Instance, grant *iapGrant) {
+	if err := removeIapGrant(gcloudExecutor.shell, grant.resource, grant.member, grant.title); err != nil {
+		log.Println(err)
+		writeToSocket(ws, "", fmt.Errorf(iapRevokeError, instance.Name, err))
+		sweeper.schedule(grant.pendingDeletion(timeNow()))
+		return
+	}
+	sweeper.forget(iapGrantDeletionKind, grant.project, grant.title)
+	writeToSocket(ws, fmt.Sprintf(iapRevokedOutput, strings.SplitN(grant.member, ":", 2)[1], instance.Name), nil)
+}
+
+// removeIapGrant removes the member's binding with the title from the IAP tunnel resource
+func removeIapGrant(shell shell, resource, member, title string) error {
+	return modifyIapPolicy(shell, resource, func(policy *iamPolicy) bool {
+		return policy.removeGrant(member, title)
+	})
+}
+
+// pendingDeletion returns the sweeper's record of the grant, it is removed once due
+func (grant *iapGrant) pendingDeletion(due time.Time) pendingDeletion {
+	return pendingDeletion{
+		Kind:     iapGrantDeletionKind,
+		Project:  grant.project,
+		Name:     grant.title,
+		Resource: grant.resource,
+		Member:   grant.member,
+		NextTry:  due,
+	}
+}
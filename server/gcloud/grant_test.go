@@ -0,0 +1,132 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTunnelResource = "projects/test-project/iap_tunnel/zones/us-west1-b/instances/vm"
+
+// policyServer keeps the IAM policy of the test instance's tunnel resource, checking etags like IAM does
+type policyServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	policy    iamPolicy
+	version   int
+	conflicts int
+}
+
+func newPolicyServer(bindings ...iamBinding) *policyServer {
+	s := &policyServer{policy: iamPolicy{Bindings: bindings}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/" + testTunnelResource + ":getIamPolicy":
+			s.policy.Etag = fmt.Sprint(s.version)
+			json.NewEncoder(w).Encode(s.policy)
+		case "/v1/" + testTunnelResource + ":setIamPolicy":
+			var request struct {
+				Policy iamPolicy `json:"policy"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			if s.conflicts > 0 || request.Policy.Etag != fmt.Sprint(s.version) {
+				s.conflicts--
+				s.version++
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			s.version++
+			s.policy = request.Policy
+			json.NewEncoder(w).Encode(s.policy)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	iapURL = s.URL
+	return s
+}
+
+func (s *policyServer) bindings() []iamBinding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]iamBinding(nil), s.policy.Bindings...)
+}
+
+func TestIapGrant(t *testing.T) {
+	standing := iamBinding{Role: "roles/viewer", Members: []string{"user:admin@example.com"}}
+	server := newPolicyServer(standing)
+	defer server.Close()
+	server.conflicts = 1
+
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b", RemotePort: rdpPort}
+	deadline := time.Date(2020, time.June, 20, 9, 0, 0, 0, time.UTC)
+	ws, written := recordingWebSocket(nil)
+	g := NewGcloudExecutor(&mockShell{})
+
+	grant, err := g.grantIapAccess(ws, instanceToUse, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := server.bindings()
+	if len(bindings) != 2 || bindings[0].Role != standing.Role {
+		t.Fatalf("grantIapAccess didn't keep the existing bindings, got %v", bindings)
+	}
+	granted := bindings[1]
+	if granted.Role != iapTunnelRole || granted.Members[0] != "user:user@example.com" || granted.Condition == nil {
+		t.Fatalf("grantIapAccess added the wrong binding, got %+v", granted)
+	}
+	if expected := `request.time < timestamp("2020-06-20T09:00:00Z") && destination.port == 3389`; granted.Condition.Expression != expected {
+		t.Errorf("grantIapAccess got condition %v, expected %v", granted.Condition.Expression, expected)
+	}
+	if output := written(); len(output) != 1 || output[0].Event == nil || output[0].Event.Detail != grant.title {
+		t.Errorf("grantIapAccess didn't report the grant on the socket, got %v", output)
+	}
+
+	if err := g.renewIapGrant(grant, deadline.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if bindings = server.bindings(); len(bindings) != 2 || !strings.Contains(bindings[1].Condition.Expression, "2020-06-20T10:00:00Z") {
+		t.Errorf("renewIapGrant didn't move the expiry, got %v", bindings)
+	}
+
+	g.revokeIapGrant(ws, instanceToUse, grant)
+	if bindings = server.bindings(); len(bindings) != 1 || bindings[0].Role != standing.Role {
+		t.Errorf("revokeIapGrant didn't remove only the grant, got %v", bindings)
+	}
+	if err := g.renewIapGrant(grant, deadline.Add(2*time.Hour)); err == nil {
+		t.Errorf("renewIapGrant added back a grant that was removed")
+	}
+}
+
+func TestIamMember(t *testing.T) {
+	if member := iamMember("runner@test-project.iam.gserviceaccount.com"); member != "serviceAccount:runner@test-project.iam.gserviceaccount.com" {
+		t.Errorf("iamMember got %v for a service account", member)
+	}
+	if member := iamMember("user@example.com"); member != "user:user@example.com" {
+		t.Errorf("iamMember got %v for a user", member)
+	}
+}
@@ -0,0 +1,187 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// IAM preflight consts
+const (
+	permissionIapTunnel       string = "iap.tunnelInstances.accessViaIAP"
+	permissionFirewallCreate  string = "compute.firewalls.create"
+	permissionFirewallDelete  string = "compute.firewalls.delete"
+	permissionInstanceGet     string = "compute.instances.get"
+	permissionIapGetPolicy    string = "iap.tunnelInstances.getIamPolicy"
+	permissionIapSetPolicy    string = "iap.tunnelInstances.setIamPolicy"
+	permissionsEvent          string = "permissions"
+	permissionsOutput         string = "You have the permissions needed to connect to %v"
+	permissionsMissing        string = "Missing permissions on %v: %v"
+	firewallPermissionWarning string = "Missing %v, the session only works if a firewall rule already allows IAP to %v"
+	permissionCheckError      string = "Could not check permissions on %v: %v"
+	missingPermissionValues   string = "Project, zone and instance name are needed to check permissions"
+)
+
+// requiredPermissions are what a session needs, the firewall ones only if no existing rule allows IAP
+var requiredPermissions = []string{permissionIapTunnel, permissionFirewallCreate, permissionFirewallDelete, permissionInstanceGet}
+
+// jitRequiredPermissions replace the tunnel permission with the ones needed to grant it for the session
+var jitRequiredPermissions = []string{permissionIapGetPolicy, permissionIapSetPolicy, permissionFirewallCreate, permissionFirewallDelete, permissionInstanceGet}
+
+// IAM endpoints, replaced in tests
+var (
+	resourceManagerURL = "https://cloudresourcemanager.googleapis.com"
+	computeURL         = "https://compute.googleapis.com"
+	iapURL             = "https://iap.googleapis.com"
+	iamHTTPClient      = &http.Client{Timeout: 20 * time.Second}
+)
+
+// PermissionReport is the result of checking the caller's permissions for a session
+type PermissionReport struct {
+	Project  string   `json:"project"`
+	Instance string   `json:"instance"`
+	Granted  []string `json:"granted"`
+	Missing  []string `json:"missing"`
+}
+
+// blocking returns the missing permissions that stop a session even if a firewall rule already exists
+func (r *PermissionReport) blocking() []string {
+	var blocking []string
+	for _, permission := range r.Missing {
+		if permission != permissionFirewallCreate && permission != permissionFirewallDelete {
+			blocking = append(blocking, permission)
+		}
+	}
+	return blocking
+}
+
+// errIamConflict is returned when a policy changed between reading and writing it
+var errIamConflict = errors.New("IAM policy was changed concurrently")
+
+// postIam posts the request as JSON to an IAM method at the url and decodes the reply into response
+func postIam(url, token string, request, response interface{}) error {
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := iamHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w: %s", errIamConflict, strings.TrimSpace(string(data)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, response)
+}
+
+// testIamPermissions posts a test permissions request to the url and returns the permissions that are granted
+func testIamPermissions(url, token string, permissions []string) ([]string, error) {
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := postIam(url, token, map[string][]string{"permissions": permissions}, &granted); err != nil {
+		return nil, err
+	}
+	return granted.Permissions, nil
+}
+
+// CheckPermissions tests the caller's permissions on the instance's project, the instance and its IAP tunnel
+// resource, a permission granted on any of them counts. Nothing is changed by the check.
+func (gcloudExecutor *GcloudExecutor) CheckPermissions(instance *Instance) (*PermissionReport, error) {
+	required, iapPermissions := requiredPermissions, []string{permissionIapTunnel}
+	if gcloudExecutor.settings.jitGrant {
+		required, iapPermissions = jitRequiredPermissions, []string{permissionIapGetPolicy, permissionIapSetPolicy}
+	}
+
+	if instance.ProjectName == "" || instance.Zone == "" || instance.Name == "" {
+		return nil, errors.New(missingPermissionValues)
+	}
+	token, err := gcloudAccessToken(gcloudExecutor.shell)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []struct {
+		url         string
+		permissions []string
+	}{
+		{fmt.Sprintf("%v/v1/projects/%v:testIamPermissions", resourceManagerURL, instance.ProjectName), required},
+		{fmt.Sprintf("%v/compute/v1/projects/%v/zones/%v/instances/%v/testIamPermissions", computeURL, instance.ProjectName, instance.Zone, instance.Name), []string{permissionInstanceGet}},
+		{fmt.Sprintf("%v/v1/%v:testIamPermissions", iapURL, iapTunnelResource(instance)), iapPermissions},
+	}
+
+	granted := make(map[string]bool)
+	for _, check := range checks {
+		permissions, err := testIamPermissions(check.url, token, check.permissions)
+		if err != nil {
+			return nil, fmt.Errorf(permissionCheckError, instance.Name, err)
+		}
+		for _, permission := range permissions {
+			granted[permission] = true
+		}
+	}
+
+	report := &PermissionReport{Project: instance.ProjectName, Instance: instance.Name, Granted: []string{}, Missing: []string{}}
+	for _, permission := range required {
+		if granted[permission] {
+			report.Granted = append(report.Granted, permission)
+		} else {
+			report.Missing = append(report.Missing, permission)
+		}
+	}
+	return report, nil
+}
+
+// preflightPermissions reports the caller's permissions on the socket and errors if one that every
+// session needs is missing. Missing firewall permissions are only a warning since a rule may already exist.
+func (gcloudExecutor *GcloudExecutor) preflightPermissions(ws conn, instance *Instance) error {
+	report, err := gcloudExecutor.CheckPermissions(instance)
+	if err != nil {
+		return err
+	}
+
+	event := &tunnelEvent{Type: permissionsEvent, Detail: strings.Join(report.Missing, ",")}
+	if blocking := report.blocking(); len(blocking) > 0 {
+		writeEventToSocket(ws, "", nil, event)
+		return protocol.WithCode(protocol.CodePermissionDenied, fmt.Errorf(permissionsMissing, instance.Name, strings.Join(blocking, ", ")))
+	}
+	if len(report.Missing) > 0 {
+		return writeEventToSocket(ws, fmt.Sprintf(firewallPermissionWarning, strings.Join(report.Missing, ", "), instance.Name), nil, event)
+	}
+	return writeEventToSocket(ws, fmt.Sprintf(permissionsOutput, instance.Name), nil, event)
+}
@@ -0,0 +1,109 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+// iamServer serves test permissions requests, granting the permissions listed for each path
+func iamServer(granted map[string][]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		permissions, ok := granted[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"permissions": permissions})
+	}))
+
+	resourceManagerURL, computeURL, iapURL = server.URL, server.URL, server.URL
+	return server
+}
+
+func TestCheckPermissions(t *testing.T) {
+	server := iamServer(map[string][]string{
+		"/v1/projects/test-project:testIamPermissions":                                          {permissionFirewallCreate},
+		"/compute/v1/projects/test-project/zones/us-west1-b/instances/vm/testIamPermissions":    {permissionInstanceGet},
+		"/v1/projects/test-project/iap_tunnel/zones/us-west1-b/instances/vm:testIamPermissions": {permissionIapTunnel},
+	})
+	defer server.Close()
+
+	g := NewGcloudExecutor(&mockShell{})
+	report, err := g.CheckPermissions(&Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Missing, []string{permissionFirewallDelete}) {
+		t.Errorf("CheckPermissions got missing %v, expected %v", report.Missing, []string{permissionFirewallDelete})
+	}
+	if len(report.Granted) != 3 {
+		t.Errorf("CheckPermissions didn't combine the granted permissions, got %v", report.Granted)
+	}
+	if len(report.blocking()) != 0 {
+		t.Errorf("blocking included firewall permissions, got %v", report.blocking())
+	}
+
+	// The permissions endpoint applies the loaded config the same way
+	g.SetConfig(&admin.Config{RDP: admin.RDPConfig{JitIapGrant: true}})
+	report, err = g.CheckPermissions(&Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.blocking(), []string{permissionIapGetPolicy, permissionIapSetPolicy}) {
+		t.Errorf("CheckPermissions didn't require granting tunnel access with just in time grants, got %v", report.blocking())
+	}
+	g.SetConfig(nil)
+
+	if _, err := g.CheckPermissions(&Instance{Name: "missing", ProjectName: "test-project", Zone: "us-west1-b"}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("CheckPermissions didn't error for a missing instance, got %v", err)
+	}
+	if _, err := g.CheckPermissions(&Instance{Name: "vm"}); err == nil || err.Error() != missingPermissionValues {
+		t.Errorf("CheckPermissions didn't error without a project and zone, got %v", err)
+	}
+}
+
+func TestPreflightPermissions(t *testing.T) {
+	server := iamServer(map[string][]string{
+		"/v1/projects/test-project:testIamPermissions":                                          {permissionFirewallCreate, permissionFirewallDelete},
+		"/compute/v1/projects/test-project/zones/us-west1-b/instances/vm/testIamPermissions":    {permissionInstanceGet},
+		"/v1/projects/test-project/iap_tunnel/zones/us-west1-b/instances/vm:testIamPermissions": {},
+	})
+	defer server.Close()
+
+	ws, written := recordingWebSocket(nil)
+	g := NewGcloudExecutor(&mockShell{})
+	err := g.preflightPermissions(ws, &Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b"})
+	if err == nil || !strings.Contains(err.Error(), permissionIapTunnel) {
+		t.Errorf("preflightPermissions didn't name the missing IAP permission, got %v", err)
+	}
+	if output := written(); len(output) != 1 || output[0].Event == nil || output[0].Event.Detail != permissionIapTunnel {
+		t.Errorf("preflightPermissions didn't report the missing permissions on the socket, got %v", output)
+	}
+}
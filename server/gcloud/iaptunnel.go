@@ -0,0 +1,389 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// native iap tunnel consts, the relay protocol is the one used by gcloud compute start-iap-tunnel
+const (
+	nativeTunnelType      string = "native"
+	iapRelayURL           string = "wss://tunnel.cloudproxy.app/v4"
+	iapRelaySubprotocol   string = "relay.tunnel.cloudproxy.app"
+	iapRelayOrigin        string = "bot:iap-tunneler"
+	accessTokenCmd        string = "gcloud auth print-access-token"
+	relayMaxDataFrameSize int    = 16384
+	relayAckThreshold     uint64 = 2 * 16384
+	nativeTunnelFallback  string = "Native IAP tunnel failed for %v, falling back to gcloud"
+	fallbackListenError   string = "Could not listen on port %v to fall back to gcloud: %v"
+	relayUnexpectedTag    string = "IAP relay sent unexpected message tag %v"
+	relayFrameTooLarge    string = "IAP relay sent a %v byte frame which is larger than allowed"
+	relayLostFailures     int    = 3
+)
+
+// relay message tags
+const (
+	relayTagConnectSuccessSid   uint16 = 0x0001
+	relayTagReconnectSuccessAck uint16 = 0x0002
+	relayTagData                uint16 = 0x0004
+	relayTagAck                 uint16 = 0x0007
+)
+
+// iapTunneler starts an IAP tunnel to the instance's remote port that accepts connections on the port listener.
+// The result is sent on outputChan and the tunnel is kept open until ctx is done.
+type iapTunneler interface {
+	startIapTunnel(ctx context.Context, ws conn, instance *Instance, portListener *net.TCPListener, outputChan chan<- iapResult)
+}
+
+// nativeIapTunnel implements the IAP TCP forwarding websocket protocol in process instead of running gcloud
+type nativeIapTunnel struct {
+	shell    shell
+	relayURL string
+	settings rdpSettings
+}
+
+func newNativeIapTunnel(shell shell, settings rdpSettings) *nativeIapTunnel {
+	relayURL := settings.relayURL
+	if relayURL == "" {
+		relayURL = iapRelayURL
+	}
+	return &nativeIapTunnel{shell: shell, relayURL: strings.TrimSuffix(relayURL, "/"), settings: settings}
+}
+
+// tunneler returns the native tunnel if the settings ask for it and the gcloud tunnel otherwise
+func (gcloudExecutor *GcloudExecutor) tunneler() iapTunneler {
+	if gcloudExecutor.settings.tunnel == nativeTunnelType {
+		return newNativeIapTunnel(gcloudExecutor.shell, gcloudExecutor.settings)
+	}
+	return gcloudExecutor
+}
+
+// accessToken gets an OAuth access token for the relay from the gcloud SDK
+func (t *nativeIapTunnel) accessToken() (string, error) {
+	return gcloudAccessToken(t.shell)
+}
+
+// gcloudAccessToken gets an OAuth access token for Google APIs from the gcloud SDK
+func gcloudAccessToken(shell shell) (string, error) {
+	output, err := shell.ExecuteCmd(accessTokenCmd)
+	if err != nil {
+		if strings.Contains(strings.ToLower(string(output)), gcloudAuthError) {
+			return "", errors.New(SdkAuthError)
+		}
+		return "", fmt.Errorf("%v: %s", err, string(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// connectURL builds the relay URL that opens a new TCP connection to the instance's remote port
+func (t *nativeIapTunnel) connectURL(instance *Instance) string {
+	interfaceName := "nic0"
+	if len(instance.NetworkInterfaces) > 0 && instance.NetworkInterfaces[0].Name != "" {
+		interfaceName = instance.NetworkInterfaces[0].Name
+	}
+
+	query := url.Values{}
+	query.Set("project", instance.ProjectName)
+	query.Set("zone", path.Base(instance.Zone))
+	query.Set("instance", instance.Name)
+	query.Set("interface", interfaceName)
+	query.Set("port", strconv.Itoa(instance.remotePort()))
+	query.Set("newWebsocket", "True")
+	return fmt.Sprintf("%s/connect?%s", t.relayURL, query.Encode())
+}
+
+// dial opens a relay websocket to the instance and waits for the relay to confirm the connection
+func (t *nativeIapTunnel) dial(ctx context.Context, instance *Instance) (*websocket.Conn, error) {
+	token, err := t.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("Origin", iapRelayOrigin)
+
+	dialer := websocket.Dialer{Subprotocols: []string{iapRelaySubprotocol}}
+	relay, resp, err := dialer.DialContext(ctx, t.connectURL(instance), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%v: %v", err, resp.Status)
+		}
+		return nil, err
+	}
+
+	tag, _, err := readRelayFrame(relay)
+	if err != nil {
+		relay.Close()
+		return nil, err
+	}
+	if tag != relayTagConnectSuccessSid {
+		relay.Close()
+		return nil, fmt.Errorf(relayUnexpectedTag, tag)
+	}
+	return relay, nil
+}
+
+// relayWatch decides when a native tunnel has exited. It exits once its listener stops accepting or the relay
+// refuses relayLostFailures connections in a row, as gcloud's tunnel would stop working.
+type relayWatch struct {
+	mu       sync.Mutex
+	failures int
+	exited   chan struct{}
+	once     sync.Once
+}
+
+func newRelayWatch() *relayWatch {
+	return &relayWatch{exited: make(chan struct{})}
+}
+
+// dialed records whether the relay accepted a connection
+func (w *relayWatch) dialed(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		w.failures = 0
+		return
+	}
+	if w.failures++; w.failures >= relayLostFailures {
+		w.exit()
+	}
+}
+
+// exit closes exited, it may be called more than once
+func (w *relayWatch) exit() {
+	w.once.Do(func() { close(w.exited) })
+}
+
+// startIapTunnel checks that the relay accepts a connection to the instance and then forwards every connection
+// accepted on the port listener through its own relay websocket. The tunnel counts as exited once the relay
+// is lost.
+func (t *nativeIapTunnel) startIapTunnel(ctx context.Context, ws conn, instance *Instance, portListener *net.TCPListener, outputChan chan<- iapResult) {
+	log.Println("Starting native IAP tunnel for ", instance.Name)
+	started := time.Now()
+	port := portListener.Addr().(*net.TCPAddr).Port
+
+	probe, err := t.dial(ctx, instance)
+	if err != nil {
+		log.Println(err)
+		portListener.Close()
+		outputChan <- reportTunnelReadiness(ws, instance, port, started, t.settings.sessionTimeout, []string{err.Error()}, err)
+		return
+	}
+	probe.Close()
+
+	tunnelCtx, tunnelCancel := context.WithCancel(ctx)
+	defer tunnelCancel()
+	go func() {
+		<-tunnelCtx.Done()
+		portListener.Close()
+	}()
+
+	watch := newRelayWatch()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.acceptConnections(tunnelCtx, instance, portListener, watch)
+		if tunnelCtx.Err() == nil {
+			watch.exit()
+		}
+	}()
+
+	probeRDP, timeout := tunnelReadiness(instance, t.settings)
+	err = waitForTunnel(tunnelCtx, port, probeRDP, timeout, nil, nil)
+	result := reportTunnelReadiness(ws, instance, port, started, t.settings.sessionTimeout, nil, err)
+	result.exited = watch.exited
+	if !result.tunnelCreated {
+		// The port is free once the result is sent so the gcloud tunnel can fall back to it
+		tunnelCancel()
+		portListener.Close()
+	}
+	outputChan <- result
+
+	if result.tunnelCreated {
+		select {
+		case <-ctx.Done():
+		case <-watch.exited:
+			log.Printf("native IAP tunnel for %v lost the relay", instance.Name)
+		}
+	}
+	tunnelCancel()
+	wg.Wait()
+	log.Println("Ended native IAP tunnel for ", instance.Name)
+}
+
+// acceptConnections forwards every connection accepted on the listener until it is closed
+func (t *nativeIapTunnel) acceptConnections(ctx context.Context, instance *Instance, portListener *net.TCPListener, watch *relayWatch) {
+	var wg sync.WaitGroup
+	for {
+		local, err := portListener.AcceptTCP()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.forward(ctx, instance, local, watch)
+		}()
+	}
+	wg.Wait()
+}
+
+// forward pipes one local connection through a relay websocket until either side closes
+func (t *nativeIapTunnel) forward(ctx context.Context, instance *Instance, local *net.TCPConn, watch *relayWatch) {
+	defer local.Close()
+
+	relay, err := t.dial(ctx, instance)
+	if ctx.Err() == nil {
+		watch.dialed(err)
+	}
+	if err != nil {
+		log.Printf("native IAP tunnel for %v couldn't connect: %v", instance.Name, err)
+		return
+	}
+	defer relay.Close()
+
+	var writeMu sync.Mutex
+	done := make(chan struct{}, 2)
+
+	// Local to relay
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, relayMaxDataFrameSize)
+		for {
+			n, err := local.Read(buf)
+			if n > 0 {
+				writeMu.Lock()
+				err := writeRelayFrame(relay, relayTagData, buf[:n])
+				writeMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Relay to local, acknowledging received bytes so the relay keeps sending
+	go func() {
+		defer func() { done <- struct{}{} }()
+		var received, acked uint64
+		for {
+			tag, data, err := readRelayFrame(relay)
+			if err != nil {
+				return
+			}
+			switch tag {
+			case relayTagData:
+				if _, err := local.Write(data); err != nil {
+					return
+				}
+				received += uint64(len(data))
+				if received-acked >= relayAckThreshold {
+					ack := make([]byte, 8)
+					binary.BigEndian.PutUint64(ack, received)
+					writeMu.Lock()
+					err := writeRelayFrame(relay, relayTagAck, ack)
+					writeMu.Unlock()
+					if err != nil {
+						return
+					}
+					acked = received
+				}
+			case relayTagAck, relayTagReconnectSuccessAck:
+				// Nothing is buffered for reconnects so acks from the relay can be ignored
+			default:
+				log.Printf(relayUnexpectedTag, tag)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// writeRelayFrame writes a relay message, data frames carry a length and acks carry a byte count
+func writeRelayFrame(relay *websocket.Conn, tag uint16, payload []byte) error {
+	var frame []byte
+	switch tag {
+	case relayTagData, relayTagConnectSuccessSid:
+		frame = make([]byte, 6+len(payload))
+		binary.BigEndian.PutUint32(frame[2:], uint32(len(payload)))
+		copy(frame[6:], payload)
+	default:
+		frame = make([]byte, 2+len(payload))
+		copy(frame[2:], payload)
+	}
+	binary.BigEndian.PutUint16(frame, tag)
+	return relay.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// readRelayFrame reads one relay message and returns its tag and payload
+func readRelayFrame(relay *websocket.Conn) (uint16, []byte, error) {
+	_, frame, err := relay.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(frame) < 2 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	tag := binary.BigEndian.Uint16(frame)
+	switch tag {
+	case relayTagData, relayTagConnectSuccessSid:
+		if len(frame) < 6 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		length := int(binary.BigEndian.Uint32(frame[2:]))
+		if length > relayMaxDataFrameSize {
+			return 0, nil, fmt.Errorf(relayFrameTooLarge, length)
+		}
+		if len(frame) < 6+length {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return tag, frame[6 : 6+length], nil
+	case relayTagAck, relayTagReconnectSuccessAck:
+		if len(frame) < 10 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return tag, frame[2:10], nil
+	default:
+		return tag, frame[2:], nil
+	}
+}
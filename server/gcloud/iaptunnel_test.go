@@ -0,0 +1,226 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	pshell "github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
+)
+
+// newStandInRelay starts a local relay that checks the connect request and echoes data frames back
+func newStandInRelay(t *testing.T, rejectTag uint16) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{iapRelaySubprotocol}, CheckOrigin: func(r *http.Request) bool { return true }}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" || r.URL.Query().Get("instance") != "test-project" || r.URL.Query().Get("zone") != "us-west1-b" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		relay, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer relay.Close()
+
+		if rejectTag != 0 {
+			writeRelayFrame(relay, rejectTag, []byte("reject"))
+			return
+		}
+		writeRelayFrame(relay, relayTagConnectSuccessSid, []byte("sid"))
+		for {
+			tag, data, err := readRelayFrame(relay)
+			if err != nil {
+				return
+			}
+			if tag == relayTagData {
+				writeRelayFrame(relay, relayTagData, data)
+			}
+		}
+	}))
+}
+
+func TestNativeIapTunnel(t *testing.T) {
+	relay := newStandInRelay(t, 0)
+	defer relay.Close()
+
+	ws := newMockWebSocket(func() (int, []byte, error) { return websocket.TextMessage, nil, nil }, func(v interface{}) error { return nil }, func() error { return nil })
+
+	var instanceToUse Instance
+	json.Unmarshal(instance, &instanceToUse)
+	tunnel := newNativeIapTunnel(&mockShell{}, rdpSettings{relayURL: "ws" + strings.TrimPrefix(relay.URL, "http"), readyTimeout: time.Second})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	outputChan := make(chan iapResult)
+	go tunnel.startIapTunnel(ctx, ws, &instanceToUse, listener, outputChan)
+	if output := <-outputChan; !output.tunnelCreated {
+		t.Fatalf("native startIapTunnel didn't create tunnel with a working relay, got %v", output.cmdOutput)
+	}
+
+	local, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	if _, err := local.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(local, reply); err != nil || string(reply) != "hello" {
+		t.Errorf("native tunnel didn't forward data through relay, got %q, %v", string(reply), err)
+	}
+}
+
+func TestNativeIapTunnelRejected(t *testing.T) {
+	relay := newStandInRelay(t, relayTagAck)
+	defer relay.Close()
+
+	var socketOutput socketMessage
+	ws := newMockWebSocket(func() (int, []byte, error) { return websocket.TextMessage, nil, nil }, func(v interface{}) error {
+		socketOutput = *(v.(*socketMessage))
+		return nil
+	}, func() error { return nil })
+
+	var instanceToUse Instance
+	json.Unmarshal(instance, &instanceToUse)
+	tunnel := newNativeIapTunnel(&mockShell{}, rdpSettings{relayURL: "ws" + strings.TrimPrefix(relay.URL, "http"), readyTimeout: time.Second})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	listener, _ := net.ListenTCP("tcp", addr)
+
+	outputChan := make(chan iapResult)
+	go tunnel.startIapTunnel(context.Background(), ws, &instanceToUse, listener, outputChan)
+	if output := <-outputChan; output.tunnelCreated {
+		t.Errorf("native startIapTunnel created tunnel when relay rejected the connection")
+	}
+	if socketOutput.Err == "" {
+		t.Errorf("native startIapTunnel didn't write error to socket")
+	}
+}
+
+// newProbeOnlyRelay starts a local relay that accepts the connection checking it and refuses every later one
+func newProbeOnlyRelay() *httptest.Server {
+	var mu sync.Mutex
+	accepted := false
+	upgrader := websocket.Upgrader{Subprotocols: []string{iapRelaySubprotocol}, CheckOrigin: func(r *http.Request) bool { return true }}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		first := !accepted
+		accepted = true
+		mu.Unlock()
+		if !first {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeRelayFrame(conn, relayTagConnectSuccessSid, []byte("sid"))
+	}))
+}
+
+func TestNativeIapTunnelRelayLost(t *testing.T) {
+	relay := newProbeOnlyRelay()
+	defer relay.Close()
+
+	ws := newMockWebSocket(func() (int, []byte, error) { return websocket.TextMessage, nil, nil }, func(v interface{}) error { return nil }, func() error { return nil })
+	var instanceToUse Instance
+	json.Unmarshal(instance, &instanceToUse)
+	tunnel := newNativeIapTunnel(&mockShell{}, rdpSettings{relayURL: "ws" + strings.TrimPrefix(relay.URL, "http"), readyTimeout: time.Second})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	outputChan := make(chan iapResult)
+	go tunnel.startIapTunnel(ctx, ws, &instanceToUse, listener, outputChan)
+	output := <-outputChan
+	if !output.tunnelCreated || output.exited == nil {
+		t.Fatalf("native startIapTunnel didn't create a tunnel that reports exiting, got %v", output)
+	}
+
+	for i := 0; i < relayLostFailures; i++ {
+		local, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			break
+		}
+		local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		local.Read(make([]byte, 1))
+		local.Close()
+	}
+	select {
+	case <-output.exited:
+	case <-time.After(5 * time.Second):
+		t.Errorf("native tunnel didn't exit once the relay refused its connections")
+	}
+}
+
+func TestNativeIapTunnelNotReady(t *testing.T) {
+	relay := newProbeOnlyRelay()
+	defer relay.Close()
+
+	ws := newMockWebSocket(func() (int, []byte, error) { return websocket.TextMessage, nil, nil }, func(v interface{}) error { return nil }, func() error { return nil })
+	var instanceToUse Instance
+	json.Unmarshal(instance, &instanceToUse)
+	instanceToUse.Protocol = rdpProtocol
+	tunnel := newNativeIapTunnel(&mockShell{}, rdpSettings{relayURL: "ws" + strings.TrimPrefix(relay.URL, "http"), readyTimeout: 200 * time.Millisecond, probeRDP: true})
+
+	listener, err := pshell.FindOpenPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	outputChan := make(chan iapResult)
+	go tunnel.startIapTunnel(context.Background(), ws, &instanceToUse, listener, outputChan)
+	if output := <-outputChan; output.tunnelCreated {
+		t.Fatalf("native startIapTunnel created a tunnel the relay refused to carry")
+	}
+
+	// The gcloud fallback listens on the port as soon as the result is sent
+	fallback, err := pshell.ListenOnPort(port)
+	if err != nil {
+		t.Fatalf("native startIapTunnel didn't free its port before reporting the failure, got %v", err)
+	}
+	fallback.Close()
+}
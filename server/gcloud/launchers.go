@@ -0,0 +1,258 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+// rdp launcher consts
+const (
+	xfreerdpLauncher         string = "xfreerdp"
+	remminaLauncher          string = "remmina"
+	rdesktopLauncher         string = "rdesktop"
+	unknownLauncher          string = "Unknown RDP launcher %v, use xfreerdp, remmina or rdesktop"
+	launcherOptionMissing    string = "%v doesn't support %v"
+	invalidDisplaySize       string = "Display size %vx%v is invalid, width and height must both be between 200 and 8192"
+	invalidDriveRedirect     string = "Drive %v must have a name made of letters, digits, - or _ and an absolute path"
+	minDisplaySize           int    = 200
+	maxDisplaySize           int    = 8192
+	remminaProfilePermission        = 0600
+)
+
+var driveNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// displayOptions are sent with the start-rdp command to control the RDP client
+type displayOptions struct {
+	Width        int             `json:"width"`
+	Height       int             `json:"height"`
+	Fullscreen   bool            `json:"fullscreen"`
+	MultiMonitor bool            `json:"multimon"`
+	Clipboard    bool            `json:"clipboard"`
+	Drives       []driveRedirect `json:"drives"`
+}
+
+// driveRedirect shares a local directory with the instance under the name
+type driveRedirect struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// rdpLaunch is a prepared RDP client command, the password is only ever in stdin or a private temp file
+type rdpLaunch struct {
+	args    []string
+	stdin   []byte
+	cleanup func()
+}
+
+// rdpLauncher prepares the command that starts an RDP client against the tunnel's local port
+type rdpLauncher interface {
+	launch(creds *credentials, port int) (*rdpLaunch, error)
+}
+
+// newRdpLauncher returns the launcher for the profile picked in the settings
+func newRdpLauncher(settings rdpSettings) (rdpLauncher, error) {
+	config := settings.launchers[settings.launcher]
+	if config.Path == "" {
+		config.Path = settings.launcher
+	}
+
+	switch settings.launcher {
+	case xfreerdpLauncher:
+		return &xfreerdp{config}, nil
+	case remminaLauncher:
+		return &remmina{config}, nil
+	case rdesktopLauncher:
+		return &rdesktop{config}, nil
+	}
+	return nil, fmt.Errorf(unknownLauncher, settings.launcher)
+}
+
+// validate checks the display options before they are put in a command
+func (display *displayOptions) validate() error {
+	if display.Width != 0 || display.Height != 0 {
+		if display.Width < minDisplaySize || display.Width > maxDisplaySize || display.Height < minDisplaySize || display.Height > maxDisplaySize {
+			return fmt.Errorf(invalidDisplaySize, display.Width, display.Height)
+		}
+	}
+	for _, drive := range display.Drives {
+		if !driveNameRegex.MatchString(drive.Name) || !filepath.IsAbs(drive.Path) || strings.ContainsAny(drive.Path, ",;\n") {
+			return fmt.Errorf(invalidDriveRedirect, drive.Name)
+		}
+	}
+	return nil
+}
+
+// displayFor returns the validated display options of the credentials, missing options use the client defaults
+func displayFor(creds *credentials) (*displayOptions, error) {
+	if creds.display == nil {
+		return &displayOptions{}, nil
+	}
+	if err := creds.display.validate(); err != nil {
+		return nil, err
+	}
+	return creds.display, nil
+}
+
+// xfreerdp reads the password from stdin with /from-stdin
+type xfreerdp struct {
+	config admin.LauncherConfig
+}
+
+func (l *xfreerdp) launch(creds *credentials, port int) (*rdpLaunch, error) {
+	display, err := displayFor(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{l.config.Path, "/v:localhost", fmt.Sprintf("/port:%d", port), "/u:" + creds.Username, "/from-stdin", "/cert-ignore"}
+	if flag := xfreerdpSecurityFlag(creds.security); flag != "" {
+		args = append(args, flag)
+	}
+	if display.Width != 0 {
+		args = append(args, fmt.Sprintf("/size:%dx%d", display.Width, display.Height))
+	}
+	if display.Fullscreen {
+		args = append(args, "/f")
+	}
+	if display.MultiMonitor {
+		args = append(args, "/multimon")
+	}
+	if display.Clipboard {
+		args = append(args, "+clipboard")
+	}
+	for _, drive := range display.Drives {
+		args = append(args, fmt.Sprintf("/drive:%s,%s", drive.Name, drive.Path))
+	}
+	args = append(args, l.config.Args...)
+
+	return &rdpLaunch{args: args, stdin: []byte(creds.Password + "\n")}, nil
+}
+
+// rdesktop reads the password from stdin with -p -
+type rdesktop struct {
+	config admin.LauncherConfig
+}
+
+func (l *rdesktop) launch(creds *credentials, port int) (*rdpLaunch, error) {
+	display, err := displayFor(creds)
+	if err != nil {
+		return nil, err
+	}
+	if display.MultiMonitor {
+		return nil, fmt.Errorf(launcherOptionMissing, rdesktopLauncher, "multi-monitor")
+	}
+
+	args := []string{l.config.Path, "-u", creds.Username, "-p", "-"}
+	if display.Width != 0 {
+		args = append(args, "-g", fmt.Sprintf("%dx%d", display.Width, display.Height))
+	}
+	if display.Fullscreen {
+		args = append(args, "-f")
+	}
+	if display.Clipboard {
+		args = append(args, "-r", "clipboard:PRIMARYCLIPBOARD")
+	}
+	for _, drive := range display.Drives {
+		args = append(args, "-r", fmt.Sprintf("disk:%s=%s", drive.Name, drive.Path))
+	}
+	args = append(args, l.config.Args...)
+	args = append(args, fmt.Sprintf("localhost:%d", port))
+
+	return &rdpLaunch{args: args, stdin: []byte(creds.Password + "\n")}, nil
+}
+
+// remmina is started with a connection profile written to a 0600 temp file that is removed when it exits
+type remmina struct {
+	config admin.LauncherConfig
+}
+
+func (l *remmina) launch(creds *credentials, port int) (*rdpLaunch, error) {
+	display, err := displayFor(creds)
+	if err != nil {
+		return nil, err
+	}
+	if len(display.Drives) > 1 {
+		return nil, fmt.Errorf(launcherOptionMissing, remminaLauncher, "more than one shared drive")
+	}
+	if strings.ContainsAny(creds.Username+creds.Password, "\r\n") {
+		return nil, fmt.Errorf(launcherOptionMissing, remminaLauncher, "line breaks in credentials")
+	}
+
+	profile := remminaProfile(creds, port, display)
+	file, err := ioutil.TempFile("", "rdp-*.remmina")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+
+	if err := file.Chmod(remminaProfilePermission); err != nil {
+		file.Close()
+		cleanup()
+		return nil, err
+	}
+	if _, err := file.WriteString(profile); err != nil {
+		file.Close()
+		cleanup()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	args := append([]string{l.config.Path, "-c", file.Name()}, l.config.Args...)
+	return &rdpLaunch{args: args, cleanup: cleanup}, nil
+}
+
+// remminaProfile builds the contents of a Remmina RDP connection profile
+func remminaProfile(creds *credentials, port int, display *displayOptions) string {
+	lines := []string{
+		"[remmina]",
+		"protocol=RDP",
+		fmt.Sprintf("server=localhost:%d", port),
+		"username=" + creds.Username,
+		"password=" + creds.Password,
+		"cert_ignore=1",
+	}
+	if creds.security != nil && creds.security.Protocol != "" {
+		lines = append(lines, "security="+strings.TrimPrefix(xfreerdpSecurityFlag(creds.security), "/sec:"))
+	}
+	if display.Width != 0 {
+		lines = append(lines, "resolution_mode=2", fmt.Sprintf("resolution_width=%d", display.Width), fmt.Sprintf("resolution_height=%d", display.Height))
+	}
+	if display.Fullscreen {
+		lines = append(lines, "viewmode=4")
+	}
+	if display.MultiMonitor {
+		lines = append(lines, "multimon=1")
+	}
+	if display.Clipboard {
+		lines = append(lines, "disableclipboard=0")
+	}
+	if len(display.Drives) == 1 {
+		lines = append(lines, "sharefolder="+display.Drives[0].Path)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
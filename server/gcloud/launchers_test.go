@@ -0,0 +1,152 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+func TestNewRdpLauncher(t *testing.T) {
+	settings := newRdpSettings(nil)
+	if launcher, err := newRdpLauncher(settings); err != nil || launcher.(*xfreerdp).config.Path != xfreerdpLauncher {
+		t.Errorf("newRdpLauncher didn't default to xfreerdp, got %v, %v", launcher, err)
+	}
+
+	settings.launcher = rdesktopLauncher
+	settings.launchers = map[string]admin.LauncherConfig{rdesktopLauncher: {Path: "/opt/rdesktop"}}
+	if launcher, err := newRdpLauncher(settings); err != nil || launcher.(*rdesktop).config.Path != "/opt/rdesktop" {
+		t.Errorf("newRdpLauncher didn't use configured path, got %v, %v", launcher, err)
+	}
+
+	settings.launcher = "mstsc"
+	if _, err := newRdpLauncher(settings); err == nil {
+		t.Errorf("newRdpLauncher accepted unknown launcher")
+	}
+}
+
+func TestXfreerdpLaunch(t *testing.T) {
+	creds := &credentials{
+		Username: "o'brien",
+		Password: "p@ss word",
+		security: &rdpSecurity{Protocol: rdpSecurityTLS},
+		display: &displayOptions{
+			Width: 1280, Height: 720, MultiMonitor: true, Clipboard: true,
+			Drives: []driveRedirect{{Name: "home", Path: "/home/user/shared dir"}},
+		},
+	}
+	launcher := &xfreerdp{admin.LauncherConfig{Path: "xfreerdp", Args: []string{"/log-level:WARN"}}}
+
+	launch, err := launcher.launch(creds, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.Join(launch.args, " "), creds.Password) {
+		t.Errorf("xfreerdp launch put the password in the command line: %v", launch.args)
+	}
+	if string(launch.stdin) != "p@ss word\n" {
+		t.Errorf("xfreerdp launch didn't pass password on stdin, got %q", launch.stdin)
+	}
+
+	args := launch.args
+	expected := []string{"xfreerdp", "/v:localhost", "/port:9999", "/u:o'brien", "/from-stdin", "/cert-ignore", "/sec:tls",
+		"/size:1280x720", "/multimon", "+clipboard", "/drive:home,/home/user/shared dir", "/log-level:WARN"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("xfreerdp launch got args %v, expected %v", args, expected)
+	}
+
+	creds.display = &displayOptions{Width: 50, Height: 50}
+	if _, err := launcher.launch(creds, 9999); err == nil {
+		t.Errorf("xfreerdp launch accepted an invalid display size")
+	}
+
+	creds.display = &displayOptions{Drives: []driveRedirect{{Name: "bad name", Path: "relative"}}}
+	if _, err := launcher.launch(creds, 9999); err == nil {
+		t.Errorf("xfreerdp launch accepted an invalid drive")
+	}
+}
+
+func TestRdesktopLaunch(t *testing.T) {
+	creds := &credentials{Username: "user", Password: "password", display: &displayOptions{Fullscreen: true}}
+	launcher := &rdesktop{admin.LauncherConfig{Path: "rdesktop"}}
+
+	launch, err := launcher.launch(creds, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := launch.args
+	expected := []string{"rdesktop", "-u", "user", "-p", "-", "-f", "localhost:9999"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("rdesktop launch got args %v, expected %v", args, expected)
+	}
+	if string(launch.stdin) != "password\n" {
+		t.Errorf("rdesktop launch didn't pass password on stdin, got %q", launch.stdin)
+	}
+
+	creds.display.MultiMonitor = true
+	if _, err := launcher.launch(creds, 9999); err == nil {
+		t.Errorf("rdesktop launch accepted multi-monitor")
+	}
+}
+
+func TestRemminaLaunch(t *testing.T) {
+	creds := &credentials{Username: "user", Password: "password", security: &rdpSecurity{Protocol: rdpSecurityNLA}}
+	launcher := &remmina{admin.LauncherConfig{Path: "remmina"}}
+
+	launch, err := launcher.launch(creds, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.Join(launch.args, " "), creds.Password) || launch.stdin != nil {
+		t.Errorf("remmina launch passed the password outside the profile")
+	}
+
+	args := launch.args
+	if len(args) != 3 || args[1] != "-c" {
+		t.Fatalf("remmina launch got args %v", args)
+	}
+	profile := args[2]
+
+	info, err := os.Stat(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("remmina profile has permissions %v, expected 0600", info.Mode().Perm())
+	}
+	contents, _ := ioutil.ReadFile(profile)
+	for _, line := range []string{"server=localhost:9999", "username=user", "password=password", "security=nla"} {
+		if !strings.Contains(string(contents), line+"\n") {
+			t.Errorf("remmina profile is missing %v, got %v", line, string(contents))
+		}
+	}
+
+	launch.cleanup()
+	if _, err := os.Stat(profile); !os.IsNotExist(err) {
+		t.Errorf("remmina launch cleanup didn't remove the profile")
+	}
+
+	creds.Password = "password\nserver=elsewhere"
+	if _, err := launcher.launch(creds, 9999); err == nil {
+		t.Errorf("remmina launch accepted credentials with a line break")
+	}
+}
@@ -0,0 +1,215 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// firewallLeases is shared by every session on the server so sessions to the same instance share one rule
+var firewallLeases = newFirewallLeaseManager()
+
+// firewallLease is held by a session for as long as it needs the IAP firewall rule of an instance
+type firewallLease struct {
+	key      string
+	id       int
+	deadline time.Time
+}
+
+// firewallLeaseEntry keeps the leases of one firewall rule, its mutex is held while the rule is created or deleted
+type firewallLeaseEntry struct {
+	mu     sync.Mutex
+	leases map[int]time.Time
+	// expire deletes the rule if the last lease expires without being released, timer fires at the latest deadline
+	expire func()
+	timer  *time.Timer
+	// dropped is set once the entry is removed from the manager, a new entry is used for the key after it
+	dropped bool
+}
+
+// firewallLeaseManager reference counts the sessions using each firewall rule
+type firewallLeaseManager struct {
+	mu      sync.Mutex
+	nextID  int
+	entries map[string]*firewallLeaseEntry
+}
+
+func newFirewallLeaseManager() *firewallLeaseManager {
+	return &firewallLeaseManager{entries: make(map[string]*firewallLeaseEntry)}
+}
+
+// firewallLeaseKey returns the key used to lease the firewall rule of the instance
+func firewallLeaseKey(instance *Instance) string {
+	return fmt.Sprintf("%s/%s", instance.ProjectName, firewallRuleSuffix(instance))
+}
+
+// lock returns the entry of the key with its mutex held
+func (m *firewallLeaseManager) lock(key string) *firewallLeaseEntry {
+	for {
+		m.mu.Lock()
+		entry, ok := m.entries[key]
+		if !ok {
+			entry = &firewallLeaseEntry{leases: make(map[int]time.Time)}
+			m.entries[key] = entry
+		}
+		m.mu.Unlock()
+
+		entry.mu.Lock()
+		if !entry.dropped {
+			return entry
+		}
+		entry.mu.Unlock()
+	}
+}
+
+// dropIfUnused removes the entry from the manager once it has no leases and its rule isn't waiting for the
+// timer to delete it, the entry's mutex must be held
+func (m *firewallLeaseManager) dropIfUnused(key string, entry *firewallLeaseEntry) {
+	if len(entry.leases) > 0 || entry.expire != nil {
+		return
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.dropped = true
+	m.mu.Lock()
+	if m.entries[key] == entry {
+		delete(m.entries, key)
+	}
+	m.mu.Unlock()
+}
+
+// arm sets the entry's timer to the latest deadline of its leases, the entry's mutex must be held
+func (m *firewallLeaseManager) arm(key string, entry *firewallLeaseEntry) {
+	var latest time.Time
+	for _, deadline := range entry.leases {
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.timer = time.AfterFunc(time.Until(latest), func() {
+		m.expire(key, entry)
+	})
+}
+
+// expire deletes the rule when its last lease expired without being released
+func (m *firewallLeaseManager) expire(key string, entry *firewallLeaseEntry) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.dropped {
+		return
+	}
+
+	entry.pruneExpired(time.Now())
+	if len(entry.leases) > 0 {
+		m.arm(key, entry)
+		return
+	}
+	if entry.expire != nil {
+		entry.expire()
+		entry.expire = nil
+	}
+	m.dropIfUnused(key, entry)
+}
+
+// pruneExpired drops leases whose holders never released them, the entry's mutex must be held
+func (entry *firewallLeaseEntry) pruneExpired(now time.Time) {
+	for id, deadline := range entry.leases {
+		if now.After(deadline) {
+			delete(entry.leases, id)
+		}
+	}
+}
+
+// acquire takes a lease on the rule for ttl, create is called only when no other live lease exists.
+// expire is called if the last lease on a rule the call created expires without being released.
+// If create fails no lease is taken and the error is returned.
+func (m *firewallLeaseManager) acquire(key string, ttl time.Duration, create func() error, expire func()) (*firewallLease, int, error) {
+	entry := m.lock(key)
+	defer entry.mu.Unlock()
+
+	now := time.Now()
+	entry.pruneExpired(now)
+
+	if len(entry.leases) == 0 {
+		if err := create(); err != nil {
+			m.dropIfUnused(key, entry)
+			return nil, 0, err
+		}
+		entry.expire = expire
+	}
+
+	m.mu.Lock()
+	m.nextID++
+	lease := &firewallLease{key: key, id: m.nextID, deadline: now.Add(ttl)}
+	m.mu.Unlock()
+
+	shared := len(entry.leases)
+	entry.leases[lease.id] = lease.deadline
+	m.arm(key, entry)
+	return lease, shared, nil
+}
+
+// release gives up the lease and calls remove if it was the last live lease on the rule.
+// It returns the number of leases still held, releasing a lease twice does nothing.
+func (m *firewallLeaseManager) release(lease *firewallLease, remove func()) int {
+	entry := m.lock(lease.key)
+	defer entry.mu.Unlock()
+
+	_, held := entry.leases[lease.id]
+	delete(entry.leases, lease.id)
+	entry.pruneExpired(time.Now())
+
+	if held && len(entry.leases) == 0 {
+		remove()
+		entry.expire = nil
+	}
+	remaining := len(entry.leases)
+	m.dropIfUnused(lease.key, entry)
+	return remaining
+}
+
+// leased returns true if any live lease is held on the rule
+func (m *firewallLeaseManager) leased(key string) bool {
+	entry := m.lock(key)
+	defer entry.mu.Unlock()
+
+	entry.pruneExpired(time.Now())
+	leased := len(entry.leases) > 0
+	m.dropIfUnused(key, entry)
+	return leased
+}
+
+// ifUnleased calls fn with the entry's mutex held if no live lease is held on the rule, so no session can take
+// a lease while fn deletes the rule. It returns false without calling fn if the rule is leased.
+func (m *firewallLeaseManager) ifUnleased(key string, fn func() error) (bool, error) {
+	entry := m.lock(key)
+	defer entry.mu.Unlock()
+
+	entry.pruneExpired(time.Now())
+	if len(entry.leases) > 0 {
+		return false, nil
+	}
+	err := fn()
+	m.dropIfUnused(key, entry)
+	return true, err
+}
@@ -0,0 +1,115 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFirewallLeaseManager(t *testing.T) {
+	m := newFirewallLeaseManager()
+	created, removed := 0, 0
+	create := func() error {
+		created++
+		return nil
+	}
+	remove := func() {
+		removed++
+	}
+
+	first, shared, err := m.acquire("project/instance", time.Hour, create, nil)
+	if err != nil || shared != 0 || created != 1 {
+		t.Errorf("acquire didn't create rule for first lease, got shared %v, created %v", shared, created)
+	}
+
+	second, shared, err := m.acquire("project/instance", time.Hour, create, nil)
+	if err != nil || shared != 1 || created != 1 {
+		t.Errorf("acquire created rule for second lease, got shared %v, created %v", shared, created)
+	}
+
+	if ran, _ := m.ifUnleased("project/instance", func() error { return nil }); ran {
+		t.Errorf("ifUnleased ran while the rule was leased")
+	}
+
+	if remaining := m.release(first, remove); remaining != 1 || removed != 0 {
+		t.Errorf("release removed rule while still leased, got remaining %v, removed %v", remaining, removed)
+	}
+
+	if remaining := m.release(first, remove); remaining != 1 || removed != 0 {
+		t.Errorf("releasing a lease twice changed the lease count, got remaining %v", remaining)
+	}
+
+	if remaining := m.release(second, remove); remaining != 0 || removed != 1 {
+		t.Errorf("release didn't remove rule for last lease, got remaining %v, removed %v", remaining, removed)
+	}
+
+	if m.leased("project/instance") {
+		t.Errorf("leased returned true after all leases were released")
+	}
+	if ran, err := m.ifUnleased("project/instance", func() error { return errors.New("error") }); !ran || err == nil {
+		t.Errorf("ifUnleased didn't run for a rule without leases, got %v, %v", ran, err)
+	}
+	if len(m.entries) != 0 {
+		t.Errorf("lease manager kept the entry of a rule without leases")
+	}
+
+	if _, _, err := m.acquire("project/instance", time.Hour, func() error { return errors.New("error") }, nil); err == nil {
+		t.Errorf("acquire didn't return create error")
+	}
+	if m.leased("project/instance") {
+		t.Errorf("acquire took a lease when create failed")
+	}
+
+	expired, _, _ := m.acquire("project/instance", -time.Second, create, nil)
+	if _, shared, _ := m.acquire("project/instance", time.Hour, create, nil); shared != 0 || created != 3 {
+		t.Errorf("acquire counted an expired lease, got shared %v, created %v", shared, created)
+	}
+	if remaining := m.release(expired, remove); remaining != 1 || removed != 1 {
+		t.Errorf("releasing an expired lease removed the rule, got remaining %v, removed %v", remaining, removed)
+	}
+}
+
+func TestFirewallLeaseExpiry(t *testing.T) {
+	m := newFirewallLeaseManager()
+	expired := make(chan struct{}, 2)
+	expire := func() {
+		expired <- struct{}{}
+	}
+
+	lease, _, err := m.acquire("project/instance", 20*time.Millisecond, func() error { return nil }, expire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire didn't delete the rule when its last lease expired")
+	}
+	if m.release(lease, func() { t.Errorf("release removed a rule that already expired") }) != 0 {
+		t.Errorf("release counted an expired lease")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.entries) != 0 {
+		t.Errorf("lease manager kept the entry of an expired rule")
+	}
+	if len(expired) != 0 {
+		t.Errorf("the rule was deleted more than once")
+	}
+}
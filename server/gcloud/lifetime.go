@@ -0,0 +1,200 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// session lifetime consts
+const (
+	extendSocketCmd        string        = "extend"
+	statusSocketCmd        string        = "status"
+	sessionExpiringEvent   string        = "session_expiring"
+	sessionExtendedEvent   string        = "session_extended"
+	sessionStatusEvent     string        = "session_status"
+	sessionExpiringOutput  string        = "Session for %v ends in %v, send extend to keep it open"
+	sessionExtendedOutput  string        = "Session for %v extended, it ends in %v"
+	sessionStatusOutput    string        = "Session for %v is active on port %v and ends in %v"
+	sessionExpiredOutput   string        = "Session for %v reached the end of its lifetime"
+	sessionAtMaximum       string        = "Session can't be extended past its maximum lifetime of %v"
+	sessionNotReady        string        = "Session is not ready yet"
+	invalidExtendDuration  string        = "Invalid extend duration %q"
+	maxLifetimeRaised      string        = "max_session_timeout %v is shorter than session_timeout %v, sessions can't be extended"
+	defaultMaxSessionTime  time.Duration = 8 * time.Hour
+	defaultSessionExtendBy time.Duration = 30 * time.Minute
+)
+
+// defaultSessionWarnings are the lead times before expiry at which warnings are sent
+var defaultSessionWarnings = []time.Duration{10 * time.Minute, time.Minute}
+
+// sessionLifetime tracks when a session ends, the deadline can be extended up to the maximum lifetime
+type sessionLifetime struct {
+	mu       sync.Mutex
+	started  time.Time
+	deadline time.Time
+	max      time.Duration
+	extendBy time.Duration
+	warnings []time.Duration
+	changed  chan struct{}
+	expired  chan struct{}
+}
+
+func newSessionLifetime(settings rdpSettings) *sessionLifetime {
+	warnings := append([]time.Duration(nil), settings.sessionWarnings...)
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i] > warnings[j] })
+
+	started := time.Now()
+	return &sessionLifetime{
+		started:  started,
+		deadline: started.Add(settings.sessionTimeout),
+		max:      settings.maxSessionTimeout,
+		extendBy: settings.extendBy,
+		warnings: warnings,
+		changed:  make(chan struct{}, 1),
+		expired:  make(chan struct{}),
+	}
+}
+
+// end returns the current deadline of the session
+func (l *sessionLifetime) end() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.deadline
+}
+
+// remaining returns how long the session has left, rounded to the second for display
+func (l *sessionLifetime) remaining() time.Duration {
+	remaining := time.Until(l.end()).Round(time.Second)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// extend pushes the deadline out by the duration, or the configured default if it is zero,
+// without going past the maximum lifetime. It returns the time left after extending.
+func (l *sessionLifetime) extend(by time.Duration) (time.Duration, error) {
+	if by <= 0 {
+		by = l.extendBy
+	}
+
+	l.mu.Lock()
+	limit := l.started.Add(l.max)
+	if !l.deadline.Before(limit) {
+		l.mu.Unlock()
+		return 0, fmt.Errorf(sessionAtMaximum, l.max)
+	}
+	l.deadline = l.deadline.Add(by)
+	if l.deadline.After(limit) {
+		l.deadline = limit
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+	return l.remaining(), nil
+}
+
+// watch sends a warning on the socket at each lead time before the deadline and closes expired once it passes.
+// Extending the session re-arms the warnings that are still ahead.
+func (l *sessionLifetime) watch(ctx context.Context, ws conn, instance *Instance) {
+	for {
+		remaining := time.Until(l.end())
+		if remaining <= 0 {
+			close(l.expired)
+			return
+		}
+
+		wait, warning := remaining, time.Duration(0)
+		for _, lead := range l.warnings {
+			if lead < remaining {
+				wait, warning = remaining-lead, lead
+				break
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-l.changed:
+			timer.Stop()
+		case <-timer.C:
+			if warning > 0 {
+				writeEventToSocket(ws, fmt.Sprintf(sessionExpiringOutput, instance.Name, warning), nil,
+					&tunnelEvent{Type: sessionExpiringEvent, RemainingMs: warning.Milliseconds()})
+			}
+		}
+	}
+}
+
+// handleExtend extends the session by the duration in the socket command
+func (gcloudExecutor *GcloudExecutor) handleExtend(ws conn, instance *Instance, cmd *socketCmd) {
+	if gcloudExecutor.session == nil {
+		writeToSocket(ws, "", errors.New(sessionNotReady))
+		return
+	}
+
+	var by time.Duration
+	if cmd.Duration != "" {
+		parsed, err := time.ParseDuration(cmd.Duration)
+		if err != nil || parsed <= 0 {
+			writeToSocket(ws, "", fmt.Errorf(invalidExtendDuration, cmd.Duration))
+			return
+		}
+		by = parsed
+	}
+
+	remaining, err := gcloudExecutor.session.lifetime.extend(by)
+	if err != nil {
+		writeToSocket(ws, "", err)
+		return
+	}
+	if grant := gcloudExecutor.session.grant; grant != nil {
+		if err := gcloudExecutor.renewIapGrant(grant, gcloudExecutor.session.lifetime.end()); err != nil {
+			writeToSocket(ws, "", fmt.Errorf(iapRenewError, instance.Name, err))
+		}
+	}
+	writeEventToSocket(ws, fmt.Sprintf(sessionExtendedOutput, instance.Name, remaining), nil,
+		&tunnelEvent{Type: sessionExtendedEvent, Port: gcloudExecutor.session.port, RemainingMs: remaining.Milliseconds()})
+}
+
+// handleStatus writes the session's port and remaining time to the socket
+func (gcloudExecutor *GcloudExecutor) handleStatus(ws conn, instance *Instance) {
+	session := gcloudExecutor.session
+	if session == nil {
+		writeToSocket(ws, "", errors.New(sessionNotReady))
+		return
+	}
+
+	remaining := session.lifetime.remaining()
+	event := &tunnelEvent{Type: sessionStatusEvent, Port: session.port, RemainingMs: remaining.Milliseconds(), Detail: session.id}
+	if session.proxy != nil {
+		stats := session.proxy.snapshot()
+		event.Stats = &stats
+	}
+	writeEventToSocket(ws, fmt.Sprintf(sessionStatusOutput, instance.Name, session.port, remaining), nil, event)
+}
@@ -0,0 +1,150 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+	"github.com/gorilla/websocket"
+)
+
+// lifetimeEnding returns a session lifetime with the default settings that ends after the duration
+func lifetimeEnding(in time.Duration) *sessionLifetime {
+	lifetime := newSessionLifetime(newRdpSettings(nil))
+	lifetime.deadline = time.Now().Add(in)
+	return lifetime
+}
+
+func TestNewRdpSettingsLifetime(t *testing.T) {
+	settings := newRdpSettings(nil)
+	if settings.sessionTimeout != rdpContextTimeout || settings.firewallTimeout != firewallContextTimeout {
+		t.Errorf("newRdpSettings didn't default the session and firewall timeouts, got %v", settings)
+	}
+
+	config := &admin.Config{RDP: admin.RDPConfig{SessionTimeout: 10 * time.Hour, MaxSessionTimeout: time.Hour, SessionWarnings: []time.Duration{}}}
+	settings = newRdpSettings(config)
+	if settings.maxSessionTimeout != 10*time.Hour {
+		t.Errorf("newRdpSettings allowed a maximum lifetime shorter than the default, got %v", settings.maxSessionTimeout)
+	}
+	if len(settings.sessionWarnings) != 0 {
+		t.Errorf("newRdpSettings didn't allow disabling warnings, got %v", settings.sessionWarnings)
+	}
+}
+
+func TestSessionLifetimeExtend(t *testing.T) {
+	settings := newRdpSettings(nil)
+	settings.sessionTimeout = time.Hour
+	settings.maxSessionTimeout = 2 * time.Hour
+	settings.extendBy = 30 * time.Minute
+	lifetime := newSessionLifetime(settings)
+
+	if remaining, err := lifetime.extend(0); err != nil || remaining != 90*time.Minute {
+		t.Errorf("extend didn't use the default duration, got %v, %v", remaining, err)
+	}
+	if remaining, err := lifetime.extend(time.Hour); err != nil || remaining != 2*time.Hour {
+		t.Errorf("extend didn't stop at the maximum lifetime, got %v, %v", remaining, err)
+	}
+	if _, err := lifetime.extend(time.Minute); err == nil {
+		t.Errorf("extend went past the maximum lifetime")
+	}
+}
+
+func TestSessionLifetimeWatch(t *testing.T) {
+	var mu sync.Mutex
+	var events []*tunnelEvent
+
+	readMessage := func() (messageType int, p []byte, err error) {
+		return websocket.TextMessage, nil, nil
+	}
+
+	writeJSON := func(v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if event := v.(*socketMessage).Event; event != nil {
+			events = append(events, event)
+		}
+		return nil
+	}
+
+	closeFunc := func() error {
+		return nil
+	}
+
+	ws := newMockWebSocket(readMessage, writeJSON, closeFunc)
+
+	lifetime := lifetimeEnding(300 * time.Millisecond)
+	lifetime.warnings = []time.Duration{200 * time.Millisecond, 100 * time.Millisecond}
+	go lifetime.watch(context.Background(), ws, &Instance{Name: "vm"})
+
+	select {
+	case <-lifetime.expired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watch didn't expire the session")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0].RemainingMs != 200 || events[1].RemainingMs != 100 {
+		t.Errorf("watch didn't warn at each lead time, got %v", events)
+	}
+}
+
+func TestHandleExtendAndStatus(t *testing.T) {
+	var socketOutput socketMessage
+
+	readMessage := func() (messageType int, p []byte, err error) {
+		return websocket.TextMessage, nil, nil
+	}
+
+	writeJSON := func(v interface{}) error {
+		socketOutput = *(v.(*socketMessage))
+		return nil
+	}
+
+	closeFunc := func() error {
+		return nil
+	}
+
+	ws := newMockWebSocket(readMessage, writeJSON, closeFunc)
+	g := NewGcloudExecutor(&mockShell{})
+	instanceToUse := &Instance{Name: "vm"}
+
+	g.handleStatus(ws, instanceToUse)
+	if socketOutput.Err != sessionNotReady {
+		t.Errorf("handleStatus didn't error before the session is ready, got %v", socketOutput)
+	}
+
+	g.session = &tunnelSession{id: "id", port: 9999, lifetime: lifetimeEnding(time.Hour)}
+	g.handleExtend(ws, instanceToUse, &socketCmd{Cmd: extendSocketCmd, Duration: "15m"})
+	if socketOutput.Event == nil || socketOutput.Event.Type != sessionExtendedEvent || socketOutput.Event.RemainingMs < (74*time.Minute).Milliseconds() {
+		t.Errorf("handleExtend didn't extend the session, got %v", socketOutput.Event)
+	}
+
+	g.handleExtend(ws, instanceToUse, &socketCmd{Cmd: extendSocketCmd, Duration: "soon"})
+	if socketOutput.Err == "" {
+		t.Errorf("handleExtend accepted an invalid duration")
+	}
+
+	g.handleStatus(ws, instanceToUse)
+	if socketOutput.Event == nil || socketOutput.Event.Type != sessionStatusEvent || socketOutput.Event.RemainingMs == 0 {
+		t.Errorf("handleStatus didn't include the remaining time, got %v", socketOutput.Event)
+	}
+}
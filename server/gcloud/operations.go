@@ -0,0 +1,234 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// rdp operation consts
+const (
+	defaultRdpOperationTimeout time.Duration = 20 * time.Second
+	rdpOperationFillError      string        = "Could not fill params of %v operation %v"
+	rdpOperationSkipped        string        = "Not running %v due to dependency %v"
+	rdpOperationFailed         string        = "%v operation %v failed after %v attempt(s): %v"
+	rdpOperationTimedOut       string        = "timed out after %v"
+	rdpOperationsSkipped       string        = "Skipping the remaining %v operations after %v failed"
+	rdpOperationAborted        string        = "Required %v operation %v failed, not connecting to %v"
+)
+
+// rdp operation statuses
+const (
+	operationSucceeded string = "succeeded"
+	operationFailed    string = "failed"
+	operationTimedOut  string = "timed_out"
+	operationSkipped   string = "skipped"
+)
+
+// rdpOperationRetryDelay is how long to wait before retrying a failed operation
+var rdpOperationRetryDelay = 2 * time.Second
+
+// operationPhase is when a list of RDP operations runs
+type operationPhase struct {
+	label string
+	event string
+	// canAbort is set if a failed operation can stop the session from connecting
+	canAbort bool
+}
+
+var (
+	preRdpPhase  = operationPhase{label: "pre RDP", event: "pre_rdp_operations", canAbort: true}
+	postRdpPhase = operationPhase{label: "post RDP", event: "post_rdp_operations"}
+)
+
+// operationResult is the outcome of one RDP operation, the exit code is -1 if the command didn't exit on its own
+type operationResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	ExitCode  int    `json:"exit_code"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Output    string `json:"output,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// session end reasons, passed to post RDP operations as END_REASON
+const (
+	endReasonEnded      string = "ended"
+	endReasonExpired    string = "expired"
+	endReasonIdle       string = "idle"
+	endReasonClosed     string = "closed"
+	endReasonTunnelLost string = "tunnel_lost"
+	endReasonCancelled  string = "cancelled"
+	endReasonError      string = "error"
+)
+
+// toAdminInstance converts the instance to the admin package's instance that operations are filled with
+func toAdminInstance(instance *Instance) admin.Instance {
+	tmp, _ := json.Marshal(*instance)
+	var adminInstance admin.Instance
+	json.Unmarshal(tmp, &adminInstance)
+	return adminInstance
+}
+
+// prepareRdpOperation fills the operation with the instance and params, it also returns the dependencies
+// the params don't meet, the operation is skipped if there are any
+func prepareRdpOperation(operation admin.RdpOperation, instance admin.Instance, params map[string]string) (string, []string, error) {
+	operationToFill := admin.InstanceOperationToFill{Instance: instance, Params: params}
+	configOperation := admin.ConfigAdminOperation{Name: operation.Name, Operation: operation.Operation}
+	filledOperation, err := admin.ReadInstanceOperation(operationToFill, configOperation)
+
+	var unmet []string
+	for dependency, value := range operation.Dependencies {
+		dependency = strings.ToUpper(dependency)
+		if params[dependency] != value {
+			unmet = append(unmet, dependency)
+		}
+	}
+	sort.Strings(unmet)
+	return filledOperation.Operation, unmet, err
+}
+
+// runRdpOperations fills the operations with the instance and params and runs the ones whose dependencies
+// match the params. The output of each is sent to the socket as it finishes and every result is sent once
+// the phase is done. An error is returned if a failed operation aborts the session.
+func (gcloudExecutor *GcloudExecutor) runRdpOperations(ws conn, operations []admin.RdpOperation, instance *Instance, params map[string]string, phase operationPhase) error {
+	adminInstance := toAdminInstance(instance)
+
+	var results []operationResult
+	var abortErr error
+	for i, operation := range operations {
+		result := operationResult{Name: operation.Name, Status: operationSkipped}
+
+		cmd, unmet, fillErr := prepareRdpOperation(operation, adminInstance, params)
+		for _, dependency := range unmet {
+			writeToSocket(ws, fmt.Sprintf(rdpOperationSkipped, operation.Name, dependency), nil)
+		}
+		if len(unmet) > 0 {
+			results = append(results, result)
+			continue
+		}
+
+		if fillErr != nil {
+			result.Status, result.Error = operationFailed, fillErr.Error()
+			writeToSocket(ws, "", fmt.Errorf(rdpOperationFillError, phase.label, operation.Name))
+		} else {
+			result = gcloudExecutor.runRdpOperation(operation, cmd, phase)
+			writeToSocket(ws, fmt.Sprintf("%s: %s", operation.Name, result.Output), nil)
+			if result.Status != operationSucceeded {
+				writeToSocket(ws, "", fmt.Errorf(rdpOperationFailed, phase.label, operation.Name, result.Attempts, result.Error))
+			}
+		}
+		results = append(results, result)
+		if result.Status == operationSucceeded {
+			continue
+		}
+
+		action := operation.FailureAction()
+		if action == admin.OnFailureContinue {
+			continue
+		}
+		if action == admin.OnFailureAbort && phase.canAbort {
+			abortErr = protocol.WithCode(protocol.CodeOperationFailed, fmt.Errorf(rdpOperationAborted, phase.label, operation.Name, instance.Name))
+		} else {
+			writeToSocket(ws, fmt.Sprintf(rdpOperationsSkipped, phase.label, operation.Name), nil)
+		}
+		for _, skipped := range operations[i+1:] {
+			results = append(results, operationResult{Name: skipped.Name, Status: operationSkipped})
+		}
+		break
+	}
+
+	if len(results) > 0 {
+		writeEventToSocket(ws, "", nil, &tunnelEvent{Type: phase.event, Operations: results})
+	}
+	return abortErr
+}
+
+// runRdpOperation runs a filled operation until it succeeds or runs out of retries, each attempt is
+// limited to the operation's timeout
+func (gcloudExecutor *GcloudExecutor) runRdpOperation(operation admin.RdpOperation, cmd string, phase operationPhase) operationResult {
+	timeout := operation.Timeout
+	if timeout <= 0 {
+		timeout = defaultRdpOperationTimeout
+	}
+
+	result := operationResult{Name: operation.Name}
+	started := time.Now()
+	for result.Attempts < operation.Retries+1 {
+		if result.Attempts > 0 {
+			time.Sleep(rdpOperationRetryDelay)
+		}
+		result.Attempts++
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		log.Println(fmt.Sprintf("Server running %v operation: %s ", phase.label, cmd))
+		output, err := gcloudExecutor.shell.ExecuteCmdWithContext(ctx, cmd)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+
+		result.Output = string(output)
+		switch {
+		case timedOut:
+			result.Status, result.ExitCode, result.Error = operationTimedOut, -1, fmt.Sprintf(rdpOperationTimedOut, timeout)
+		case err != nil:
+			result.Status, result.ExitCode, result.Error = operationFailed, -1, err.Error()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				result.ExitCode = exitErr.ExitCode()
+			}
+		default:
+			result.Status, result.ExitCode, result.Error = operationSucceeded, 0, ""
+		}
+		if result.Status == operationSucceeded {
+			break
+		}
+	}
+	result.ElapsedMs = time.Since(started).Milliseconds()
+	return result
+}
+
+// runPostRdpOperations runs the post RDP operations once a session that wasn't a dry run or shared ends, with
+// how it ended and how many seconds it lasted added to the params
+func (gcloudExecutor *GcloudExecutor) runPostRdpOperations(ws conn, instance *Instance, reason string) {
+	config := gcloudExecutor.config
+	if config == nil || len(config.PostRDPOperations) == 0 || gcloudExecutor.started.IsZero() {
+		return
+	}
+
+	params := make(map[string]string)
+	for name, value := range instance.PreRDPParams {
+		params[name] = value
+	}
+	params[admin.EndReasonParam] = reason
+	params[admin.SessionDurationParam] = strconv.Itoa(int(time.Since(gcloudExecutor.started).Seconds()))
+
+	gcloudExecutor.runRdpOperations(ws, config.PostRDPOperations, instance, params, postRdpPhase)
+	gcloudExecutor.started = time.Time{}
+}
@@ -0,0 +1,156 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+	"github.com/gorilla/websocket"
+)
+
+// operationShell is a mock shell that records the operations it runs, each run of a command in failures
+// takes the next error and waits for the context if it is a deadline
+type operationShell struct {
+	mockShell
+	ran      []string
+	failures map[string][]error
+}
+
+func (s *operationShell) ExecuteCmdWithContext(ctx context.Context, cmd string) ([]byte, error) {
+	s.ran = append(s.ran, cmd)
+	if errs := s.failures[cmd]; len(errs) > 0 {
+		s.failures[cmd] = errs[1:]
+		if errs[0] == context.DeadlineExceeded {
+			<-ctx.Done()
+		}
+		if errs[0] != nil {
+			return []byte("failed"), errs[0]
+		}
+	}
+	return []byte("done"), nil
+}
+
+func TestRunPostRdpOperations(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b", PreRDPParams: map[string]string{"ENV": "prod"}}
+	config := &admin.Config{PostRDPOperations: []admin.RdpOperation{
+		{Name: "log", Operation: "log ${{NAME}} ${{ENV}} ${{END_REASON}} ${{SESSION_DURATION}}"},
+		{Name: "on-error", Operation: "snapshot ${{NAME}}", Dependencies: map[string]string{"end_reason": endReasonError}},
+	}}
+
+	shell := &operationShell{}
+	g := NewGcloudExecutor(shell)
+	g.config = config
+	g.runPostRdpOperations(nil, instanceToUse, endReasonExpired)
+	if len(shell.ran) != 0 {
+		t.Errorf("runPostRdpOperations ran operations for a session that never started, got %v", shell.ran)
+	}
+
+	ws, written := recordingWebSocket(nil)
+	g.started = time.Now().Add(-90 * time.Second)
+	g.runPostRdpOperations(ws, instanceToUse, endReasonExpired)
+	if expected := []string{"log vm prod expired 90"}; !reflect.DeepEqual(shell.ran, expected) {
+		t.Errorf("runPostRdpOperations got %v, expected %v", shell.ran, expected)
+	}
+	if output := written(); len(output) != 3 || output[0].Message != "log: done" || output[1].Message != "Not running on-error due to dependency END_REASON" {
+		t.Errorf("runPostRdpOperations didn't report the operations on the socket, got %v", output)
+	}
+
+	g.runPostRdpOperations(ws, instanceToUse, endReasonError)
+	if len(shell.ran) != 1 {
+		t.Errorf("runPostRdpOperations ran the operations twice for one session, got %v", shell.ran)
+	}
+}
+
+func TestPostRdpOperationsAfterPreflight(t *testing.T) {
+	config := &admin.Config{PostRDPOperations: []admin.RdpOperation{{Name: "log", Operation: "log ${{NAME}} ${{END_REASON}}"}}}
+
+	// Without a zone the permission check fails before anything is created
+	reads := []string{`{"name": "vm", "project": "test-project"}`}
+	ws, written := recordingWebSocket(func() (int, []byte, error) {
+		if len(reads) == 0 {
+			return 0, nil, errors.New("closed")
+		}
+		read := reads[0]
+		reads = reads[1:]
+		return websocket.TextMessage, []byte(read), nil
+	})
+
+	shell := &operationShell{}
+	g := NewGcloudExecutor(shell)
+	g.runTunnelSession(ws, config, false)
+	if expected := []string{"log vm " + endReasonError}; !reflect.DeepEqual(shell.ran, expected) {
+		t.Errorf("runTunnelSession got %v after the permission check failed, expected %v", shell.ran, expected)
+	}
+	if output := written(); len(output) < 2 || output[1].Err != missingPermissionValues {
+		t.Errorf("runTunnelSession didn't fail at the permission check, got %v", output)
+	}
+}
+
+func TestRunRdpOperations(t *testing.T) {
+	rdpOperationRetryDelay = 0
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b"}
+	shell := &operationShell{failures: map[string][]error{
+		"flaky vm":   {errors.New("exit status 1")},
+		"slow vm":    {context.DeadlineExceeded},
+		"failing vm": {errors.New("exit status 2")},
+	}}
+	g := NewGcloudExecutor(shell)
+	operations := []admin.RdpOperation{
+		{Name: "flaky", Operation: "flaky ${{NAME}}", Retries: 1},
+		{Name: "slow", Operation: "slow ${{NAME}}", Timeout: time.Millisecond},
+		{Name: "failing", Operation: "failing ${{NAME}}", Required: true},
+		{Name: "after", Operation: "after ${{NAME}}"},
+	}
+
+	ws, written := recordingWebSocket(nil)
+	err := g.runRdpOperations(ws, operations, instanceToUse, nil, preRdpPhase)
+	if err == nil || err.Error() != fmt.Sprintf(rdpOperationAborted, "pre RDP", "failing", "vm") {
+		t.Errorf("runRdpOperations didn't abort when a required operation failed, got %v", err)
+	}
+	if expected := []string{"flaky vm", "flaky vm", "slow vm", "failing vm"}; !reflect.DeepEqual(shell.ran, expected) {
+		t.Errorf("runRdpOperations ran %v, expected %v", shell.ran, expected)
+	}
+
+	output := written()
+	event := output[len(output)-1].Event
+	if event == nil || event.Type != preRdpPhase.event || len(event.Operations) != 4 {
+		t.Fatalf("runRdpOperations didn't report the results of the phase, got %v", output[len(output)-1])
+	}
+	var statuses []string
+	for _, result := range event.Operations {
+		statuses = append(statuses, result.Status)
+	}
+	if expected := []string{operationSucceeded, operationTimedOut, operationFailed, operationSkipped}; !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("runRdpOperations got statuses %v, expected %v", statuses, expected)
+	}
+	if event.Operations[0].Attempts != 2 || event.Operations[1].ExitCode != -1 {
+		t.Errorf("runRdpOperations didn't record the attempts and exit code, got %+v", event.Operations)
+	}
+
+	// After the session a failure can only stop the remaining operations
+	shell = &operationShell{failures: map[string][]error{"failing vm": {errors.New("exit status 2")}}}
+	g = NewGcloudExecutor(shell)
+	if err := g.runRdpOperations(ws, operations[2:], instanceToUse, nil, postRdpPhase); err != nil || len(shell.ran) != 1 {
+		t.Errorf("runRdpOperations didn't skip the remaining post RDP operations, got %v, ran %v", err, shell.ran)
+	}
+}
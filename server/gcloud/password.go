@@ -0,0 +1,117 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// windows password reset consts
+const (
+	resetPasswordSocketCmd string = "reset-password"
+	resetPasswordCmd       string = "gcloud compute reset-windows-password %s --user=%s --zone=%s --project=%s --quiet --format=json"
+	resettingPassword      string = "Resetting Windows password of %v on %v"
+	resetPasswordOutput    string = "Reset Windows password of %v on %v"
+	resetPasswordError     string = "Unable to reset Windows password of %v on %v"
+	resetPasswordNoOutput  string = "gcloud didn't return the new credentials for %v"
+	resetPasswordNotSent   string = "The new credentials of %v on %v couldn't be sent, reset the password again"
+	invalidWindowsUsername string = "%q is not a valid Windows username"
+)
+
+// windowsUsernameRegex matches the usernames gcloud compute reset-windows-password accepts
+var windowsUsernameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,19}$`)
+
+// resetPasswordResult is the JSON printed by gcloud compute reset-windows-password
+type resetPasswordResult struct {
+	IPAddress string `json:"ip_address"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+// resetWindowsPassword resets the password of the user on the instance, creating the user if it doesn't exist.
+// The output contains the password so it is never logged or written to the socket as is.
+func (gcloudExecutor *GcloudExecutor) resetWindowsPassword(instance *Instance, username string) (*credentials, error) {
+	if !windowsUsernameRegex.MatchString(username) {
+		return nil, fmt.Errorf(invalidWindowsUsername, username)
+	}
+
+	log.Printf(resettingPassword, username, instance.Name)
+	cmd := fmt.Sprintf(resetPasswordCmd, instance.Name, username, path.Base(instance.Zone), instance.ProjectName)
+	output, err := gcloudExecutor.shell.ExecuteCmd(cmd)
+	if err != nil {
+		if stringOutput := strings.ToLower(string(output)); strings.Contains(stringOutput, gcloudAuthError) {
+			return nil, errors.New(SdkAuthError)
+		} else if strings.Contains(stringOutput, projectCmdError) {
+			return nil, errors.New(SdkProjectError)
+		}
+		return nil, fmt.Errorf(resetPasswordError, username, instance.Name)
+	}
+
+	// Warnings are printed to stderr around the JSON
+	start, end := strings.Index(string(output), "{"), strings.LastIndex(string(output), "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf(resetPasswordNoOutput, instance.Name)
+	}
+	var result resetPasswordResult
+	if err := json.Unmarshal(output[start:end+1], &result); err != nil || result.Password == "" {
+		return nil, fmt.Errorf(resetPasswordNoOutput, instance.Name)
+	}
+	if result.Username == "" {
+		result.Username = username
+	}
+
+	log.Printf(resetPasswordOutput, result.Username, instance.Name)
+	return &credentials{Username: result.Username, Password: result.Password}, nil
+}
+
+// handleResetPassword resets the password asked for by the socket command and either starts the RDP program
+// with the new credentials or sends them back once on the socket.
+func (gcloudExecutor *GcloudExecutor) handleResetPassword(ws conn, instance *Instance, cmd *socketCmd, port int, endChan chan<- bool) {
+	if cmd.Launch && instance.Protocol != rdpProtocol {
+		writeToSocket(ws, "", fmt.Errorf(rdpOnlyCmd, startRdpSocketCmd))
+		return
+	}
+
+	writeToSocket(ws, fmt.Sprintf(resettingPassword, cmd.Username, instance.Name), nil)
+	creds, err := gcloudExecutor.resetWindowsPassword(instance, cmd.Username)
+	if err != nil {
+		log.Println(err)
+		writeToSocket(ws, "", err)
+		return
+	}
+
+	if cmd.Launch {
+		writeToSocket(ws, fmt.Sprintf(resetPasswordOutput, creds.Username, instance.Name), nil)
+		creds.security = instance.security
+		creds.display = cmd.Display
+		gcloudExecutor.startRdpProgram(ws, creds, port, endChan)
+		return
+	}
+
+	socketMessage := newSocketMessage(fmt.Sprintf(resetPasswordOutput, creds.Username, instance.Name), nil)
+	socketMessage.Credentials = creds
+	if err := ws.WriteJSON(socketMessage); err != nil {
+		log.Println(err)
+		writeToSocket(ws, "", fmt.Errorf(resetPasswordNotSent, creds.Username, instance.Name))
+	}
+}
@@ -0,0 +1,108 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+const resetPasswordJSON = `{"ip_address": "10.0.0.2", "password": "password", "username": "quit"}`
+
+func TestResetWindowsPassword(t *testing.T) {
+	g := NewGcloudExecutor(&mockShell{})
+	instanceToUse := &Instance{Name: "valid", Zone: "projects/test-project/zones/us-west1-b", ProjectName: "test-project"}
+
+	creds, err := g.resetWindowsPassword(instanceToUse, "quit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Username != "quit" || creds.Password != "password" {
+		t.Errorf("resetWindowsPassword didn't parse credentials, got %v", creds)
+	}
+
+	if _, err := g.resetWindowsPassword(instanceToUse, "bad user; rm"); err == nil {
+		t.Errorf("resetWindowsPassword accepted an invalid username")
+	}
+
+	instanceToUse.Name = "auth-error"
+	if _, err := g.resetWindowsPassword(instanceToUse, "quit"); err == nil || err.Error() != SdkAuthError {
+		t.Errorf("resetWindowsPassword didn't return auth error, got %v", err)
+	}
+
+	instanceToUse.Name = "no-output"
+	if _, err := g.resetWindowsPassword(instanceToUse, "quit"); err == nil {
+		t.Errorf("resetWindowsPassword didn't error without credentials in the output")
+	}
+}
+
+func TestHandleResetPassword(t *testing.T) {
+	var socketOutput []socketMessage
+
+	readMessage := func() (messageType int, p []byte, err error) {
+		return websocket.TextMessage, nil, nil
+	}
+
+	writeJSON := func(v interface{}) error {
+		socketOutput = append(socketOutput, *(v.(*socketMessage)))
+		return nil
+	}
+
+	closeFunc := func() error {
+		return nil
+	}
+
+	ws := newMockWebSocket(readMessage, writeJSON, closeFunc)
+	g := NewGcloudExecutor(&mockShell{})
+	instanceToUse := &Instance{Name: "valid", Zone: "projects/test-project/zones/us-west1-b", ProjectName: "test-project", Protocol: rdpProtocol}
+	endChan := make(chan bool, 1)
+
+	g.handleResetPassword(ws, instanceToUse, &socketCmd{Cmd: resetPasswordSocketCmd, Username: "quit"}, 9999, endChan)
+	last := socketOutput[len(socketOutput)-1]
+	if last.Credentials == nil || last.Credentials.Password != "password" {
+		t.Errorf("handleResetPassword didn't send credentials on the socket, got %v", last)
+	}
+	for _, message := range socketOutput[:len(socketOutput)-1] {
+		if message.Credentials != nil {
+			t.Errorf("handleResetPassword sent credentials more than once")
+		}
+	}
+
+	socketOutput = nil
+	instanceToUse.security = &rdpSecurity{Protocol: rdpSecurityNLA}
+	g.handleResetPassword(ws, instanceToUse, &socketCmd{Cmd: resetPasswordSocketCmd, Username: "quit", Launch: true}, 9999, endChan)
+	if quit := <-endChan; !quit {
+		t.Errorf("handleResetPassword didn't start the RDP program with the new credentials")
+	}
+	for _, message := range socketOutput {
+		if message.Credentials != nil {
+			t.Errorf("handleResetPassword sent credentials on the socket when launching")
+		}
+	}
+	if expected := fmt.Sprintf(rdpProgramQuit, "quit"); socketOutput[len(socketOutput)-1].Message != expected {
+		t.Errorf("handleResetPassword got %v, expected %v", socketOutput[len(socketOutput)-1].Message, expected)
+	}
+
+	socketOutput = nil
+	instanceToUse.Protocol = "ssh"
+	g.handleResetPassword(ws, instanceToUse, &socketCmd{Cmd: resetPasswordSocketCmd, Username: "quit", Launch: true}, 9999, endChan)
+	if len(socketOutput) != 1 || socketOutput[0].Err == "" {
+		t.Errorf("handleResetPassword launched an RDP program for a session that isn't RDP")
+	}
+}
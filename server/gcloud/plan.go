@@ -0,0 +1,223 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+// dry run consts
+const (
+	planEvent             string = "plan"
+	dryRunStartOutput     string = "Dry run for %v, nothing is run or changed"
+	dryRunDoneOutput      string = "Dry run for %v planned %v steps"
+	planRedacted          string = "<redacted>"
+	planUsername          string = "<username>"
+	planGcloudAccount     string = "<gcloud account>"
+	planInternalPort      string = "<internal port>"
+	planSessionDuration   string = "<seconds>"
+	planOperationSettings string = "timeout %v, retries %v, on failure %v"
+	planSkippedDependency string = "skipped, %v doesn't match"
+	planEndReasonOnly     string = "only if the session ends with %v %v"
+)
+
+// plan steps, in the order a session takes them
+const (
+	planPermissions      string = "check_permissions"
+	planInstanceStatus   string = "instance_status"
+	planPreRdpOperation  string = "pre_rdp_operation"
+	planIapGrant         string = "iap_grant"
+	planFirewallCheck    string = "firewall_check"
+	planFirewallCreate   string = "firewall_create"
+	planLocalPort        string = "local_port"
+	planTunnel           string = "tunnel"
+	planRdpClient        string = "rdp_client"
+	planPostRdpOperation string = "post_rdp_operation"
+	planFirewallDelete   string = "firewall_delete"
+	planIapRevoke        string = "iap_revoke"
+)
+
+// planStep is a step a session would take, Skip is set with the reason when the session wouldn't take it
+type planStep struct {
+	Step    string `json:"step"`
+	Name    string `json:"name,omitempty"`
+	Command string `json:"command,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	Skip    string `json:"skip,omitempty"`
+}
+
+// sessionPlan collects the steps of a dry run and sends each one to the socket
+type sessionPlan struct {
+	ws    conn
+	steps []planStep
+}
+
+func (plan *sessionPlan) add(step planStep) {
+	plan.steps = append(plan.steps, step)
+	message := step.Step
+	if step.Name != "" {
+		message = fmt.Sprintf("%v %v", step.Step, step.Name)
+	}
+	if step.Command != "" {
+		message = fmt.Sprintf("%v: %v", message, step.Command)
+	}
+	writeEventToSocket(plan.ws, message, nil, &tunnelEvent{Type: planEvent, Plan: &step})
+}
+
+// planSession walks the steps of a session for the instance and sends each one as a plan to the socket.
+// Nothing is run and nothing is changed, the local port is only checked to be free and the RDP client
+// command is built with the password redacted.
+func (gcloudExecutor *GcloudExecutor) planSession(ws conn, instance *Instance, config *admin.Config) []planStep {
+	settings := gcloudExecutor.settings
+	plan := &sessionPlan{ws: ws}
+	writeToSocket(ws, fmt.Sprintf(dryRunStartOutput, instance.Name), nil)
+
+	permissions := planStep{Step: planPermissions, Detail: strings.Join(requiredPermissions, ", ")}
+	if settings.jitGrant {
+		permissions.Detail = strings.Join(jitRequiredPermissions, ", ")
+	}
+	if !settings.checkPermissions {
+		permissions.Skip = "skip_permission_check is set"
+	}
+	plan.add(permissions)
+
+	status := planStep{Step: planInstanceStatus, Command: fmt.Sprintf(instanceStatusCmd, instance.Name, instance.Zone, instance.ProjectName),
+		Detail: "the client is asked to start the instance if it isn't running"}
+	if !settings.startStopped {
+		status.Skip = "start_stopped_instances is not set"
+	}
+	plan.add(status)
+
+	var preOperations, postOperations []admin.RdpOperation
+	if config != nil {
+		preOperations, postOperations = config.PreRDPOperations, config.PostRDPOperations
+	}
+	for _, operation := range preOperations {
+		plan.add(planRdpOperation(planPreRdpOperation, operation, instance, instance.PreRDPParams))
+	}
+
+	grant := grantCondition(iapGrantTitlePrefix+"<session>", instance.remotePort(), timeNow().Add(settings.sessionTimeout))
+	if settings.jitGrant {
+		plan.add(planStep{Step: planIapGrant, Command: fmt.Sprintf("setIamPolicy %v/v1/%v", iapURL, iapTunnelResource(instance)),
+			Detail: fmt.Sprintf("%v for %v when %v", iapTunnelRole, iamMember(planGcloudAccount), grant.Expression)})
+	}
+
+	firewallCreate := planStep{Step: planFirewallCreate, Detail: "only if no existing rule allows IAP"}
+	if len(instance.NetworkInterfaces) == 1 {
+		firewallCreate.Command = fmt.Sprintf(iapFirewallCreateCmd, firewallRuleSuffix(instance), instance.remotePort(), instance.Name,
+			instance.ProjectName, instance.NetworkInterfaces[0].Network, firewallDescription(timeNow().Add(settings.firewallTimeout)))
+	} else {
+		firewallCreate.Skip = fmt.Sprintf(multipleNetworksError, instance.Name)
+	}
+	plan.add(planStep{Step: planFirewallCheck, Command: fmt.Sprintf(firewallListCmd, instance.ProjectName),
+		Detail: fmt.Sprintf("looks for an enabled rule that allows %v to port %v", iapSourceRange, instance.remotePort())})
+	plan.add(firewallCreate)
+
+	// The port is only checked to be free, it isn't kept for the instance like a session's is
+	port, localPort := planStep{Step: planLocalPort}, instance.LocalPort
+	if listener, err := findLocalPort(instance, settings, portKey(instance)); err == nil {
+		localPort = listener.Addr().(*net.TCPAddr).Port
+		port.Detail = fmt.Sprintf("localhost:%v", localPort)
+		listener.Close()
+	} else {
+		port.Skip = err.Error()
+	}
+	plan.add(port)
+
+	tunnel := planStep{Step: planTunnel, Command: fmt.Sprintf(iapTunnelCmd, instance.Name, instance.remotePort(), instance.ProjectName, planInternalPort, instance.Zone),
+		Detail: "the local port forwards to the tunnel through a proxy that counts traffic"}
+	if native, ok := gcloudExecutor.tunneler().(*nativeIapTunnel); ok {
+		tunnel.Command = native.connectURL(instance)
+		tunnel.Detail = "connections to the local port are forwarded over IAP relay websockets, gcloud is the fallback"
+	}
+	plan.add(tunnel)
+
+	if instance.Protocol == rdpProtocol {
+		plan.add(gcloudExecutor.planRdpClient(localPort))
+	}
+
+	endParams := make(map[string]string)
+	for name, value := range instance.PreRDPParams {
+		endParams[name] = value
+	}
+	endParams[admin.SessionDurationParam] = planSessionDuration
+	for _, operation := range postOperations {
+		plan.add(planRdpOperation(planPostRdpOperation, operation, instance, endParams))
+	}
+
+	firewallDelete := planStep{Step: planFirewallDelete, Command: fmt.Sprintf(firewallDeleteCmd, firewallRuleSuffix(instance), instance.ProjectName),
+		Detail: fmt.Sprintf("when the session ends or after %v, only if the rule was created and no other session uses it", settings.firewallTimeout)}
+	plan.add(firewallDelete)
+	if settings.jitGrant {
+		plan.add(planStep{Step: planIapRevoke, Command: fmt.Sprintf("setIamPolicy %v/v1/%v", iapURL, iapTunnelResource(instance)),
+			Detail: fmt.Sprintf("removes the binding titled %v when the session ends", grant.Title)})
+	}
+
+	writeToSocket(ws, fmt.Sprintf(dryRunDoneOutput, instance.Name, len(plan.steps)), nil)
+	return plan.steps
+}
+
+// planRdpOperation renders the operation and decides if it would run. A post RDP operation that depends
+// on the end reason would run only if the session ends that way.
+func planRdpOperation(step string, operation admin.RdpOperation, instance *Instance, params map[string]string) planStep {
+	plan := planStep{Step: step, Name: operation.Name}
+	plan.Detail = fmt.Sprintf(planOperationSettings, operation.Timeout, operation.Retries, operation.FailureAction())
+
+	if step == planPostRdpOperation {
+		if reason, ok := operation.Dependencies[strings.ToLower(admin.EndReasonParam)]; ok {
+			params[admin.EndReasonParam] = reason
+			plan.Detail = fmt.Sprintf(planEndReasonOnly, reason, plan.Detail)
+		} else {
+			params[admin.EndReasonParam] = "<" + strings.ToLower(admin.EndReasonParam) + ">"
+		}
+	}
+
+	cmd, unmet, err := prepareRdpOperation(operation, toAdminInstance(instance), params)
+	plan.Command = cmd
+	if len(unmet) > 0 {
+		plan.Skip = fmt.Sprintf(planSkippedDependency, strings.Join(unmet, ", "))
+	} else if err != nil {
+		plan.Skip = err.Error()
+	}
+	return plan
+}
+
+// planRdpClient builds the command the RDP client would be started with, the password is redacted and any
+// profile the launcher writes is removed right away
+func (gcloudExecutor *GcloudExecutor) planRdpClient(port int) planStep {
+	plan := planStep{Step: planRdpClient, Name: gcloudExecutor.settings.launcher}
+	launcher, err := newRdpLauncher(gcloudExecutor.settings)
+	if err != nil {
+		plan.Skip = err.Error()
+		return plan
+	}
+	launch, err := launcher.launch(&credentials{Username: planUsername, Password: planRedacted}, port)
+	if err != nil {
+		plan.Skip = err.Error()
+		return plan
+	}
+	if launch.cleanup != nil {
+		launch.cleanup()
+	}
+	plan.Command = strings.Join(launch.args, " ")
+	plan.Detail = "started on start-rdp, the password is passed on stdin or in a private profile"
+	return plan
+}
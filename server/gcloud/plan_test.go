@@ -0,0 +1,104 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+// noRunShell fails the test if anything is run
+type noRunShell struct {
+	t *testing.T
+}
+
+func (s *noRunShell) ExecuteCmd(cmd string) ([]byte, error) {
+	s.t.Errorf("dry run ran %v", cmd)
+	return nil, nil
+}
+
+func (s *noRunShell) ExecuteCmdWithContext(ctx context.Context, cmd string) ([]byte, error) {
+	return s.ExecuteCmd(cmd)
+}
+
+func (s *noRunShell) ExecuteCmdWithStdin(args []string, stdin []byte, started func(int)) ([]byte, error) {
+	return s.ExecuteCmd(strings.Join(args, " "))
+}
+
+func (s *noRunShell) ExecuteCmdReader(cmd string) ([]io.ReadCloser, context.CancelFunc, error) {
+	s.ExecuteCmd(cmd)
+	return nil, func() {}, nil
+}
+
+func TestPlanSession(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b", Protocol: rdpProtocol, RemotePort: rdpPort,
+		NetworkInterfaces: []networkInterfaces{{Network: "default"}}, PreRDPParams: map[string]string{"ENV": "prod"}, DryRun: true}
+	config := &admin.Config{
+		PreRDPOperations: []admin.RdpOperation{
+			{Name: "tag", Operation: "tag ${{NAME}} ${{ENV}}", Retries: 2},
+			{Name: "staging-only", Operation: "reset ${{NAME}}", Dependencies: map[string]string{"env": "staging"}},
+		},
+		PostRDPOperations: []admin.RdpOperation{
+			{Name: "snapshot", Operation: "snapshot ${{NAME}} ${{END_REASON}}", Dependencies: map[string]string{"end_reason": endReasonError}},
+		},
+	}
+	ws, written := recordingWebSocket(nil)
+	g := NewGcloudExecutor(&noRunShell{t})
+	g.settings.jitGrant = true
+
+	steps := g.planSession(ws, instanceToUse, config)
+	byStep := make(map[string][]planStep)
+	for _, step := range steps {
+		byStep[step.Step] = append(byStep[step.Step], step)
+	}
+
+	for _, step := range []string{planPermissions, planPreRdpOperation, planIapGrant, planFirewallCheck, planFirewallCreate,
+		planLocalPort, planTunnel, planRdpClient, planPostRdpOperation, planFirewallDelete, planIapRevoke} {
+		if len(byStep[step]) == 0 {
+			t.Errorf("planSession is missing the %v step, got %+v", step, steps)
+		}
+	}
+	if pre := byStep[planPreRdpOperation]; len(pre) != 2 || pre[0].Command != "tag vm prod" || pre[0].Skip != "" || pre[1].Skip == "" {
+		t.Errorf("planSession didn't render the pre RDP operations and their dependencies, got %+v", pre)
+	}
+	if post := byStep[planPostRdpOperation]; len(post) != 1 || post[0].Command != "snapshot vm "+endReasonError || !strings.Contains(post[0].Detail, endReasonError) {
+		t.Errorf("planSession didn't plan the post RDP operation for its end reason, got %+v", post)
+	}
+	if create := byStep[planFirewallCreate]; len(create) != 1 || !strings.Contains(create[0].Command, "--network=default") {
+		t.Errorf("planSession didn't plan the firewall rule on the instance's network, got %+v", create)
+	}
+	if client := byStep[planRdpClient]; len(client) != 1 || !strings.Contains(client[0].Command, "/u:"+planUsername) {
+		t.Errorf("planSession didn't plan the RDP client command, got %+v", client)
+	}
+
+	output := written()
+	if len(output) != len(steps)+2 {
+		t.Errorf("planSession sent %v messages for %v steps", len(output), len(steps))
+	}
+	for _, message := range output {
+		if strings.Contains(message.Message, planRedacted) || (message.Event != nil && message.Event.Plan != nil && strings.Contains(message.Event.Plan.Command, planRedacted)) {
+			t.Errorf("planSession sent the password, got %+v", message)
+		}
+	}
+	if _, ok := localPorts.get(portKey(instanceToUse)); ok {
+		t.Errorf("planSession kept a local port for the instance")
+	}
+}
@@ -0,0 +1,177 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+	pshell "github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
+)
+
+// local port consts
+const (
+	noFreePort       string = "Could not get a unused port on system"
+	noPortInRange    string = "No local port is free between %v and %v"
+	invalidPortRange string = "Ignoring invalid local port range %v-%v"
+)
+
+// localPorts remembers the local port each instance was given so it gets the same one next time
+var localPorts = &portTable{Ports: make(map[string]int)}
+
+// portTable maps an instance and remote port to the local port it was last given
+type portTable struct {
+	mu    sync.Mutex
+	path  string
+	Ports map[string]int `json:"ports"`
+}
+
+// StartPortTable loads the port assignments from path, the table is kept in memory only if path is empty
+func StartPortTable(path string) error {
+	table := &portTable{path: path, Ports: make(map[string]int)}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, table); err != nil {
+				return err
+			}
+		}
+	}
+	localPorts = table
+	return nil
+}
+
+// portKey identifies the instance and remote port a local port is assigned to
+func portKey(instance *Instance) string {
+	return fmt.Sprintf("%v/%v/%v/%v", instance.ProjectName, instance.Zone, instance.Name, instance.remotePort())
+}
+
+func (t *portTable) get(key string) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	port, ok := t.Ports[key]
+	return port, ok
+}
+
+// assigned returns true if the port is assigned to an instance other than key
+func (t *portTable) assigned(port int, key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for other, assigned := range t.Ports {
+		if assigned == port && other != key {
+			return true
+		}
+	}
+	return false
+}
+
+// set assigns the port to key and saves the table
+func (t *portTable) set(key string, port int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Ports[key] == port {
+		return
+	}
+	t.Ports[key] = port
+	if t.path == "" {
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := ioutil.WriteFile(t.path, data, 0600); err != nil {
+		log.Println(err)
+	}
+}
+
+// portRange reads the configured local port range, an invalid range is ignored
+func portRange(config admin.PortRange) (int, int) {
+	if config.Min == 0 && config.Max == 0 {
+		return 0, 0
+	}
+	if config.Min < 1 || config.Max > 65535 || config.Min > config.Max {
+		log.Printf(invalidPortRange, config.Min, config.Max)
+		return 0, 0
+	}
+	return config.Min, config.Max
+}
+
+// listenOnLocalPort binds the local port for the instance's session and returns the listener, which is
+// kept open for the whole session so the port can't be taken between checking and using it.
+// The port sent with the instance is used if set, otherwise the port the instance had last time,
+// otherwise the first free port in the configured range or any free port.
+func listenOnLocalPort(instance *Instance, settings rdpSettings) (*net.TCPListener, error) {
+	key := portKey(instance)
+	listener, err := findLocalPort(instance, settings, key)
+	if err != nil {
+		return nil, err
+	}
+	localPorts.set(key, listener.Addr().(*net.TCPAddr).Port)
+	return listener, nil
+}
+
+func findLocalPort(instance *Instance, settings rdpSettings, key string) (*net.TCPListener, error) {
+	if instance.LocalPort != 0 {
+		listener, err := pshell.ListenOnPort(instance.LocalPort)
+		if err != nil {
+			return nil, fmt.Errorf(localPortUnavailable, instance.LocalPort)
+		}
+		return listener, nil
+	}
+
+	if port, ok := localPorts.get(key); ok {
+		if listener, err := pshell.ListenOnPort(port); err == nil {
+			return listener, nil
+		}
+		log.Printf("Local port %v of %v is in use, picking another", port, instance.Name)
+	}
+
+	if settings.portRangeMin == 0 {
+		listener, err := pshell.FindOpenPort()
+		if err != nil {
+			return nil, errors.New(noFreePort)
+		}
+		return listener, nil
+	}
+	for port := settings.portRangeMin; port <= settings.portRangeMax; port++ {
+		if localPorts.assigned(port, key) {
+			continue
+		}
+		if listener, err := pshell.ListenOnPort(port); err == nil {
+			return listener, nil
+		}
+	}
+	// Every unassigned port is taken, fall back to ports assigned to other instances that are free now
+	for port := settings.portRangeMin; port <= settings.portRangeMax; port++ {
+		if listener, err := pshell.ListenOnPort(port); err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf(noPortInRange, settings.portRangeMin, settings.portRangeMax)
+}
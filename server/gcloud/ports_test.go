@@ -0,0 +1,129 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+	pshell "github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
+)
+
+// freePortRange returns the start of a range of n ports that were free when checked
+func freePortRange(t *testing.T, n int) int {
+	for attempt := 0; attempt < 20; attempt++ {
+		listener, err := pshell.FindOpenPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if start+n > 65535 {
+			continue
+		}
+
+		free := true
+		for port := start; port < start+n && free; port++ {
+			if l, err := pshell.ListenOnPort(port); err == nil {
+				l.Close()
+			} else {
+				free = false
+			}
+		}
+		if free {
+			return start
+		}
+	}
+	t.Fatal("couldn't find a free port range")
+	return 0
+}
+
+func TestListenOnLocalPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ports.json")
+	if err := StartPortTable(path); err != nil {
+		t.Fatal(err)
+	}
+	defer StartPortTable("")
+
+	start := freePortRange(t, 3)
+	settings := newRdpSettings(&admin.Config{RDP: admin.RDPConfig{LocalPorts: admin.PortRange{Min: start, Max: start + 1}}})
+	first := &Instance{Name: "first", ProjectName: "test-project", Zone: "us-west1-b", RemotePort: rdpPort}
+	second := &Instance{Name: "second", ProjectName: "test-project", Zone: "us-west1-b", RemotePort: rdpPort}
+
+	listener, err := listenOnLocalPort(first, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := listener.Addr().(*net.TCPAddr).Port; port != start {
+		t.Errorf("listenOnLocalPort got port %v, expected the start of the range %v", port, start)
+	}
+	listener.Close()
+
+	// The first instance's port is skipped even while it isn't in use
+	listener, err = listenOnLocalPort(second, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := listener.Addr().(*net.TCPAddr).Port; port != start+1 {
+		t.Errorf("listenOnLocalPort gave the second instance port %v, expected %v", port, start+1)
+	}
+
+	if _, err := listenOnLocalPort(&Instance{Name: "third", ProjectName: "test-project", RemotePort: rdpPort, LocalPort: start + 1}, settings); err == nil {
+		t.Errorf("listenOnLocalPort didn't error for a requested port that is in use")
+	}
+	listener.Close()
+
+	// The assignments are kept across restarts
+	if err := StartPortTable(path); err != nil {
+		t.Fatal(err)
+	}
+	listener, err = listenOnLocalPort(second, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := listener.Addr().(*net.TCPAddr).Port; port != start+1 {
+		t.Errorf("listenOnLocalPort didn't reuse the saved port, got %v, expected %v", port, start+1)
+	}
+
+	held, err := listenOnLocalPort(first, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	if _, err := listenOnLocalPort(&Instance{Name: "third", ProjectName: "test-project", RemotePort: rdpPort}, settings); err == nil {
+		t.Errorf("listenOnLocalPort didn't error when every port in the range is in use")
+	}
+	listener.Close()
+}
+
+func TestPortRange(t *testing.T) {
+	if min, max := portRange(admin.PortRange{Min: 40000, Max: 39000}); min != 0 || max != 0 {
+		t.Errorf("portRange accepted a range that ends before it starts, got %v-%v", min, max)
+	}
+	if min, max := portRange(admin.PortRange{Min: 40000, Max: 40010}); min != 40000 || max != 40010 {
+		t.Errorf("portRange got %v-%v, expected 40000-40010", min, max)
+	}
+}
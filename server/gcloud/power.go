@@ -0,0 +1,275 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// instance power consts
+const (
+	instanceStatusCmd           string        = "gcloud compute instances describe %s --zone=%s --project=%s --format=value(status)"
+	instanceStartCmd            string        = "gcloud compute instances start %s --zone=%s --project=%s --async"
+	instanceResumeCmd           string        = "gcloud compute instances resume %s --zone=%s --project=%s --async"
+	instanceStopCmd             string        = "gcloud compute instances stop %s --zone=%s --project=%s --async"
+	startInstanceSocketCmd      string        = "start-instance"
+	instanceNotRunningEvent     string        = "instance_not_running"
+	instanceStatusEvent         string        = "instance_status"
+	instanceNotRunningOutput    string        = "Instance %v is %v, send start-instance to %v it or end to cancel"
+	instanceWaitingForConfirm   string        = "Waiting for start-instance or end"
+	instanceStatusOutput        string        = "Instance %v is %v"
+	instanceWaitingForGuest     string        = "Waiting up to %v for %v to accept connections"
+	instanceStartDeclined       string        = "Not connecting to %v because it isn't running"
+	instanceStatusError         string        = "Could not get the status of %v"
+	instanceStartError          string        = "Could not %v %v"
+	instanceStartTimedOut       string        = "%v didn't reach RUNNING within %v"
+	instanceTransitioning       string        = "Instance %v is %v, try again once it has stopped"
+	instanceStarting            string        = "Waiting for %v to start, send end to cancel"
+	instanceStartCancelled      string        = "Stopped waiting for %v to start"
+	defaultInstanceStartTimeout time.Duration = 5 * time.Minute
+)
+
+// instance statuses from the compute API
+const (
+	instanceRunning    string = "RUNNING"
+	instanceTerminated string = "TERMINATED"
+	instanceStopped    string = "STOPPED"
+	instanceSuspended  string = "SUSPENDED"
+	instanceStopping   string = "STOPPING"
+	instanceSuspending string = "SUSPENDING"
+)
+
+// instancePollInterval is how often the status of a starting instance is checked
+var instancePollInterval = 5 * time.Second
+
+// instanceStatus gets the current status of the instance from gcloud
+func (gcloudExecutor *GcloudExecutor) instanceStatus(instance *Instance) (string, error) {
+	output, err := gcloudExecutor.shell.ExecuteCmd(fmt.Sprintf(instanceStatusCmd, instance.Name, instance.Zone, instance.ProjectName))
+	if err != nil {
+		log.Println(string(output))
+		return "", fmt.Errorf(instanceStatusError, instance.Name)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// startAction returns the gcloud command and its verb that bring an instance in the status to RUNNING,
+// the command is empty if the instance gets there on its own
+func startAction(status string) (string, string) {
+	switch status {
+	case instanceTerminated, instanceStopped:
+		return instanceStartCmd, "start"
+	case instanceSuspended:
+		return instanceResumeCmd, "resume"
+	}
+	return "", ""
+}
+
+// socketRead is the result of reading a message from a socket
+type socketRead struct {
+	messageType int
+	message     []byte
+	err         error
+}
+
+// readAheadConn reads the socket in the background so a wait can stop when the client ends it. A read still
+// in flight when the wait stops is returned by the next ReadMessage.
+type readAheadConn struct {
+	conn
+
+	mu      sync.Mutex
+	pending chan socketRead
+}
+
+func newReadAheadConn(ws conn) *readAheadConn {
+	return &readAheadConn{conn: ws}
+}
+
+// read returns the channel the next message is sent on, starting a read if none is in flight
+func (c *readAheadConn) read() <-chan socketRead {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		pending := make(chan socketRead, 1)
+		go func() {
+			messageType, message, err := c.conn.ReadMessage()
+			pending <- socketRead{messageType, message, err}
+		}()
+		c.pending = pending
+	}
+	return c.pending
+}
+
+// consumed marks the message in flight as handled so the next read starts another
+func (c *readAheadConn) consumed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = nil
+}
+
+// ReadMessage returns the message in flight or reads the next one
+func (c *readAheadConn) ReadMessage() (int, []byte, error) {
+	read := <-c.read()
+	c.consumed()
+	return read.messageType, read.message, read.err
+}
+
+// SetPhase sets the phase on the socket
+func (c *readAheadConn) SetPhase(phase string) {
+	protocol.SetPhase(c.conn, phase)
+}
+
+// ensureInstanceRunning checks the instance is RUNNING before connecting. If it isn't, the client is asked
+// to confirm starting or resuming it, then the status is polled until it is RUNNING or the client ends the
+// wait. It returns true if the instance was started and the client asked for it to be stopped when the
+// session ends.
+func (gcloudExecutor *GcloudExecutor) ensureInstanceRunning(ctx context.Context, ws *readAheadConn, instance *Instance) (bool, error) {
+	status, err := gcloudExecutor.instanceStatus(instance)
+	if err != nil {
+		return false, err
+	}
+	if status == instanceRunning {
+		return false, nil
+	}
+	if status == instanceStopping || status == instanceSuspending {
+		return false, fmt.Errorf(instanceTransitioning, instance.Name, status)
+	}
+
+	stopAfter := false
+	if cmd, verb := startAction(status); cmd != "" {
+		writeEventToSocket(ws, fmt.Sprintf(instanceNotRunningOutput, instance.Name, status, verb), nil,
+			&tunnelEvent{Type: instanceNotRunningEvent, Detail: status})
+		confirm, err := readStartConfirmation(ws)
+		if err != nil {
+			return false, err
+		}
+		if confirm == nil {
+			return false, fmt.Errorf(instanceStartDeclined, instance.Name)
+		}
+		stopAfter = confirm.StopAfter
+
+		output, err := gcloudExecutor.shell.ExecuteCmd(fmt.Sprintf(cmd, instance.Name, instance.Zone, instance.ProjectName))
+		if err != nil {
+			log.Println(string(output))
+			return false, fmt.Errorf(instanceStartError, verb, instance.Name)
+		}
+	}
+
+	if err := gcloudExecutor.waitForRunning(ctx, ws, instance, status); err != nil {
+		return stopAfter, err
+	}
+
+	// Only the first start of the tunnel waits for the guest to boot
+	instance.bootWait = gcloudExecutor.settings.instanceStartTimeout
+	_, timeout := tunnelReadiness(instance, gcloudExecutor.settings)
+	writeToSocket(ws, fmt.Sprintf(instanceWaitingForGuest, timeout, instance.Name), nil)
+	return stopAfter, nil
+}
+
+// readStartConfirmation reads the socket until the client confirms or cancels starting the instance,
+// the command is nil if it was cancelled
+func readStartConfirmation(ws conn) (*socketCmd, error) {
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		var cmd socketCmd
+		if err := json.Unmarshal(message, &cmd); err == nil {
+			switch cmd.Cmd {
+			case startInstanceSocketCmd:
+				return &cmd, nil
+			case endRdpSocketCmd:
+				return nil, nil
+			}
+		}
+		writeToSocket(ws, "", errors.New(instanceWaitingForConfirm))
+	}
+}
+
+// waitForRunning polls the instance's status until it is RUNNING, sending each change to the socket. It
+// stops early if ctx is done, the socket is lost or the client sends end.
+func (gcloudExecutor *GcloudExecutor) waitForRunning(ctx context.Context, ws *readAheadConn, instance *Instance, status string) error {
+	timeout := gcloudExecutor.settings.instanceStartTimeout
+	deadline := time.Now().Add(timeout)
+	for status != instanceRunning {
+		if time.Now().After(deadline) {
+			return fmt.Errorf(instanceStartTimedOut, instance.Name, timeout)
+		}
+		if err := waitForPoll(ctx, ws, instance); err != nil {
+			return err
+		}
+
+		current, err := gcloudExecutor.instanceStatus(instance)
+		if err != nil {
+			return err
+		}
+		if current != status {
+			status = current
+			writeEventToSocket(ws, fmt.Sprintf(instanceStatusOutput, instance.Name, status), nil,
+				&tunnelEvent{Type: instanceStatusEvent, Detail: status})
+		}
+	}
+	return nil
+}
+
+// waitForPoll waits until the status is polled again, handling what the client sends in the meantime
+func waitForPoll(ctx context.Context, ws *readAheadConn, instance *Instance) error {
+	timer := time.NewTimer(instancePollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case read := <-ws.read():
+			ws.consumed()
+			if read.err != nil {
+				return read.err
+			}
+			var cmd socketCmd
+			if json.Unmarshal(read.message, &cmd) == nil && cmd.Cmd == endRdpSocketCmd {
+				return fmt.Errorf(instanceStartCancelled, instance.Name)
+			}
+			writeToSocket(ws, "", fmt.Errorf(instanceStarting, instance.Name))
+		}
+	}
+}
+
+// stopInstance stops an instance that was started for the session once the session has ended, it is left
+// running while another session, of any user, is still connected to it
+func (gcloudExecutor *GcloudExecutor) stopInstance(instance *Instance) {
+	if activeSessions.usesInstance(instance, gcloudExecutor.session) {
+		log.Printf("Not stopping %v, another session is still connected to it", instance.Name)
+		return
+	}
+	log.Println("Stopping instance started for the session", instance.Name)
+	output, err := gcloudExecutor.shell.ExecuteCmd(fmt.Sprintf(instanceStopCmd, instance.Name, instance.Zone, instance.ProjectName))
+	if err != nil {
+		log.Printf("Could not stop %v: %v", instance.Name, string(output))
+	}
+}
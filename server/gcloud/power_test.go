@@ -0,0 +1,205 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// powerShell is a mock shell for an instance that boots through the statuses after it is started
+type powerShell struct {
+	mockShell
+	mu       sync.Mutex
+	statuses []string
+	cmds     []string
+}
+
+func (s *powerShell) ExecuteCmd(cmd string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cmds = append(s.cmds, cmd)
+	if cmd == fmt.Sprintf(instanceStatusCmd, "vm", "us-west1-b", "test-project") {
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		return []byte(status + "\n"), nil
+	}
+	return nil, nil
+}
+
+// confirmingWebSocket returns a websocket that replies to the start prompt with the commands in order, once
+// they run out reads block until done is closed
+func confirmingWebSocket(done <-chan struct{}, cmds ...socketCmd) (*readAheadConn, func() []socketMessage) {
+	var mu sync.Mutex
+	ws, written := recordingWebSocket(func() (int, []byte, error) {
+		mu.Lock()
+		if len(cmds) == 0 {
+			mu.Unlock()
+			<-done
+			return 0, nil, errors.New("closed")
+		}
+		defer mu.Unlock()
+		cmd := cmds[0]
+		cmds = cmds[1:]
+		message, _ := json.Marshal(cmd)
+		return websocket.TextMessage, message, nil
+	})
+	return newReadAheadConn(ws), written
+}
+
+func TestEnsureInstanceRunning(t *testing.T) {
+	instancePollInterval = time.Millisecond
+	instanceToUse := &Instance{Name: "vm", Zone: "us-west1-b", ProjectName: "test-project", Protocol: rdpProtocol}
+
+	shell := &powerShell{statuses: []string{instanceTerminated, instanceTerminated, "STAGING", instanceRunning}}
+	g := NewGcloudExecutor(shell)
+	done := make(chan struct{})
+	defer close(done)
+	ws, written := confirmingWebSocket(done, socketCmd{Cmd: "status"}, socketCmd{Cmd: startInstanceSocketCmd, StopAfter: true})
+
+	stopAfter, err := g.ensureInstanceRunning(context.Background(), ws, instanceToUse)
+	if err != nil || !stopAfter {
+		t.Fatalf("ensureInstanceRunning got %v, %v", stopAfter, err)
+	}
+
+	output := written()
+	if output[0].Event == nil || output[0].Event.Type != instanceNotRunningEvent || output[0].Event.Detail != instanceTerminated {
+		t.Errorf("ensureInstanceRunning didn't ask to start the instance, got %v", output[0])
+	}
+	if output[1].Err != instanceWaitingForConfirm {
+		t.Errorf("ensureInstanceRunning didn't ignore other commands while waiting, got %v", output[1])
+	}
+	var statuses []string
+	for _, message := range output {
+		if message.Event != nil && message.Event.Type == instanceStatusEvent {
+			statuses = append(statuses, message.Event.Detail)
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != "STAGING" || statuses[1] != instanceRunning {
+		t.Errorf("ensureInstanceRunning didn't stream the status changes, got %v", statuses)
+	}
+	if shell.cmds[1] != fmt.Sprintf(instanceStartCmd, "vm", "us-west1-b", "test-project") {
+		t.Errorf("ensureInstanceRunning didn't start the instance, got %v", shell.cmds)
+	}
+	if probeRDP, timeout := tunnelReadiness(instanceToUse, g.settings); !probeRDP || timeout < g.settings.instanceStartTimeout {
+		t.Errorf("ensureInstanceRunning didn't wait for the guest, got %v, %v", probeRDP, timeout)
+	}
+	if g.settings.probeRDP || g.settings.readyTimeout >= g.settings.instanceStartTimeout {
+		t.Errorf("ensureInstanceRunning changed the settings of the session, got %v", g.settings)
+	}
+
+	instanceToUse.bootWait = 0
+	if probeRDP, timeout := tunnelReadiness(instanceToUse, g.settings); probeRDP || timeout != g.settings.readyTimeout {
+		t.Errorf("tunnelReadiness waited for the guest of a running instance, got %v, %v", probeRDP, timeout)
+	}
+}
+
+func TestEnsureInstanceRunningCancelled(t *testing.T) {
+	instancePollInterval = time.Millisecond
+	instanceToUse := &Instance{Name: "vm", Zone: "us-west1-b", ProjectName: "test-project"}
+	done := make(chan struct{})
+	defer close(done)
+
+	shell := &powerShell{statuses: []string{instanceTerminated, "STAGING"}}
+	ws, _ := confirmingWebSocket(done, socketCmd{Cmd: startInstanceSocketCmd, StopAfter: true}, socketCmd{Cmd: endRdpSocketCmd})
+	stopAfter, err := NewGcloudExecutor(shell).ensureInstanceRunning(context.Background(), ws, instanceToUse)
+	if err == nil || err.Error() != fmt.Sprintf(instanceStartCancelled, "vm") || !stopAfter {
+		t.Errorf("ensureInstanceRunning didn't stop waiting when the client ended it, got %v, %v", stopAfter, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ws, _ = confirmingWebSocket(done, socketCmd{Cmd: startInstanceSocketCmd})
+	result := make(chan error, 1)
+	go func() {
+		_, err := NewGcloudExecutor(&powerShell{statuses: []string{instanceTerminated, "STAGING"}}).ensureInstanceRunning(ctx, ws, instanceToUse)
+		result <- err
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("ensureInstanceRunning didn't return the context's error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ensureInstanceRunning kept waiting after the context was cancelled")
+	}
+}
+
+func TestEnsureInstanceRunningDeclined(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", Zone: "us-west1-b", ProjectName: "test-project"}
+
+	g := NewGcloudExecutor(&powerShell{statuses: []string{instanceRunning}})
+	if stopAfter, err := g.ensureInstanceRunning(context.Background(), nil, instanceToUse); err != nil || stopAfter {
+		t.Errorf("ensureInstanceRunning didn't pass a running instance through, got %v, %v", stopAfter, err)
+	}
+
+	shell := &powerShell{statuses: []string{instanceSuspended}}
+	done := make(chan struct{})
+	defer close(done)
+	ws, _ := confirmingWebSocket(done, socketCmd{Cmd: endRdpSocketCmd})
+	if _, err := NewGcloudExecutor(shell).ensureInstanceRunning(context.Background(), ws, instanceToUse); err == nil {
+		t.Errorf("ensureInstanceRunning didn't error when starting was cancelled")
+	}
+	if len(shell.cmds) != 1 {
+		t.Errorf("ensureInstanceRunning ran commands after starting was cancelled, got %v", shell.cmds)
+	}
+
+	g = NewGcloudExecutor(&powerShell{statuses: []string{instanceStopping}})
+	if _, err := g.ensureInstanceRunning(context.Background(), nil, instanceToUse); err == nil {
+		t.Errorf("ensureInstanceRunning didn't error for a stopping instance")
+	}
+}
+
+func TestStopInstanceInUse(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", Zone: "us-west1-b", ProjectName: "test-project"}
+	stopCmd := fmt.Sprintf(instanceStopCmd, "vm", "us-west1-b", "test-project")
+
+	shell := &powerShell{statuses: []string{instanceRunning}}
+	g := NewGcloudExecutor(shell)
+	g.session = activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(g.session.id)
+	other := activeSessions.add(&Instance{Name: "vm", Zone: "us-west1-b", ProjectName: "test-project"}, 9998, newRdpSettings(nil), lifetimeEnding(time.Hour))
+
+	g.stopInstance(instanceToUse)
+	if len(shell.cmds) != 0 {
+		t.Errorf("stopInstance stopped an instance another session is connected to, got %v", shell.cmds)
+	}
+
+	activeSessions.remove(other.id)
+	g.stopInstance(instanceToUse)
+	if len(shell.cmds) != 1 || shell.cmds[0] != stopCmd {
+		t.Errorf("stopInstance didn't stop the instance once no other session used it, got %v", shell.cmds)
+	}
+}
+
+func TestStartAction(t *testing.T) {
+	if cmd, verb := startAction(instanceSuspended); cmd != instanceResumeCmd || verb != "resume" {
+		t.Errorf("startAction got %v, %v for a suspended instance", cmd, verb)
+	}
+	if cmd, _ := startAction("STAGING"); cmd != "" {
+		t.Errorf("startAction got %v for an instance that is already starting", cmd)
+	}
+}
@@ -0,0 +1,184 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnel proxy consts
+const (
+	tunnelStatsEvent     string        = "tunnel_stats"
+	tunnelIdleOutput     string        = "Closing session for %v after %v without traffic"
+	defaultIdleTimeout   time.Duration = 30 * time.Minute
+	defaultStatsInterval time.Duration = 30 * time.Second
+)
+
+// proxyStats is the traffic through the session's local port, sent to the socket as part of tunnel_stats events
+type proxyStats struct {
+	BytesSent      uint64 `json:"bytes_sent"`
+	BytesReceived  uint64 `json:"bytes_received"`
+	SentPerSec     uint64 `json:"sent_per_sec"`
+	ReceivedPerSec uint64 `json:"received_per_sec"`
+	Connections    int32  `json:"connections"`
+	IdleMs         int64  `json:"idle_ms"`
+}
+
+// tunnelProxy relays connections on the client facing port to the tunnel's port, counting the bytes in each
+// direction and when they last moved so idle sessions can be closed.
+type tunnelProxy struct {
+	// updated atomically, kept first for 64-bit alignment
+	sent       uint64
+	received   uint64
+	lastActive int64
+	conns      int32
+
+	listener *net.TCPListener
+	target   string
+
+	// last stats sample used to compute throughput
+	mu           sync.Mutex
+	lastSample   time.Time
+	lastSent     uint64
+	lastReceived uint64
+}
+
+func newTunnelProxy(listener *net.TCPListener, tunnelPort int) *tunnelProxy {
+	now := time.Now()
+	return &tunnelProxy{
+		listener:   listener,
+		target:     net.JoinHostPort(tunnelHost, strconv.Itoa(tunnelPort)),
+		lastActive: now.UnixNano(),
+		lastSample: now,
+	}
+}
+
+// serve accepts connections until ctx is done
+func (p *tunnelProxy) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		p.listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		client, err := p.listener.AcceptTCP()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.relay(ctx, client)
+		}()
+	}
+	wg.Wait()
+}
+
+// relay pipes one client connection to the tunnel until either side closes
+func (p *tunnelProxy) relay(ctx context.Context, client *net.TCPConn) {
+	defer client.Close()
+
+	tunnel, err := net.DialTimeout("tcp", p.target, tunnelDialTimeout)
+	if err != nil {
+		log.Printf("tunnel proxy couldn't connect to %v: %v", p.target, err)
+		return
+	}
+	defer tunnel.Close()
+
+	atomic.AddInt32(&p.conns, 1)
+	defer atomic.AddInt32(&p.conns, -1)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(&countingWriter{w: tunnel, count: &p.sent, lastActive: &p.lastActive}, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(&countingWriter{w: client, count: &p.received, lastActive: &p.lastActive}, tunnel)
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// idleFor returns how long it has been since bytes moved in either direction
+func (p *tunnelProxy) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActive)))
+}
+
+// stats returns the totals and the throughput since the previous call
+func (p *tunnelProxy) stats() proxyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, now := p.measure()
+	p.lastSample, p.lastSent, p.lastReceived = now, stats.BytesSent, stats.BytesReceived
+	return stats
+}
+
+// snapshot returns the totals and the throughput since the last call to stats without starting a new sample,
+// it is used when a client asks for the status so the periodic stats aren't disturbed
+func (p *tunnelProxy) snapshot() proxyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, _ := p.measure()
+	return stats
+}
+
+// measure returns the stats against the last sample and when they were taken, the mutex must be held
+func (p *tunnelProxy) measure() (proxyStats, time.Time) {
+	sent, received := atomic.LoadUint64(&p.sent), atomic.LoadUint64(&p.received)
+	now := time.Now()
+	elapsed := now.Sub(p.lastSample).Seconds()
+	stats := proxyStats{
+		BytesSent:     sent,
+		BytesReceived: received,
+		Connections:   atomic.LoadInt32(&p.conns),
+		IdleMs:        p.idleFor().Milliseconds(),
+	}
+	if elapsed > 0 {
+		stats.SentPerSec = uint64(float64(sent-p.lastSent) / elapsed)
+		stats.ReceivedPerSec = uint64(float64(received-p.lastReceived) / elapsed)
+	}
+	return stats, now
+}
+
+// countingWriter adds the bytes written to count and marks the time of the write
+type countingWriter struct {
+	w          io.Writer
+	count      *uint64
+	lastActive *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if n > 0 {
+		atomic.AddUint64(c.count, uint64(n))
+		atomic.StoreInt64(c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
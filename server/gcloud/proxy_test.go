@@ -0,0 +1,119 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+func TestTunnelProxy(t *testing.T) {
+	// The echo listener stands in for the tunnel
+	tunnel, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	go func() {
+		for {
+			conn, err := tunnel.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := newTunnelProxy(listener, tunnel.Addr().(*net.TCPAddr).Port)
+	proxy.lastActive = time.Now().Add(-time.Hour).UnixNano()
+	if idle := proxy.idleFor(); idle < time.Hour {
+		t.Errorf("idleFor got %v, expected at least an hour", idle)
+	}
+	go proxy.serve(ctx)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	message := []byte("hello tunnel")
+	client.Write(message)
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != string(message) {
+		t.Fatalf("proxy didn't relay to the tunnel, got %q, %v", reply, err)
+	}
+
+	if snapshot := proxy.snapshot(); snapshot.BytesSent != uint64(len(message)) || snapshot.SentPerSec == 0 {
+		t.Errorf("snapshot didn't include the totals and throughput, got %+v", snapshot)
+	}
+	stats := proxy.stats()
+	if stats.BytesSent != uint64(len(message)) || stats.BytesReceived != uint64(len(message)) {
+		t.Errorf("stats got %v sent and %v received, expected %v each", stats.BytesSent, stats.BytesReceived, len(message))
+	}
+	if stats.Connections != 1 || stats.SentPerSec == 0 {
+		t.Errorf("stats didn't include the connection and throughput, got %+v", stats)
+	}
+	if idle := proxy.idleFor(); idle > time.Minute {
+		t.Errorf("idleFor wasn't reset by traffic, got %v", idle)
+	}
+
+	if stats = proxy.stats(); stats.SentPerSec != 0 || stats.BytesSent != uint64(len(message)) {
+		t.Errorf("stats throughput didn't reset between samples, got %+v", stats)
+	}
+	if snapshot := proxy.snapshot(); snapshot.SentPerSec != 0 {
+		t.Errorf("snapshot counted the bytes of the previous sample, got %+v", snapshot)
+	}
+}
+
+func TestNewRdpSettingsProxy(t *testing.T) {
+	settings := newRdpSettings(nil)
+	if settings.idleTimeout != defaultIdleTimeout || settings.statsInterval != defaultStatsInterval {
+		t.Errorf("newRdpSettings didn't default the proxy settings, got %v", settings)
+	}
+
+	settings = newRdpSettings(&admin.Config{RDP: admin.RDPConfig{IdleTimeout: -1}})
+	if settings.idleTimeout > 0 {
+		t.Errorf("newRdpSettings didn't allow disabling the idle timeout, got %v", settings.idleTimeout)
+	}
+}
+
+func TestReportTunnelReadinessProxyPort(t *testing.T) {
+	var socketOutput socketMessage
+	ws := newMockWebSocket(nil, func(v interface{}) error {
+		socketOutput = *(v.(*socketMessage))
+		return nil
+	}, func() error { return nil })
+
+	instanceToUse := &Instance{Name: "vm", proxyPort: 9999}
+	reportTunnelReadiness(ws, instanceToUse, 40000, time.Now(), time.Hour, nil, nil)
+	if socketOutput.Event == nil || socketOutput.Event.Port != 9999 {
+		t.Errorf("reportTunnelReadiness didn't report the client facing port, got %v", socketOutput.Event)
+	}
+}
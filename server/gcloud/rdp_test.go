@@ -169,22 +169,37 @@ func TestListenForCmd(t *testing.T) {
 }
 
 func TestReadIapTunnelOutput(t *testing.T) {
-	scanner := bufio.NewScanner(strings.NewReader(gcloudErrorOutput))
-	var cmdOutput []string
-	tunnelCreated := false
-	iapOutputChan := make(chan iapResult)
+	scanner := bufio.NewScanner(strings.NewReader(tunnelListeningOutput + "\n" + gcloudErrorOutput))
+	var cmdOutput tunnelOutput
+	failed := make(chan error, 1)
+
+	readIapTunnelOutput(scanner, &cmdOutput, failed)
+	select {
+	case err := <-failed:
+		if err.Error() != gcloudErrorOutput {
+			t.Errorf("readIapTunnelOutput sent wrong failure, got %v, expected %v", err, gcloudErrorOutput)
+		}
+	default:
+		t.Errorf("readIapTunnelOutput didn't send failure on gcloud error")
+	}
+	if expected := []string{tunnelListeningOutput, gcloudErrorOutput}; !reflect.DeepEqual(cmdOutput.get(), expected) {
+		t.Errorf("readIapTunnelOutput didn't collect output, got %v, expected %v", cmdOutput.get(), expected)
+	}
 
-	go readIapTunnelOutput(scanner, &tunnelCreated, &cmdOutput, iapOutputChan)
-	if iapResult := <-iapOutputChan; iapResult.tunnelCreated {
-		fmt.Println(iapResult)
-		t.Errorf("readIapTunnelOutput set tunnel created on gcloud error")
+	scanner = bufio.NewScanner(strings.NewReader(gcloudErrorOutput + "\n" + gcloudErrorOutput))
+	failed = make(chan error, 1)
+	readIapTunnelOutput(scanner, &cmdOutput, failed)
+	if len(failed) != 1 {
+		t.Errorf("readIapTunnelOutput didn't keep only the first failure")
 	}
 
-	scanner = bufio.NewScanner(strings.NewReader(tunnelCreatedOutput))
-	go readIapTunnelOutput(scanner, &tunnelCreated, &cmdOutput, iapOutputChan)
-	if iapResult := <-iapOutputChan; !iapResult.tunnelCreated {
-		fmt.Println(iapResult)
-		t.Errorf("readIapTunnelOutput didn't set tunnel created on tunnel created output")
+	bound := make(chan struct{})
+	boundOutput := tunnelOutput{listening: fmt.Sprintf(iapTunnelListening, 9999), bound: bound}
+	readIapTunnelOutput(bufio.NewScanner(strings.NewReader(tunnelListeningOutput)), &boundOutput, make(chan error, 1))
+	select {
+	case <-bound:
+	default:
+		t.Errorf("readIapTunnelOutput didn't report the tunnel listening")
 	}
 }
 
@@ -216,7 +231,7 @@ func TestStartRdpProgram(t *testing.T) {
 		t.Errorf("startRdpProgram didn't write error to socket, got %v, expected %v", socketOutput.Message, expected)
 	}
 
-	creds = &credentials{Username: "quit", Password: "password"}
+	creds = &credentials{Username: "quit", Password: "password", security: &rdpSecurity{Protocol: rdpSecurityNLA}}
 	go g.startRdpProgram(ws, creds, port, quitChan)
 	quit := <-quitChan
 	if !quit {
@@ -329,6 +344,9 @@ func TestStartIapTunnel(t *testing.T) {
 	if expected := fmt.Sprintf(iapTunnelError, instanceToUse.Name); socketOutput.Err != expected {
 		t.Errorf("startIapTunnel didn't write iapTunnelError to socket, got %v, expected %v", socketOutput.Err, expected)
 	}
+	if socketOutput.Event == nil || socketOutput.Event.Type != tunnelFailedEvent || socketOutput.Event.Detail != gcloudErrorOutput {
+		t.Errorf("startIapTunnel didn't write tunnel_failed event to socket, got %v", socketOutput.Event)
+	}
 
 	instanceToUse.ProjectName = "valid"
 	go g.startIapTunnel(ctx, ws, &instanceToUse, port, outputChan)
@@ -337,11 +355,38 @@ func TestStartIapTunnel(t *testing.T) {
 	if !output.tunnelCreated {
 		t.Errorf("startIapTunnel didn't create tunnel on valid output")
 	}
-	if expected := []string{tunnelCreatedOutput}; !reflect.DeepEqual(output.cmdOutput, expected) {
-		t.Errorf("startIapTunnel output chan cmdoutput not equal to output from cmd, got %v, expected %v", socketOutput.Message, expected)
+	if socketOutput.Event == nil || socketOutput.Event.Type != tunnelReadyEvent || socketOutput.Event.Port != 9999 {
+		t.Errorf("startIapTunnel didn't write tunnel_ready event to socket, got %v", socketOutput.Event)
 	}
 	if expected := fmt.Sprintf(iapTunnelStarted, instanceToUse.Name, 9999, rdpContextTimeout); socketOutput.Message != expected {
 		t.Errorf("startIapTunnel didn't write iapTunnelStarted to socket, got %v, expected %v", socketOutput.Message, expected)
 	}
 
 }
+
+func TestSetSessionPorts(t *testing.T) {
+	rdpInstance := Instance{RemotePort: 22, Protocol: "ssh"}
+	if err := setSessionPorts(&rdpInstance, false); err != nil || rdpInstance.RemotePort != rdpPort || rdpInstance.Protocol != rdpProtocol {
+		t.Errorf("setSessionPorts didn't force RDP port for RDP session, got %v %v", rdpInstance.RemotePort, rdpInstance.Protocol)
+	}
+
+	var decoded Instance
+	if err := json.Unmarshal([]byte(`{"remotePort": 5986, "localPort": 3390}`), &decoded); err != nil || decoded.RemotePort != 5986 || decoded.LocalPort != 3390 {
+		t.Errorf("Instance didn't decode remotePort and localPort, got %v %v", decoded.RemotePort, decoded.LocalPort)
+	}
+
+	forwardInstance := Instance{RemotePort: 5986}
+	if err := setSessionPorts(&forwardInstance, true); err != nil || forwardInstance.RemotePort != 5986 || forwardInstance.Protocol != defaultForwardProtocol {
+		t.Errorf("setSessionPorts didn't keep remote port for port forward session, got %v %v", forwardInstance.RemotePort, forwardInstance.Protocol)
+	}
+
+	forwardInstance = Instance{RemotePort: 0}
+	if err := setSessionPorts(&forwardInstance, true); err == nil || err.Error() != fmt.Sprintf(invalidRemotePort, 0) {
+		t.Errorf("setSessionPorts didn't error on missing remote port")
+	}
+
+	forwardInstance = Instance{RemotePort: 22, LocalPort: 70000}
+	if err := setSessionPorts(&forwardInstance, true); err == nil {
+		t.Errorf("setSessionPorts didn't error on invalid local port")
+	}
+}
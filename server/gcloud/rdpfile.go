@@ -0,0 +1,283 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// rdp file consts
+const (
+	// RdpFileContentType is the content type .rdp files are served with
+	RdpFileContentType     string = "application/x-rdp"
+	rdpFileNotRdp          string = "Session %v forwards %v, .rdp files are only available for RDP sessions"
+	rdpFileSigningKeyError string = "Could not load the .rdp signing certificate: %v"
+	rdpFileSigningKeyType  string = ".rdp files can only be signed with an RSA key"
+	rdpFileInvalidUsername string = "Username can't contain line breaks"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// RdpFileOptions are the client settings requested for a .rdp file
+type RdpFileOptions struct {
+	Username     string
+	Width        int
+	Height       int
+	Fullscreen   bool
+	MultiMonitor bool
+	Clipboard    bool
+}
+
+// RdpFile is a .rdp connection file for an active session, it stops working when the session ends.
+// ConnectBy is when the firewall rule opened for the file closes to new connections, it is zero when
+// the instance's firewall isn't managed by the server.
+type RdpFile struct {
+	Name      string
+	Content   []byte
+	Expires   time.Time
+	ConnectBy time.Time
+}
+
+// rdpSetting is one name:type:value line of a .rdp file, scope is the name used in signscope when it is signed
+type rdpSetting struct {
+	name  string
+	kind  string
+	value string
+	scope string
+}
+
+func (setting rdpSetting) String() string {
+	return fmt.Sprintf("%s:%s:%s", setting.name, setting.kind, setting.value)
+}
+
+// NewRdpFile builds the .rdp file for the owner's session, it is signed if the config has a signing certificate.
+// The session takes a new firewall lease so the file can connect for the firewall timeout after it is downloaded.
+func NewRdpFile(sessionID, owner string, options RdpFileOptions) (*RdpFile, error) {
+	session, ok := activeSessions.getOwned(sessionID, owner)
+	if !ok {
+		return nil, fmt.Errorf(sessionNotFound, sessionID)
+	}
+	if session.instance.Protocol != rdpProtocol {
+		return nil, fmt.Errorf(rdpFileNotRdp, sessionID, session.instance.Protocol)
+	}
+
+	if strings.ContainsAny(options.Username, "\r\n") {
+		return nil, errors.New(rdpFileInvalidUsername)
+	}
+	display := displayOptions{Width: options.Width, Height: options.Height}
+	if err := display.validate(); err != nil {
+		return nil, err
+	}
+
+	settings := rdpFileSettings(session, options)
+	var lines []string
+	for _, setting := range settings {
+		if setting.scope == "" {
+			lines = append(lines, setting.String())
+		}
+	}
+
+	signed, err := signRdpSettings(settings, session.settings)
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, signed...)
+
+	if err := session.leaseFirewall(quietConn{}); err != nil {
+		return nil, err
+	}
+
+	return &RdpFile{
+		Name:      fmt.Sprintf("%s-%s.rdp", session.instance.Name, session.id[:8]),
+		Content:   []byte(strings.Join(lines, "\r\n") + "\r\n"),
+		Expires:   session.lifetime.end(),
+		ConnectBy: session.firewallDeadline(),
+	}, nil
+}
+
+// rdpFileSettings returns the settings written to the file, the address is always the tunnel's local port
+func rdpFileSettings(session *tunnelSession, options RdpFileOptions) []rdpSetting {
+	address := fmt.Sprintf("localhost:%d", session.port)
+	screenMode := "1"
+	if options.Fullscreen {
+		screenMode = "2"
+	}
+	clipboard := "0"
+	if options.Clipboard {
+		clipboard = "1"
+	}
+
+	settings := []rdpSetting{
+		{name: "screen mode id", kind: "i", value: screenMode},
+		{name: "authentication level", kind: "i", value: "2"},
+		{name: "prompt for credentials", kind: "i", value: "1"},
+	}
+	if options.Username != "" {
+		settings = append(settings, rdpSetting{name: "username", kind: "s", value: options.Username})
+	}
+	if options.Width != 0 {
+		settings = append(settings,
+			rdpSetting{name: "desktopwidth", kind: "i", value: fmt.Sprint(options.Width)},
+			rdpSetting{name: "desktopheight", kind: "i", value: fmt.Sprint(options.Height)})
+	}
+	if options.MultiMonitor {
+		settings = append(settings, rdpSetting{name: "use multimon", kind: "i", value: "1"})
+	}
+
+	return append(settings,
+		rdpSetting{name: "full address", kind: "s", value: address, scope: "Full Address"},
+		rdpSetting{name: "alternate full address", kind: "s", value: address, scope: "Alternate Full Address"},
+		rdpSetting{name: "redirectclipboard", kind: "i", value: clipboard, scope: "RedirectClipboard"})
+}
+
+// signRdpSettings returns the lines of the signed settings followed by signscope and signature,
+// without a signing certificate the settings are returned unsigned.
+func signRdpSettings(settings []rdpSetting, rdp rdpSettings) ([]string, error) {
+	var lines, scope []string
+	for _, setting := range settings {
+		if setting.scope != "" {
+			lines = append(lines, setting.String())
+			scope = append(scope, setting.scope)
+		}
+	}
+	if rdp.rdpFileCert == "" {
+		return lines, nil
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(rdp.rdpFileCert, rdp.rdpFileKey)
+	if err != nil {
+		return nil, fmt.Errorf(rdpFileSigningKeyError, err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(rdpFileSigningKeyType)
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf(rdpFileSigningKeyError, err)
+	}
+
+	signscope := "signscope:s:" + strings.Join(scope, ",")
+	lines = append(lines, signscope)
+
+	signature, err := signPkcs7Detached(rdpSignedMessage(lines), cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remote Desktop expects a 12 byte header before the PKCS #7 signature
+	blob := make([]byte, 12, 12+len(signature))
+	binary.LittleEndian.PutUint32(blob[0:], 0x00010001)
+	binary.LittleEndian.PutUint32(blob[4:], 0x00000001)
+	binary.LittleEndian.PutUint32(blob[8:], uint32(len(signature)))
+	blob = append(blob, signature...)
+
+	return append(lines, "signature:s:"+base64.StdEncoding.EncodeToString(blob)), nil
+}
+
+// rdpSignedMessage is what Remote Desktop verifies, the signed lines and signscope as null terminated UTF-16LE
+func rdpSignedMessage(lines []string) []byte {
+	text := utf16.Encode([]rune(strings.Join(lines, "\r\n") + "\r\n\x00"))
+	message := make([]byte, 2*len(text))
+	for i, r := range text {
+		binary.LittleEndian.PutUint16(message[2*i:], r)
+	}
+	return message
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs7DataInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7DataInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+// signPkcs7Detached signs the message with SHA-256 and returns a detached PKCS #7 SignedData
+// without authenticated attributes that carries the signing certificate.
+func signPkcs7Detached(message []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo:      pkcs7DataInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+			DigestAlgorithm:           sha256Algorithm,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
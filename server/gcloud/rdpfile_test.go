@@ -0,0 +1,196 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSigningKeyPair writes a self-signed RSA certificate and key to dir for signing .rdp files
+func writeSigningKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "rdp signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	return certPath, keyPath
+}
+
+func TestNewRdpFile(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", Protocol: rdpProtocol}
+	session := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+	session.owner = "user@google.com"
+
+	rdpFile, err := NewRdpFile(session.id, "user@google.com", RdpFileOptions{Username: "user", Width: 1280, Height: 720, Clipboard: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "vm-" + session.id[:8] + ".rdp"; rdpFile.Name != expected {
+		t.Errorf("NewRdpFile got name %v, expected %v", rdpFile.Name, expected)
+	}
+	if !rdpFile.Expires.Equal(session.lifetime.end()) {
+		t.Errorf("NewRdpFile doesn't expire with the session, got %v", rdpFile.Expires)
+	}
+	for _, line := range []string{"full address:s:localhost:9999", "username:s:user", "desktopwidth:i:1280", "redirectclipboard:i:1"} {
+		if !strings.Contains(string(rdpFile.Content), line+"\r\n") {
+			t.Errorf("NewRdpFile is missing %v, got %v", line, string(rdpFile.Content))
+		}
+	}
+	if strings.Contains(string(rdpFile.Content), "signature:s:") {
+		t.Errorf("NewRdpFile signed the file without a signing certificate")
+	}
+
+	if _, err := NewRdpFile(session.id, "user@google.com", RdpFileOptions{Username: "user\r\nfull address:s:elsewhere"}); err == nil {
+		t.Errorf("NewRdpFile accepted a username with a line break")
+	}
+	if _, err := NewRdpFile("missing", "user@google.com", RdpFileOptions{}); err == nil {
+		t.Errorf("NewRdpFile didn't error for a missing session")
+	}
+	if _, err := NewRdpFile(session.id, "other@google.com", RdpFileOptions{}); err == nil || SessionActive(session.id, "other@google.com") {
+		t.Errorf("NewRdpFile didn't treat another owner's session as not found")
+	}
+
+	sshSession := activeSessions.add(&Instance{Name: "vm", Protocol: "ssh"}, 2222, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(sshSession.id)
+	if _, err := NewRdpFile(sshSession.id, "", RdpFileOptions{}); err == nil {
+		t.Errorf("NewRdpFile didn't error for a session that isn't RDP")
+	}
+
+	expired := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(-time.Minute))
+	defer activeSessions.remove(expired.id)
+	if SessionActive(expired.id, "") {
+		t.Errorf("SessionActive returned true for an expired session")
+	}
+}
+
+func TestNewRdpFileFirewall(t *testing.T) {
+	instanceToUse := &Instance{Name: "rdpfile-vm", ProjectName: "test-project", Protocol: rdpProtocol, RemotePort: rdpPort,
+		NetworkInterfaces: []networkInterfaces{{Network: "default"}}}
+	session := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+
+	// The firewall opened when the session started has already closed
+	shell := &firewallShell{}
+	session.executor = NewGcloudExecutor(shell)
+	session.executor.settings.firewallTimeout = time.Minute
+
+	before := time.Now()
+	rdpFile, err := NewRdpFile(session.id, "", RdpFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created, _ := shell.counts(); created != 1 || !firewallLeases.leased(firewallLeaseKey(instanceToUse)) {
+		t.Errorf("NewRdpFile didn't open the firewall for the file, got %v created", created)
+	}
+	if rdpFile.ConnectBy.Before(before.Add(time.Minute)) || rdpFile.ConnectBy.After(time.Now().Add(time.Minute)) {
+		t.Errorf("NewRdpFile got ConnectBy %v, expected the firewall timeout after the download", rdpFile.ConnectBy)
+	}
+
+	session.releaseFirewall(quietConn{})
+	if _, deleted := shell.counts(); deleted != 1 || firewallLeases.leased(firewallLeaseKey(instanceToUse)) {
+		t.Errorf("the file's firewall lease wasn't released with the session, got %v deleted", deleted)
+	}
+}
+
+func TestNewRdpFileSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdpfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	settings := newRdpSettings(nil)
+	settings.rdpFileCert, settings.rdpFileKey = writeSigningKeyPair(t, dir)
+	session := activeSessions.add(&Instance{Name: "vm", Protocol: rdpProtocol}, 9999, settings, lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+
+	rdpFile, err := NewRdpFile(session.id, "", RdpFileOptions{Username: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(rdpFile.Content), "\r\n"), "\r\n")
+	signatureLine := lines[len(lines)-1]
+	if !strings.HasPrefix(signatureLine, "signature:s:") {
+		t.Fatalf("NewRdpFile didn't end with a signature, got %v", signatureLine)
+	}
+	expectedScope := "signscope:s:Full Address,Alternate Full Address,RedirectClipboard"
+	if scope := lines[len(lines)-2]; scope != expectedScope {
+		t.Errorf("NewRdpFile got %v, expected %v", scope, expectedScope)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(signatureLine, "signature:s:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(blob) != 0x00010001 || int(binary.LittleEndian.Uint32(blob[8:])) != len(blob)-12 {
+		t.Fatalf("NewRdpFile signature has an invalid header %x", blob[:12])
+	}
+
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(blob[12:], &contentInfo); err != nil || !contentInfo.ContentType.Equal(oidSignedData) {
+		t.Fatalf("NewRdpFile signature isn't PKCS #7 signed data, got %v", err)
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(signedData.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(rdpSignedMessage(lines[len(lines)-5 : len(lines)-1]))
+	signerInfo := signedData.SignerInfos[0]
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signerInfo.EncryptedDigest); err != nil {
+		t.Errorf("NewRdpFile signature doesn't verify: %v", err)
+	}
+	if !bytes.Equal(signerInfo.IssuerAndSerialNumber.Issuer.FullBytes, cert.RawIssuer) {
+		t.Errorf("NewRdpFile signer doesn't name the signing certificate")
+	}
+}
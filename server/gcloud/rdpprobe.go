@@ -0,0 +1,220 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// X.224 consts from [MS-RDPBCGR] 2.2.1.1 and 2.2.1.2
+const (
+	tpktVersion          byte          = 0x03
+	x224ConnectionReq    byte          = 0xE0
+	x224ConnectionConf   byte          = 0xD0
+	rdpNegReq            byte          = 0x01
+	rdpNegRsp            byte          = 0x02
+	rdpNegFailure        byte          = 0x03
+	protocolRDP          uint32        = 0x00000000
+	protocolSSL          uint32        = 0x00000001
+	protocolHybrid       uint32        = 0x00000002
+	protocolRDSTLS       uint32        = 0x00000004
+	protocolHybridEx     uint32        = 0x00000008
+	x224UnexpectedReply  string        = "RDP listener sent unexpected reply %x"
+	x224InvalidTpktReply string        = "RDP listener sent invalid TPKT header %x"
+	rdpProbeTimeout      time.Duration = 10 * time.Second
+	rdpSecurityEvent     string        = "rdp_security"
+	rdpSecurityOutput    string        = "RDP listener on %v selected %v"
+	rdpSecurityFailed    string        = "RDP negotiation with %v failed: %v"
+	rdpProbeFailed       string        = "Could not probe RDP listener on %v: %v"
+)
+
+// rdpSecurity names of the protocols the RDP listener can select
+const (
+	rdpSecurityStandard string = "rdp"
+	rdpSecurityTLS      string = "tls"
+	rdpSecurityNLA      string = "nla"
+	rdpSecurityNLAEx    string = "nla-ext"
+	rdpSecurityRDSTLS   string = "rdstls"
+)
+
+// rdpNegotiationFailures maps the failureCode of an RDP Negotiation Failure to its name
+var rdpNegotiationFailures = map[uint32]string{
+	1: "SSL_REQUIRED_BY_SERVER",
+	2: "SSL_NOT_ALLOWED_BY_SERVER",
+	3: "SSL_CERT_NOT_ON_SERVER",
+	4: "INCONSISTENT_FLAGS",
+	5: "HYBRID_REQUIRED_BY_SERVER",
+	6: "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER",
+}
+
+// rdpSecurity is the result of negotiating security with the RDP listener
+type rdpSecurity struct {
+	Protocol    string `json:"protocol,omitempty"`
+	FailureCode uint32 `json:"failure_code,omitempty"`
+	Failure     string `json:"failure,omitempty"`
+}
+
+// x224ConnectionRequest builds a TPKT wrapped X.224 Connection Request with an RDP Negotiation Request
+func x224ConnectionRequest(requestedProtocols uint32) []byte {
+	negReq := make([]byte, 8)
+	negReq[0] = rdpNegReq
+	binary.LittleEndian.PutUint16(negReq[2:], 8)
+	binary.LittleEndian.PutUint32(negReq[4:], requestedProtocols)
+
+	// Length indicator, CR code, destination reference, source reference and class
+	x224 := append([]byte{byte(6 + len(negReq)), x224ConnectionReq, 0, 0, 0, 0, 0}, negReq...)
+
+	tpkt := make([]byte, 4, 4+len(x224))
+	tpkt[0] = tpktVersion
+	binary.BigEndian.PutUint16(tpkt[2:], uint16(4+len(x224)))
+	return append(tpkt, x224...)
+}
+
+// readX224ConnectionConfirm reads the TPKT packet sent in reply to the connection request and returns
+// the X.224 TPDU inside it after checking it is a Connection Confirm.
+func readX224ConnectionConfirm(conn io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if header[0] != tpktVersion || length < 4+7 {
+		return nil, fmt.Errorf(x224InvalidTpktReply, header)
+	}
+
+	tpdu := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, tpdu); err != nil {
+		return nil, err
+	}
+	if tpdu[1]&0xF0 != x224ConnectionConf {
+		return nil, fmt.Errorf(x224UnexpectedReply, tpdu[:2])
+	}
+	return tpdu, nil
+}
+
+// probeX224 sends a connection request through the connection and waits for the Connection Confirm,
+// proving an RDP listener answered at the other end.
+func probeX224(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(x224ConnectionRequest(protocolSSL | protocolHybrid)); err != nil {
+		return err
+	}
+	_, err := readX224ConnectionConfirm(conn)
+	return err
+}
+
+// parseRdpNegotiation reads the RDP Negotiation Response or Failure at the end of a Connection Confirm,
+// a confirm without one comes from a listener that only supports standard RDP security.
+func parseRdpNegotiation(tpdu []byte) (*rdpSecurity, error) {
+	// Length indicator, CC code, destination reference, source reference and class
+	if len(tpdu) < 7+8 {
+		return &rdpSecurity{Protocol: rdpSecurityStandard}, nil
+	}
+
+	negotiation := tpdu[7:]
+	value := binary.LittleEndian.Uint32(negotiation[4:8])
+	switch negotiation[0] {
+	case rdpNegRsp:
+		switch value {
+		case protocolRDP:
+			return &rdpSecurity{Protocol: rdpSecurityStandard}, nil
+		case protocolSSL:
+			return &rdpSecurity{Protocol: rdpSecurityTLS}, nil
+		case protocolHybrid:
+			return &rdpSecurity{Protocol: rdpSecurityNLA}, nil
+		case protocolHybridEx:
+			return &rdpSecurity{Protocol: rdpSecurityNLAEx}, nil
+		case protocolRDSTLS:
+			return &rdpSecurity{Protocol: rdpSecurityRDSTLS}, nil
+		}
+		return nil, fmt.Errorf(x224UnexpectedReply, negotiation)
+	case rdpNegFailure:
+		failure, ok := rdpNegotiationFailures[value]
+		if !ok {
+			failure = "UNKNOWN"
+		}
+		return &rdpSecurity{FailureCode: value, Failure: failure}, nil
+	}
+	return nil, fmt.Errorf(x224UnexpectedReply, negotiation)
+}
+
+// probeRdpSecurity sends a connection request offering TLS and CredSSP through the tunnel's local port and
+// reports which protocol the RDP listener selected or why negotiation failed.
+func probeRdpSecurity(port int, timeout time.Duration) (*rdpSecurity, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(x224ConnectionRequest(protocolSSL | protocolHybrid | protocolHybridEx)); err != nil {
+		return nil, err
+	}
+	tpdu, err := readX224ConnectionConfirm(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseRdpNegotiation(tpdu)
+}
+
+// xfreerdpSecurityFlag returns the xfreerdp flag matching the selected protocol, an empty flag lets
+// xfreerdp negotiate by itself.
+func xfreerdpSecurityFlag(security *rdpSecurity) string {
+	if security == nil {
+		return ""
+	}
+	switch security.Protocol {
+	case rdpSecurityStandard:
+		return "/sec:rdp"
+	case rdpSecurityTLS:
+		return "/sec:tls"
+	case rdpSecurityNLA, rdpSecurityNLAEx:
+		return "/sec:nla"
+	}
+	return ""
+}
+
+// reportRdpSecurity probes the RDP listener through the tunnel and writes the result to the socket
+func reportRdpSecurity(ws conn, instance *Instance, port int) *rdpSecurity {
+	started := time.Now()
+	security, err := probeRdpSecurity(port, rdpProbeTimeout)
+	event := &tunnelEvent{Type: rdpSecurityEvent, Port: port, ElapsedMs: time.Since(started).Milliseconds()}
+
+	if err != nil {
+		log.Println(err)
+		event.Detail = err.Error()
+		writeEventToSocket(ws, "", fmt.Errorf(rdpProbeFailed, instance.Name, err), event)
+		return nil
+	}
+
+	event.Security = security
+	if security.Failure != "" {
+		event.Detail = security.Failure
+		writeEventToSocket(ws, "", fmt.Errorf(rdpSecurityFailed, instance.Name, security.Failure), event)
+		return security
+	}
+
+	event.Detail = security.Protocol
+	writeEventToSocket(ws, fmt.Sprintf(rdpSecurityOutput, instance.Name, security.Protocol), nil, event)
+	return security
+}
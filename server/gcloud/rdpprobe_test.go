@@ -0,0 +1,173 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectionConfirm is a TPKT wrapped X.224 Connection Confirm without a negotiation response
+var connectionConfirm = []byte{0x03, 0x00, 0x00, 0x0b, 0x06, 0xd0, 0x00, 0x00, 0x12, 0x34, 0x00}
+
+// negotiationConfirm builds a Connection Confirm carrying an RDP Negotiation Response or Failure
+func negotiationConfirm(negType byte, value uint32) []byte {
+	return []byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xd0, 0x00, 0x00, 0x12, 0x34, 0x00,
+		negType, 0x00, 0x08, 0x00, byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)}
+}
+
+// newFakeRdpListener accepts connections, reads the connection request and writes the reply
+func newFakeRdpListener(t *testing.T, reply []byte) *net.TCPListener {
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			request := make([]byte, len(x224ConnectionRequest(0)))
+			if _, err := io.ReadFull(conn, request); err == nil {
+				conn.Write(reply)
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestProbeX224(t *testing.T) {
+	listener := newFakeRdpListener(t, connectionConfirm)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if err := probeTunnelPort(port, true); err != nil {
+		t.Errorf("probeTunnelPort failed against an RDP listener, got %v", err)
+	}
+
+	badListener := newFakeRdpListener(t, []byte("SSH-2.0-OpenSSH\r\n"))
+	defer badListener.Close()
+	if err := probeTunnelPort(badListener.Addr().(*net.TCPAddr).Port, true); err == nil {
+		t.Errorf("probeTunnelPort succeeded against a listener that isn't RDP")
+	}
+	if err := probeTunnelPort(badListener.Addr().(*net.TCPAddr).Port, false); err != nil {
+		t.Errorf("probeTunnelPort without RDP probe failed against an open port, got %v", err)
+	}
+}
+
+func TestWaitForTunnel(t *testing.T) {
+	listener := newFakeRdpListener(t, connectionConfirm)
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if err := waitForTunnel(context.Background(), port, true, time.Second, nil, nil); err != nil {
+		t.Errorf("waitForTunnel failed with a listening port, got %v", err)
+	}
+
+	listener.Close()
+	if err := waitForTunnel(context.Background(), port, false, 500*time.Millisecond, nil, nil); err == nil {
+		t.Errorf("waitForTunnel didn't time out with a closed port")
+	}
+
+	failed := make(chan error, 1)
+	failed <- errors.New(gcloudErrorOutput)
+	if err := waitForTunnel(context.Background(), port, false, time.Hour, nil, failed); err == nil || err.Error() != gcloudErrorOutput {
+		t.Errorf("waitForTunnel didn't return tunnel failure, got %v", err)
+	}
+
+	// Something else listening on the port isn't taken for the tunnel before the tunnel reports binding it
+	listener = newFakeRdpListener(t, connectionConfirm)
+	defer listener.Close()
+	port = listener.Addr().(*net.TCPAddr).Port
+	bound := make(chan struct{})
+	if err := waitForTunnel(context.Background(), port, false, 500*time.Millisecond, bound, nil); err == nil {
+		t.Errorf("waitForTunnel probed the port before the tunnel bound it")
+	}
+	close(bound)
+	if err := waitForTunnel(context.Background(), port, false, time.Second, bound, nil); err != nil {
+		t.Errorf("waitForTunnel failed once the tunnel bound the port, got %v", err)
+	}
+}
+
+func TestProbeRdpSecurity(t *testing.T) {
+	tests := []struct {
+		reply    []byte
+		expected rdpSecurity
+		flag     string
+	}{
+		{connectionConfirm, rdpSecurity{Protocol: rdpSecurityStandard}, "/sec:rdp"},
+		{negotiationConfirm(rdpNegRsp, protocolSSL), rdpSecurity{Protocol: rdpSecurityTLS}, "/sec:tls"},
+		{negotiationConfirm(rdpNegRsp, protocolHybrid), rdpSecurity{Protocol: rdpSecurityNLA}, "/sec:nla"},
+		{negotiationConfirm(rdpNegRsp, protocolHybridEx), rdpSecurity{Protocol: rdpSecurityNLAEx}, "/sec:nla"},
+		{negotiationConfirm(rdpNegFailure, 5), rdpSecurity{FailureCode: 5, Failure: "HYBRID_REQUIRED_BY_SERVER"}, ""},
+	}
+
+	for _, test := range tests {
+		listener := newFakeRdpListener(t, test.reply)
+		security, err := probeRdpSecurity(listener.Addr().(*net.TCPAddr).Port, time.Second)
+		listener.Close()
+		if err != nil {
+			t.Errorf("probeRdpSecurity failed, got %v", err)
+			continue
+		}
+		if *security != test.expected {
+			t.Errorf("probeRdpSecurity got %v, expected %v", *security, test.expected)
+		}
+		if flag := xfreerdpSecurityFlag(security); flag != test.flag {
+			t.Errorf("xfreerdpSecurityFlag got %v, expected %v", flag, test.flag)
+		}
+	}
+
+	if _, err := parseRdpNegotiation(negotiationConfirm(rdpNegRsp, 0x40)[4:]); err == nil {
+		t.Errorf("parseRdpNegotiation accepted an unknown protocol")
+	}
+}
+
+func TestReportRdpSecurity(t *testing.T) {
+	var socketOutput socketMessage
+	ws := newMockWebSocket(func() (int, []byte, error) { return 0, nil, nil }, func(v interface{}) error {
+		socketOutput = *(v.(*socketMessage))
+		return nil
+	}, func() error { return nil })
+
+	instanceToUse := Instance{Name: "vm"}
+	listener := newFakeRdpListener(t, negotiationConfirm(rdpNegRsp, protocolHybrid))
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	security := reportRdpSecurity(ws, &instanceToUse, port)
+	if security == nil || security.Protocol != rdpSecurityNLA {
+		t.Errorf("reportRdpSecurity didn't return selected protocol, got %v", security)
+	}
+	if socketOutput.Event == nil || socketOutput.Event.Type != rdpSecurityEvent || socketOutput.Event.Security == nil {
+		t.Errorf("reportRdpSecurity didn't write security event, got %v", socketOutput.Event)
+	}
+
+	listener.Close()
+	if security := reportRdpSecurity(ws, &instanceToUse, port); security != nil {
+		t.Errorf("reportRdpSecurity returned security for a closed port")
+	}
+	if socketOutput.Err == "" {
+		t.Errorf("reportRdpSecurity didn't write probe error to socket")
+	}
+}
@@ -0,0 +1,243 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// resumable socket consts
+const (
+	sessionResumedEvent  string        = "session_resumed"
+	sessionResumedOutput string        = "Resumed session for %v, %v missed messages follow"
+	invalidResumeToken   string        = "Resume token is invalid or its session has ended"
+	credentialsNotKept   string        = "Socket was lost, credentials are not kept for replay"
+	defaultResumeGrace   time.Duration = 2 * time.Minute
+	resumeBufferSize     int           = 256
+)
+
+// resumableConns holds the sockets that can be resumed by their token
+var resumableConns = &resumeRegistry{conns: make(map[string]*resumableConn)}
+
+type resumeRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*resumableConn
+}
+
+func (r *resumeRegistry) add(c *resumableConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.token] = c
+}
+
+func (r *resumeRegistry) remove(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, token)
+}
+
+func (r *resumeRegistry) get(token string) (*resumableConn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.conns[token]
+	return c, ok
+}
+
+// resumableConn is a session's socket that survives the client dropping off for the grace period.
+// Messages written while the client is away are kept and replayed once it resumes with the token.
+type resumableConn struct {
+	token    string
+	owner    string
+	instance *Instance
+	grace    time.Duration
+
+	mu      sync.Mutex
+	ws      conn
+	gen     int
+	lost    bool
+	closed  bool
+	missed  []interface{}
+	phase   string
+	resumed chan struct{}
+	done    chan struct{}
+	// released is closed when the current socket is replaced or the conn is closed
+	released chan struct{}
+}
+
+// newResumableConn wraps the socket and registers it under a new resume token
+func newResumableConn(ws conn, owner string, instance *Instance, grace time.Duration) *resumableConn {
+	c := &resumableConn{
+		token:    newSessionID(),
+		owner:    owner,
+		instance: instance,
+		grace:    grace,
+		ws:       ws,
+		resumed:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	resumableConns.add(c)
+	return c
+}
+
+// ReadMessage reads from the current socket. If it is lost, the read waits for the client to resume
+// and only returns the error once the grace period passes.
+func (c *resumableConn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		ws, gen := c.ws, c.gen
+		c.mu.Unlock()
+
+		messageType, message, err := ws.ReadMessage()
+		if err == nil {
+			return messageType, message, nil
+		}
+
+		c.mu.Lock()
+		if c.gen != gen {
+			// The client already resumed on a new socket
+			c.mu.Unlock()
+			continue
+		}
+		c.lost = true
+		c.mu.Unlock()
+
+		if c.grace <= 0 {
+			return messageType, message, err
+		}
+		log.Printf("Socket for %v was lost, waiting %v for it to resume", c.instance.Name, c.grace)
+
+		timer := time.NewTimer(c.grace)
+		select {
+		case <-c.resumed:
+			timer.Stop()
+		case <-c.done:
+			timer.Stop()
+			return messageType, message, err
+		case <-timer.C:
+			return messageType, message, err
+		}
+	}
+}
+
+// WriteJSON writes to the current socket, or keeps the message for replay while the client is away.
+// Messages with credentials are never kept, they are dropped with an error instead.
+func (c *resumableConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New(invalidResumeToken)
+	}
+	if !c.lost {
+		if err := c.ws.WriteJSON(v); err == nil {
+			return nil
+		}
+		c.lost = true
+	}
+	if message, ok := v.(*socketMessage); ok && message.Credentials != nil {
+		return errors.New(credentialsNotKept)
+	}
+	if len(c.missed) == resumeBufferSize {
+		c.missed = c.missed[1:]
+	}
+	c.missed = append(c.missed, v)
+	return nil
+}
+
+// SetPhase sets the phase on the current socket and on the sockets the client resumes on
+func (c *resumableConn) SetPhase(phase string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phase = phase
+	protocol.SetPhase(c.ws, phase)
+}
+
+// Close closes the current socket and stops the token from resuming
+func (c *resumableConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	close(c.released)
+	ws := c.ws
+	c.mu.Unlock()
+
+	resumableConns.remove(c.token)
+	return ws.Close()
+}
+
+// resume moves the conn to the new socket and replays the missed messages on it. The returned channel
+// is closed once the socket is no longer used by the session.
+func (c *resumableConn) resume(ws conn) (<-chan struct{}, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New(invalidResumeToken)
+	}
+	old := c.ws
+	c.ws, c.gen, c.lost = ws, c.gen+1, false
+	missed := c.missed
+	c.missed = nil
+	protocol.SetPhase(ws, c.phase)
+
+	writeEventToSocket(ws, fmt.Sprintf(sessionResumedOutput, c.instance.Name, len(missed)), nil,
+		&tunnelEvent{Type: sessionResumedEvent, ResumeToken: c.token})
+	for _, v := range missed {
+		ws.WriteJSON(v)
+	}
+
+	close(c.released)
+	c.released = make(chan struct{})
+	released := c.released
+	c.mu.Unlock()
+
+	old.Close()
+	select {
+	case c.resumed <- struct{}{}:
+	default:
+	}
+	return released, nil
+}
+
+// resumeSession hands the socket to the session the token was given for and waits until the session
+// stops using it. Sockets without a verified owner can't resume.
+func (gcloudExecutor *GcloudExecutor) resumeSession(ws conn, token string) {
+	c, ok := resumableConns.get(token)
+	if !ok || gcloudExecutor.owner == "" || c.owner != gcloudExecutor.owner {
+		writeToSocket(ws, "", protocol.WithCode(protocol.CodeNotFound, errors.New(invalidResumeToken)))
+		ws.Close()
+		return
+	}
+
+	log.Printf("Resuming session socket for %v", c.instance.Name)
+	released, err := c.resume(ws)
+	if err != nil {
+		writeToSocket(ws, "", err)
+		ws.Close()
+		return
+	}
+	<-released
+}
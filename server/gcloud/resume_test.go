@@ -0,0 +1,152 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordingWebSocket returns a websocket that reads what read returns and records what is written
+func recordingWebSocket(read func() (int, []byte, error)) (mockWebSocket, func() []socketMessage) {
+	var mu sync.Mutex
+	var written []socketMessage
+	ws := newMockWebSocket(read, func(v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, *(v.(*socketMessage)))
+		return nil
+	}, func() error { return nil })
+
+	return ws, func() []socketMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]socketMessage(nil), written...)
+	}
+}
+
+func TestResumableConn(t *testing.T) {
+	lost := make(chan struct{})
+	oldWs, _ := recordingWebSocket(func() (int, []byte, error) {
+		<-lost
+		return 0, nil, errors.New("connection reset")
+	})
+
+	instanceToUse := &Instance{Name: "vm"}
+	c := newResumableConn(oldWs, "user@google.com", instanceToUse, time.Minute)
+	defer c.Close()
+
+	read := make(chan string)
+	go func() {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		read <- string(message)
+	}()
+
+	close(lost)
+	time.Sleep(50 * time.Millisecond)
+	writeToSocket(c, "while away", nil)
+	if err := c.WriteJSON(&socketMessage{Credentials: &credentials{Username: "user", Password: "password"}}); err == nil {
+		t.Errorf("WriteJSON kept credentials written while the client was away")
+	}
+
+	newWs, written := recordingWebSocket(func() (int, []byte, error) {
+		return websocket.TextMessage, []byte("from new socket"), nil
+	})
+	g := NewGcloudExecutor(&mockShell{})
+	g.SetOwner("user@google.com")
+	resumed := make(chan struct{})
+	go func() {
+		g.resumeSession(newWs, c.token)
+		close(resumed)
+	}()
+
+	select {
+	case message := <-read:
+		if message != "from new socket" {
+			t.Errorf("ReadMessage didn't continue on the resumed socket, got %v", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadMessage didn't return after the socket resumed")
+	}
+
+	output := written()
+	if len(output) != 2 || output[0].Event == nil || output[0].Event.Type != sessionResumedEvent || output[1].Message != "while away" {
+		t.Errorf("resume didn't replay the missed messages, got %v", output)
+	}
+
+	c.Close()
+	select {
+	case <-resumed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("resumeSession didn't return once the session closed")
+	}
+}
+
+func TestResumableConnGrace(t *testing.T) {
+	ws, _ := recordingWebSocket(func() (int, []byte, error) {
+		return 0, nil, errors.New("connection reset")
+	})
+	c := newResumableConn(ws, "", &Instance{Name: "vm"}, 50*time.Millisecond)
+	defer c.Close()
+
+	start := time.Now()
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage didn't error after the grace period")
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("ReadMessage didn't wait for the grace period, waited %v", waited)
+	}
+}
+
+func TestResumeSessionInvalid(t *testing.T) {
+	ws, _ := recordingWebSocket(nil)
+	c := newResumableConn(ws, "user@google.com", &Instance{Name: "vm"}, time.Minute)
+	defer c.Close()
+
+	g := NewGcloudExecutor(&mockShell{})
+	g.SetOwner("other@google.com")
+	newWs, written := recordingWebSocket(nil)
+	g.resumeSession(newWs, c.token)
+	if output := written(); len(output) != 1 || output[0].Err != invalidResumeToken {
+		t.Errorf("resumeSession accepted another user's token, got %v", output)
+	}
+
+	anonymous := newResumableConn(ws, "", &Instance{Name: "vm"}, time.Minute)
+	defer anonymous.Close()
+	g.SetOwner("")
+	newWs, written = recordingWebSocket(nil)
+	g.resumeSession(newWs, anonymous.token)
+	if output := written(); len(output) != 1 || output[0].Err != invalidResumeToken {
+		t.Errorf("resumeSession accepted a token without an owner, got %v", output)
+	}
+
+	c.Close()
+	g.SetOwner("user@google.com")
+	newWs, written = recordingWebSocket(nil)
+	g.resumeSession(newWs, c.token)
+	if output := written(); len(output) != 1 || output[0].Err != invalidResumeToken {
+		t.Errorf("resumeSession accepted the token of a closed socket, got %v", output)
+	}
+}
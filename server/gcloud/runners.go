@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
 	pshell "github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
 	"github.com/gorilla/websocket"
 )
@@ -39,6 +40,7 @@ func newSocketMessage(message string, err error) *socketMessage {
 	return &socketMessage{
 		Message: message,
 		Err:     errorMessage,
+		err:     err,
 	}
 }
 
@@ -51,100 +53,314 @@ func writeToSocket(ws conn, message string, err error) error {
 	return nil
 }
 
+// writeEventToSocket is a wrapper that is used to write JSON with a structured tunnel event to the websocket
+func writeEventToSocket(ws conn, message string, err error, event *tunnelEvent) error {
+	socketMessage := newSocketMessage(message, err)
+	socketMessage.Event = event
+	if err := ws.WriteJSON(socketMessage); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
 // StartPrivateRdp is a task runner that runs all the individual functions for automated RDP.
 func (gcloudExecutor *GcloudExecutor) StartPrivateRdp(ws *websocket.Conn, config *admin.Config) {
-	ctx, cancel := context.WithTimeout(context.Background(), rdpContextTimeout)
-	firewallCtx, firewallCancel := context.WithTimeout(context.Background(), firewallContextTimeout)
+	gcloudExecutor.runTunnelSession(protocol.NewConn(ws), config, false)
+}
+
+// StartPortForward is a task runner that forwards the remote port sent with the instance through an IAP tunnel,
+// it has the same lifecycle as StartPrivateRdp without the RDP program.
+func (gcloudExecutor *GcloudExecutor) StartPortForward(ws *websocket.Conn, config *admin.Config) {
+	gcloudExecutor.runTunnelSession(protocol.NewConn(ws), config, true)
+}
+
+// setSessionPorts validates the ports of the session, RDP sessions always forward the RDP port
+func setSessionPorts(instance *Instance, portForward bool) error {
+	if !portForward {
+		instance.RemotePort = rdpPort
+		instance.Protocol = rdpProtocol
+	} else if instance.RemotePort < 1 || instance.RemotePort > 65535 {
+		return fmt.Errorf(invalidRemotePort, instance.RemotePort)
+	}
+
+	if instance.LocalPort < 0 || instance.LocalPort > 65535 {
+		return fmt.Errorf(localPortUnavailable, instance.LocalPort)
+	}
+
+	instance.Protocol = strings.ToLower(instance.Protocol)
+	if instance.Protocol == "" {
+		instance.Protocol = defaultForwardProtocol
+	}
+	return nil
+}
+
+// runTunnelSession creates the firewall rule and IAP tunnel for the instance sent on the websocket and keeps
+// them until the session ends, the remote port is read from the instance if portForward is set.
+func (gcloudExecutor *GcloudExecutor) runTunnelSession(ws conn, config *admin.Config, portForward bool) {
+	ctx, cancel := context.WithCancel(context.Background())
 	iapOutputChan := make(chan iapResult)
 	endRdpChan := make(chan bool)
-	firewallDeleted := false
+	var firewallLease *firewallLease
 
+	protocol.SetPhase(ws, phaseStarting)
 	instanceToConn, err := getComputeInstanceFromConn(ws)
 	if err != nil {
-		gcloudExecutor.cleanUpRdp(ws, instanceToConn, false, false, cancel)
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
+		return
+	}
+	if instanceToConn.ResumeToken != "" {
+		cancel()
+		gcloudExecutor.resumeSession(ws, instanceToConn.ResumeToken)
 		return
 	}
 	if err := writeToSocket(ws, fmt.Sprintf("Server received instance %s", instanceToConn.Name), err); err != nil {
-		gcloudExecutor.cleanUpRdp(ws, instanceToConn, false, false, cancel)
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
 		return
 	}
 
 	log.Println("Got instance", instanceToConn.Name)
+	gcloudExecutor.settings = newRdpSettings(config)
 
-	if config != nil {
-		log.Println("using config")
-		for _, operation := range config.PreRDPOperations {
-			runOperation := true
+	firewallCtx, firewallCancel := context.WithTimeout(context.Background(), gcloudExecutor.settings.firewallTimeout)
+	defer firewallCancel()
 
-			tmp, _ := json.Marshal(*instanceToConn)
-			var adminInstance admin.Instance
-			json.Unmarshal(tmp, &adminInstance)
+	if err := setSessionPorts(instanceToConn, portForward); err != nil {
+		writeToSocket(ws, "", protocol.WithCode(protocol.CodeInvalidRequest, err))
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
+		return
+	}
 
-			operationToFill := admin.InstanceOperationToFill{Instance: adminInstance, Params: instanceToConn.PreRDPParams}
+	// A dry run only reports what the session would do, it never counts as started so no post RDP operations run
+	if instanceToConn.DryRun {
+		gcloudExecutor.planSession(ws, instanceToConn, config)
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonEnded, cancel)
+		return
+	}
 
-			configOperation := admin.ConfigAdminOperation{Name: operation.Name, Operation: operation.Operation}
-			filledOperation, err := admin.ReadInstanceOperation(operationToFill, configOperation)
-			if err != nil {
-				writeToSocket(ws, "", fmt.Errorf("Could not fill params of pre RDP operation %v", operation.Name))
-				runOperation = false
-			}
+	// A tunnel the same user already has open to the instance is shared instead of starting another
+	if session, ok := activeSessions.find(instanceToConn, gcloudExecutor.owner); ok {
+		if gcloudExecutor.attachSession(ws, session) {
+			cancel()
+			return
+		}
+	}
 
-			for dependency, value := range operation.Dependencies {
-				dependency = strings.ToUpper(dependency)
-				if instanceToConn.PreRDPParams[dependency] != value {
-					writeToSocket(ws, fmt.Sprintf("Not running %v due to dependency %v", operation.Name, dependency), nil)
-					runOperation = false
-				}
-			}
-			if runOperation {
-				ctx, _ := context.WithTimeout(context.Background(), 20*time.Second)
-				log.Println(fmt.Sprintf("Server running pre-rdp-operation: %s ", filledOperation.Operation))
-				output, _ := gcloudExecutor.shell.ExecuteCmdWithContext(ctx, filledOperation.Operation)
-				writeToSocket(ws, fmt.Sprintf("%s: %s", operation.Name, string(output)), nil)
-			}
+	// The session counts as started from here, post RDP operations run however it ends
+	gcloudExecutor.config = config
+	gcloudExecutor.started = time.Now()
+
+	// Permissions are checked before anything below changes the project
+	if gcloudExecutor.settings.checkPermissions {
+		if err := gcloudExecutor.preflightPermissions(ws, instanceToConn); err != nil {
+			writeToSocket(ws, "", err)
+			gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
+			return
+		}
+	}
+
+	if gcloudExecutor.settings.startStopped {
+		// The socket is read ahead while the instance starts so the client can end the wait
+		readAhead := newReadAheadConn(ws)
+		ws = readAhead
+		stopAfter, err := gcloudExecutor.ensureInstanceRunning(ctx, readAhead, instanceToConn)
+		// Deferred before the session is registered so it runs after the session is removed, clients that
+		// attach share this runner and keep it from returning until they leave
+		if stopAfter {
+			defer gcloudExecutor.stopInstance(instanceToConn)
+		}
+		if err != nil {
+			writeToSocket(ws, "", err)
+			gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
+			return
 		}
 	}
 
-	if err := gcloudExecutor.createFirewall(ws, instanceToConn); err != nil {
-		gcloudExecutor.cleanUpRdp(ws, instanceToConn, false, false, cancel)
+	if config != nil {
+		protocol.SetPhase(ws, phasePreRdp)
+		log.Println("using config")
+		if err := gcloudExecutor.runRdpOperations(ws, config.PreRDPOperations, instanceToConn, instanceToConn.PreRDPParams, preRdpPhase); err != nil {
+			writeToSocket(ws, "", err)
+			gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
+			return
+		}
+	}
+
+	// Tunnel access granted just for the session expires with it and is removed when it ends, it is moved to
+	// the session's deadline once the tunnel is ready
+	protocol.SetPhase(ws, phaseAccess)
+	if gcloudExecutor.settings.jitGrant {
+		deadline := time.Now().Add(gcloudExecutor.settings.sessionTimeout)
+		if gcloudExecutor.grant, err = gcloudExecutor.grantIapAccess(ws, instanceToConn, deadline); err != nil {
+			writeToSocket(ws, "", err)
+			gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
+			return
+		}
+	}
+
+	// An existing rule that already allows IAP means there is nothing to create or delete
+	firewallLease, err = gcloudExecutor.leaseFirewall(ws, instanceToConn)
+	if err != nil {
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, nil, false, endReasonError, cancel)
 		return
 	}
 
-	portListener, err := pshell.FindOpenPort()
+	protocol.SetPhase(ws, phaseTunnel)
+	portListener, err := listenOnLocalPort(instanceToConn, gcloudExecutor.settings)
 	if err != nil {
-		writeToSocket(ws, "", errors.New("Could not get a unused port on system"))
-		gcloudExecutor.cleanUpRdp(ws, instanceToConn, true, false, cancel)
+		writeToSocket(ws, "", err)
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, firewallLease, false, endReasonError, cancel)
 		return
 	}
 
 	freePort := portListener.Addr().(*net.TCPAddr).Port
 
 	log.Println("Got free port ", freePort)
+	if portForward {
+		writeToSocket(ws, fmt.Sprintf(forwardingPortOutput, instanceToConn.Protocol, instanceToConn.RemotePort, instanceToConn.Name, freePort), nil)
+	}
 
-	go gcloudExecutor.startIapTunnel(ctx, ws, instanceToConn, portListener, iapOutputChan)
-	if output := <-iapOutputChan; !output.tunnelCreated || output.err != nil {
-		writeToSocket(ws, "", errors.New(createIapFailed))
-		gcloudExecutor.cleanUpRdp(ws, instanceToConn, true, false, cancel)
+	// The tunnel listens on an internal port, the client facing port is served by the proxy to count traffic
+	tunnelListener, err := pshell.FindOpenPort()
+	if err != nil {
+		portListener.Close()
+		writeToSocket(ws, "", errors.New(noFreePort))
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, firewallLease, false, endReasonError, cancel)
 		return
 	}
+	tunnelPort := tunnelListener.Addr().(*net.TCPAddr).Port
+	instanceToConn.proxyPort = freePort
+
+	// The tunnel runs under its own context so the supervisor can restart it without ending the session
+	tunnelCtx, tunnelCancel := context.WithCancel(ctx)
+	defer tunnelCancel()
+
+	tunneler := gcloudExecutor.tunneler()
+	go tunneler.startIapTunnel(tunnelCtx, ws, instanceToConn, tunnelListener, iapOutputChan)
+	output := <-iapOutputChan
+
+	// The gcloud tunnel is kept as a fallback if the native one can't reach the relay
+	if _, native := tunneler.(*nativeIapTunnel); native && !output.tunnelCreated && output.err == nil {
+		writeToSocket(ws, fmt.Sprintf(nativeTunnelFallback, instanceToConn.Name), nil)
+		if tunnelListener, err = pshell.ListenOnPort(tunnelPort); err != nil {
+			log.Printf("Could not listen on %v to fall back to gcloud for %v: %v", tunnelPort, instanceToConn.Name, err)
+			writeToSocket(ws, "", fmt.Errorf(fallbackListenError, tunnelPort, err))
+		} else {
+			tunneler = gcloudExecutor
+			go tunneler.startIapTunnel(tunnelCtx, ws, instanceToConn, tunnelListener, iapOutputChan)
+			output = <-iapOutputChan
+		}
+	}
+
+	if !output.tunnelCreated || output.err != nil {
+		portListener.Close()
+		writeToSocket(ws, "", protocol.WithCode(protocol.CodeTunnelFailed, errors.New(createIapFailed)))
+		gcloudExecutor.cleanUpRdp(ws, instanceToConn, firewallLease, false, endReasonError, cancel)
+		return
+	}
+
+	// Restarts of the tunnel use the usual readiness probe, the guest has booted by now
+	instanceToConn.bootWait = 0
+
+	proxy := newTunnelProxy(portListener, tunnelPort)
+	go proxy.serve(ctx)
+
+	// The listener's selected security decides how the RDP program connects
+	if instanceToConn.Protocol == rdpProtocol {
+		instanceToConn.security = reportRdpSecurity(ws, instanceToConn, freePort)
+	}
+
+	// The session's lifetime starts once the tunnel is ready, the extend command can push out its deadline
+	lifetime := newSessionLifetime(gcloudExecutor.settings)
+	if gcloudExecutor.grant != nil {
+		if err := gcloudExecutor.renewIapGrant(gcloudExecutor.grant, lifetime.end()); err != nil {
+			writeToSocket(ws, "", fmt.Errorf(iapRenewError, instanceToConn.Name, err))
+		}
+	}
+
+	session := activeSessions.add(instanceToConn, freePort, gcloudExecutor.settings, lifetime)
+	session.proxy = proxy
+	session.grant = gcloudExecutor.grant
+	session.executor = gcloudExecutor
+	session.mu.Lock()
+	session.owner = gcloudExecutor.owner
+	session.mu.Unlock()
+	if firewallLease != nil {
+		session.setFirewall(firewallCreated)
+	} else {
+		session.setFirewall(firewallExisting)
+	}
+	gcloudExecutor.session = session
+	defer activeSessions.remove(session.id)
+
+	// From here the socket can be lost and resumed with its token without ending the session
+	resumable := newResumableConn(ws, gcloudExecutor.owner, instanceToConn, gcloudExecutor.settings.resumeGrace)
+	ws = resumable
+	protocol.SetPhase(ws, phaseConnected)
 
-	writeToSocket(ws, readyForCommandOutput, nil)
+	// Messages about the whole session go to every websocket attached to it
+	clients := session.clients
+	supervisor := newTunnelSupervisor(clients, instanceToConn, tunnelPort, gcloudExecutor.settings, tunneler, tunnelCancel, output.exited)
+	supervisor.leaseFirewall = session.leaseFirewall
+	session.setSupervisor(supervisor)
+	ownerID, _ := clients.attach(ws)
+	go lifetime.watch(ctx, clients, instanceToConn)
+	go supervisor.run(ctx)
+
+	writeEventToSocket(ws, fmt.Sprintf(sessionStartedOutput, session.id, instanceToConn.Name, freePort), nil,
+		&tunnelEvent{Type: sessionStartedEvent, Port: freePort, Detail: session.id, ResumeToken: resumable.token})
+
+	writeReadyForCommand(ws)
 
 	go gcloudExecutor.listenForCmd(ws, instanceToConn, freePort, endRdpChan)
 
+	statsTicker := time.NewTicker(gcloudExecutor.settings.statsInterval)
+	defer statsTicker.Stop()
+
+	firewallDone := firewallCtx.Done()
 	for {
 		select {
 		case <-endRdpChan:
-			gcloudExecutor.cleanUpRdp(ws, instanceToConn, !firewallDeleted, true, cancel)
+			if remaining := clients.detach(ownerID); remaining > 0 {
+				writeToSocket(ws, fmt.Sprintf(clientDetachedOutput, instanceToConn.Name, remaining), nil)
+				ws.Close()
+				continue
+			}
+			gcloudExecutor.cleanUpRdp(ws, instanceToConn, firewallLease, true, endReasonEnded, cancel)
+			return
+		case <-firewallDone:
+			if firewallLease != nil {
+				gcloudExecutor.releaseFirewall(clients, instanceToConn, firewallLease)
+				firewallLease = nil
+				session.setFirewall(firewallReleased)
+			}
+			firewallDone = nil
+		case <-lifetime.expired:
+			writeToSocket(clients, fmt.Sprintf(sessionExpiredOutput, instanceToConn.Name), nil)
+			gcloudExecutor.cleanUpRdp(clients, instanceToConn, firewallLease, true, endReasonExpired, cancel)
 			return
-		case <-firewallCtx.Done():
-			if !firewallDeleted {
-				gcloudExecutor.deleteFirewall(ws, instanceToConn)
-				firewallDeleted = true
-				firewallCancel()
+		case <-supervisor.failed:
+			writeToSocket(clients, fmt.Sprintf(tunnelRestoreFailed, instanceToConn.Name, gcloudExecutor.settings.restartAttempts), nil)
+			gcloudExecutor.cleanUpRdp(clients, instanceToConn, firewallLease, true, endReasonTunnelLost, cancel)
+			return
+		case <-session.closed:
+			writeToSocket(clients, fmt.Sprintf(sessionClosedOutput, instanceToConn.Name), nil)
+			gcloudExecutor.cleanUpRdp(clients, instanceToConn, firewallLease, true, endReasonClosed, cancel)
+			return
+		case <-session.detached:
+			gcloudExecutor.cleanUpRdp(clients, instanceToConn, firewallLease, true, endReasonEnded, cancel)
+			return
+		case <-statsTicker.C:
+			stats := proxy.stats()
+			writeEventToSocket(clients, "", nil, &tunnelEvent{Type: tunnelStatsEvent, Port: freePort, Stats: &stats})
+			idleTimeout := gcloudExecutor.settings.idleTimeout
+			if idle := proxy.idleFor(); idleTimeout > 0 && idle >= idleTimeout {
+				writeToSocket(clients, fmt.Sprintf(tunnelIdleOutput, instanceToConn.Name, idle.Round(time.Second)), nil)
+				gcloudExecutor.cleanUpRdp(clients, instanceToConn, firewallLease, true, endReasonIdle, cancel)
+				return
 			}
 		case <-ctx.Done():
-			gcloudExecutor.cleanUpRdp(ws, instanceToConn, !firewallDeleted, false, cancel)
+			gcloudExecutor.cleanUpRdp(clients, instanceToConn, firewallLease, false, endReasonCancelled, cancel)
 			return
 		}
 	}
@@ -153,10 +369,8 @@ func (gcloudExecutor *GcloudExecutor) StartPrivateRdp(ws *websocket.Conn, config
 // getComputeInstancesFromConn reads the instance that is sent at the start of the websocket connection
 func getComputeInstanceFromConn(ws conn) (*Instance, error) {
 	for {
+		// The message isn't logged since it can carry a resume token
 		_, message, err := ws.ReadMessage()
-
-		log.Println("got message: ", string(message))
-
 		if err != nil {
 			writeToSocket(ws, "", err)
 			return nil, err
@@ -164,13 +378,13 @@ func getComputeInstanceFromConn(ws conn) (*Instance, error) {
 		var instance Instance
 		if err := json.Unmarshal(message, &instance); err != nil {
 			log.Println("error unmarshalling instances")
-			writeToSocket(ws, "", err)
+			writeToSocket(ws, "", protocol.WithCode(protocol.CodeInvalidRequest, err))
 			return nil, err
 		}
-		if instance.Name == "" || instance.ProjectName == "" {
+		if instance.ResumeToken == "" && (instance.Name == "" || instance.ProjectName == "") {
 			log.Println("missing instance data values")
 			err = errors.New(missingInstanceValues)
-			writeToSocket(ws, "", err)
+			writeToSocket(ws, "", protocol.WithCode(protocol.CodeInvalidRequest, err))
 			return nil, err
 		}
 		return &instance, nil
@@ -184,17 +398,17 @@ func (gcloudExecutor *GcloudExecutor) listenForCmd(ws conn, instance *Instance,
 
 		_, message, err := ws.ReadMessage()
 
-		log.Printf("listenForCmd for %v got message %v", instance.Name, string(message))
-
 		if err != nil {
 			endChan <- true
 			return
 		}
 
+		// Commands can carry passwords so only the command name is logged
 		var cmd socketCmd
 		if err := json.Unmarshal(message, &cmd); err != nil {
 			log.Printf("listenForCmd for %v failed due to %v", instance.Name, err)
 		}
+		log.Printf("listenForCmd for %v got command %v", instance.Name, cmd.Cmd)
 
 		if cmd.Cmd == endRdpSocketCmd && cmd.InstanceName == instance.Name {
 			writeToSocket(ws, receivedEndCmd, nil)
@@ -202,27 +416,76 @@ func (gcloudExecutor *GcloudExecutor) listenForCmd(ws conn, instance *Instance,
 			return
 		}
 
+		if cmd.Cmd == startRdpSocketCmd && instance.Protocol != rdpProtocol {
+			writeToSocket(ws, "", fmt.Errorf(rdpOnlyCmd, cmd.Cmd))
+			continue
+		}
+
+		if cmd.Cmd == extendSocketCmd {
+			gcloudExecutor.handleExtend(ws, instance, &cmd)
+			continue
+		}
+
+		if cmd.Cmd == statusSocketCmd {
+			gcloudExecutor.handleStatus(ws, instance)
+			continue
+		}
+
+		if cmd.Cmd == resetPasswordSocketCmd {
+			go gcloudExecutor.handleResetPassword(ws, instance, &cmd, freePort, endChan)
+			continue
+		}
+
+		if cmd.Cmd == startRdpSocketCmd && cmd.Credential != "" {
+			creds, err := savedCredentials(gcloudExecutor.owner, instance, cmd.Credential)
+			if err != nil {
+				writeToSocket(ws, "", err)
+				continue
+			}
+			log.Println("starting rdp with saved credential")
+			writeToSocket(ws, receivedStartRdpCmd, nil)
+			creds.security = instance.security
+			creds.display = cmd.Display
+			go gcloudExecutor.startRdpProgram(ws, creds, freePort, endChan)
+			continue
+		}
+
 		if cmd.Cmd == startRdpSocketCmd && cmd.Username != "" {
 			log.Println("starting rdp")
 			writeToSocket(ws, receivedStartRdpCmd, nil)
-			creds := credentials{Username: cmd.Username, Password: cmd.Password}
+			creds := credentials{Username: cmd.Username, Password: cmd.Password, security: instance.security, display: cmd.Display}
 			go gcloudExecutor.startRdpProgram(ws, &creds, freePort, endChan)
 		}
 
 	}
 }
 
-// cleanUpRdp deletes the created firewall rules and ends the IAP tunnel and closes websocket
-func (gcloudExecutor *GcloudExecutor) cleanUpRdp(ws conn, instance *Instance, cleanFirewall bool, cleanIap bool, cancelFunc context.CancelFunc) {
+// cleanUpRdp deletes the created firewall rules, ends the IAP tunnel, runs the post RDP operations with the
+// reason the session ended and closes websocket
+func (gcloudExecutor *GcloudExecutor) cleanUpRdp(ws conn, instance *Instance, lease *firewallLease, cleanIap bool, reason string, cancelFunc context.CancelFunc) {
+	if instance == nil {
+		cancelFunc()
+		ws.Close()
+		return
+	}
 	log.Println("clean up rdp for ", instance.Name)
-	if cleanFirewall {
-		gcloudExecutor.deleteFirewall(ws, instance)
+	protocol.SetPhase(ws, phaseEnding)
+	if lease != nil {
+		gcloudExecutor.releaseFirewall(ws, instance, lease)
+	}
+	if gcloudExecutor.session != nil {
+		gcloudExecutor.session.releaseFirewall(ws)
+	}
+	if gcloudExecutor.grant != nil {
+		gcloudExecutor.revokeIapGrant(ws, instance, gcloudExecutor.grant)
+		gcloudExecutor.grant = nil
 	}
 	if cleanIap {
 		writeToSocket(ws, fmt.Sprintf(endingIapTunnel, instance.Name), nil)
 		log.Println("ending rdp for ", instance.Name)
 		cancelFunc()
 	}
-	writeToSocket(ws, fmt.Sprintf(shutDownRdp, instance.Name), nil)
+	gcloudExecutor.runPostRdpOperations(ws, instance, reason)
+	writeEventToSocket(ws, fmt.Sprintf(shutDownRdp, instance.Name), nil, &tunnelEvent{Type: sessionEndedEvent, Detail: reason})
 	ws.Close()
 }
@@ -0,0 +1,339 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// session consts
+const (
+	sessionStartedEvent  string = "session_started"
+	sessionStartedOutput string = "Session %v for %v is active on port %v"
+	sessionNotFound      string = "Session %v was not found, it may have ended"
+	sessionClosedOutput  string = "Session for %v was closed from the server"
+	firewallExisting     string = "existing"
+	firewallCreated      string = "created"
+	firewallReleased     string = "released"
+)
+
+// SessionInfo describes an active session for the sessions API
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Instance  string    `json:"instance"`
+	Project   string    `json:"project"`
+	Zone      string    `json:"zone"`
+	Protocol  string    `json:"protocol"`
+	Port      int       `json:"port"`
+	Owner     string    `json:"owner"`
+	Started   time.Time `json:"started"`
+	Deadline  time.Time `json:"deadline"`
+	Firewall  string    `json:"firewall"`
+	ClientPid int       `json:"client_pid,omitempty"`
+	Clients   int       `json:"clients"`
+}
+
+// activeSessions holds every tunnel session that is ready on the server
+var activeSessions = newSessionStore()
+
+// tunnelSession is a tunnel that finished starting and is waiting for or serving connections
+type tunnelSession struct {
+	id       string
+	instance *Instance
+	port     int
+	settings rdpSettings
+	started  time.Time
+	lifetime *sessionLifetime
+	proxy    *tunnelProxy
+	clients  *sessionClients
+	// grant is set if tunnel access was granted just for the session
+	grant *iapGrant
+	// executor opens the firewall again for new connections once the lease taken at the start is released
+	executor *GcloudExecutor
+
+	// closed is closed when the session is ended through the sessions API
+	closed    chan struct{}
+	closeOnce sync.Once
+	// detached is closed when the last websocket attached to the session leaves
+	detached   chan struct{}
+	detachOnce sync.Once
+
+	mu         sync.Mutex
+	owner      string
+	firewall   string
+	clientPid  int
+	supervisor *tunnelSupervisor
+	// leases are the firewall leases taken after the session started, they are released when it ends
+	leases []*firewallLease
+}
+
+// leaseFirewall takes another lease on the session's firewall rule so new connections reach the instance for
+// the firewall timeout
+func (session *tunnelSession) leaseFirewall(ws conn) error {
+	if session.executor == nil {
+		return nil
+	}
+	lease, err := session.executor.leaseFirewall(ws, session.instance)
+	if err != nil || lease == nil {
+		return err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.leases = append(session.leases, lease)
+	session.firewall = firewallCreated
+	return nil
+}
+
+// releaseFirewall releases the firewall leases taken after the session started
+func (session *tunnelSession) releaseFirewall(ws conn) {
+	session.mu.Lock()
+	leases := session.leases
+	session.leases = nil
+	session.mu.Unlock()
+	for _, lease := range leases {
+		session.executor.releaseFirewall(ws, session.instance, lease)
+	}
+}
+
+// firewallDeadline returns the latest deadline of the session's firewall leases, zero when it holds none
+func (session *tunnelSession) firewallDeadline() time.Time {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	var deadline time.Time
+	for _, lease := range session.leases {
+		if lease.deadline.After(deadline) {
+			deadline = lease.deadline
+		}
+	}
+	return deadline
+}
+
+// setFirewall records the state of the IAP firewall rule used by the session
+func (session *tunnelSession) setFirewall(state string) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.firewall = state
+}
+
+// setClientPid records the process id of the RDP client, 0 once it has exited
+func (session *tunnelSession) setClientPid(pid int) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.clientPid = pid
+}
+
+// close asks the session's runner to end it
+func (session *tunnelSession) close() {
+	session.closeOnce.Do(func() { close(session.closed) })
+}
+
+// detach tells the session's runner that its last websocket left so it ends the session
+func (session *tunnelSession) detach() {
+	session.detachOnce.Do(func() { close(session.detached) })
+}
+
+// setSupervisor sets the supervisor that watches the session's tunnel
+func (session *tunnelSession) setSupervisor(supervisor *tunnelSupervisor) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.supervisor = supervisor
+}
+
+// tunnelHealthy returns false while the session's tunnel is lost or being restarted
+func (session *tunnelSession) tunnelHealthy() bool {
+	session.mu.Lock()
+	supervisor := session.supervisor
+	session.mu.Unlock()
+	return supervisor == nil || supervisor.healthy()
+}
+
+func (session *tunnelSession) info() SessionInfo {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return SessionInfo{
+		ID:        session.id,
+		Instance:  session.instance.Name,
+		Project:   session.instance.ProjectName,
+		Zone:      session.instance.Zone,
+		Protocol:  session.instance.Protocol,
+		Port:      session.port,
+		Owner:     session.owner,
+		Started:   session.started,
+		Deadline:  session.lifetime.end(),
+		Firewall:  session.firewall,
+		ClientPid: session.clientPid,
+		Clients:   session.clients.count(),
+	}
+}
+
+// ownedBy returns true if the owner started the session
+func (session *tunnelSession) ownedBy(owner string) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.owner == owner
+}
+
+// shares returns true if a websocket asking for the instance can use this session's tunnel
+func (session *tunnelSession) shares(instance *Instance, owner string) bool {
+	existing := session.instance
+	return session.ownedBy(owner) && existing.ProjectName == instance.ProjectName && existing.Name == instance.Name &&
+		existing.RemotePort == instance.RemotePort && existing.Protocol == instance.Protocol &&
+		(instance.LocalPort == 0 || instance.LocalPort == session.port)
+}
+
+// sessionStore keeps the active sessions by id
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*tunnelSession
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*tunnelSession)}
+}
+
+// newSessionID returns a random id that is hard to guess, it is used in URLs that hand out session details
+func newSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// add registers a ready session that ends with its lifetime
+func (s *sessionStore) add(instance *Instance, port int, settings rdpSettings, lifetime *sessionLifetime) *tunnelSession {
+	session := &tunnelSession{
+		id:       newSessionID(),
+		instance: instance,
+		port:     port,
+		settings: settings,
+		started:  timeNow(),
+		lifetime: lifetime,
+		clients:  newSessionClients(),
+		closed:   make(chan struct{}),
+		detached: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.id] = session
+	return session
+}
+
+// remove drops the session once it has ended
+func (s *sessionStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// get returns the session if it is still active
+func (s *sessionStore) get(id string) (*tunnelSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if ok && session.lifetime.remaining() <= 0 {
+		return nil, false
+	}
+	return session, ok
+}
+
+// getOwned returns the session if it is still active and the owner started it, the sessions of other owners
+// are treated as not found
+func (s *sessionStore) getOwned(id, owner string) (*tunnelSession, bool) {
+	session, ok := s.get(id)
+	if !ok || !session.ownedBy(owner) {
+		return nil, false
+	}
+	return session, true
+}
+
+// find returns an active session the owner started for the same instance and port. A session without
+// attached clients is still starting or being torn down and one whose tunnel is being restarted may not come
+// back, so neither is returned.
+func (s *sessionStore) find(instance *Instance, owner string) (*tunnelSession, bool) {
+	for _, session := range s.list() {
+		select {
+		case <-session.closed:
+			continue
+		case <-session.detached:
+			continue
+		default:
+		}
+		if session.clients.count() > 0 && session.tunnelHealthy() && session.shares(instance, owner) {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// usesInstance returns true if an active session other than except is connected to the instance
+func (s *sessionStore) usesInstance(instance *Instance, except *tunnelSession) bool {
+	for _, session := range s.list() {
+		existing := session.instance
+		if session != except && existing.ProjectName == instance.ProjectName && existing.Zone == instance.Zone && existing.Name == instance.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the active sessions, oldest first
+func (s *sessionStore) list() []*tunnelSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*tunnelSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		if session.lifetime.remaining() > 0 {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].started.Before(sessions[j].started) })
+	return sessions
+}
+
+// SessionActive returns true if the session with the id is still active and the owner started it
+func SessionActive(id, owner string) bool {
+	_, ok := activeSessions.getOwned(id, owner)
+	return ok
+}
+
+// ListSessions returns the active sessions the owner started
+func ListSessions(owner string) []SessionInfo {
+	sessions := activeSessions.list()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		if session.ownedBy(owner) {
+			infos = append(infos, session.info())
+		}
+	}
+	return infos
+}
+
+// CloseSession ends the owner's session the same way the end-rdp command does, cleaning up its tunnel and
+// firewall rule
+func CloseSession(id, owner string) error {
+	session, ok := activeSessions.getOwned(id, owner)
+	if !ok {
+		return fmt.Errorf(sessionNotFound, id)
+	}
+	session.close()
+	return nil
+}
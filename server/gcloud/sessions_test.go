@@ -0,0 +1,286 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestListAndCloseSessions(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project", Zone: "us-west1-b", Protocol: rdpProtocol}
+	session := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+	session.owner = "user@google.com"
+	session.setFirewall(firewallCreated)
+	session.setClientPid(4242)
+
+	expired := activeSessions.add(instanceToUse, 9998, newRdpSettings(nil), lifetimeEnding(-time.Minute))
+	defer activeSessions.remove(expired.id)
+
+	other := activeSessions.add(instanceToUse, 9997, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(other.id)
+	other.owner = "other@google.com"
+
+	sessions := ListSessions("user@google.com")
+	if len(sessions) != 1 {
+		t.Fatalf("ListSessions got %v, expected only the owner's active session", sessions)
+	}
+	info := sessions[0]
+	if info.ID != session.id || info.Instance != "vm" || info.Project != "test-project" || info.Port != 9999 {
+		t.Errorf("ListSessions got %+v", info)
+	}
+	if info.Owner != "user@google.com" || info.Firewall != firewallCreated || info.ClientPid != 4242 {
+		t.Errorf("ListSessions is missing the owner, firewall or client, got %+v", info)
+	}
+	if !info.Deadline.Equal(session.lifetime.end()) {
+		t.Errorf("ListSessions got deadline %v, expected %v", info.Deadline, session.lifetime.end())
+	}
+
+	if err := CloseSession(session.id, "other@google.com"); err == nil {
+		t.Errorf("CloseSession didn't error for another owner's session")
+	}
+	select {
+	case <-session.closed:
+		t.Fatalf("CloseSession closed another owner's session")
+	default:
+	}
+
+	if err := CloseSession(session.id, "user@google.com"); err != nil {
+		t.Errorf("CloseSession failed, got %v", err)
+	}
+	select {
+	case <-session.closed:
+	default:
+		t.Errorf("CloseSession didn't signal the session's runner")
+	}
+	if err := CloseSession(session.id, "user@google.com"); err != nil {
+		t.Errorf("CloseSession errored when closing twice, got %v", err)
+	}
+	if err := CloseSession(expired.id, ""); err == nil {
+		t.Errorf("CloseSession didn't error for an expired session")
+	}
+}
+
+func TestStartRdpProgramClientPid(t *testing.T) {
+	var pids []int
+	session := activeSessions.add(&Instance{Name: "vm", Protocol: rdpProtocol}, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+
+	ws := newMockWebSocket(nil, func(v interface{}) error {
+		session.mu.Lock()
+		pids = append(pids, session.clientPid)
+		session.mu.Unlock()
+		return nil
+	}, func() error { return nil })
+
+	g := NewGcloudExecutor(&mockShell{})
+	g.session = session
+	quit := make(chan bool, 1)
+	g.startRdpProgram(ws, &credentials{Username: "quit", Password: "password", security: &rdpSecurity{Protocol: rdpSecurityNLA}}, 9999, quit)
+
+	if len(pids) != 1 || pids[0] != 4242 {
+		t.Errorf("startRdpProgram didn't record the client's pid while it ran, got %v", pids)
+	}
+	if session.clientPid != 0 {
+		t.Errorf("startRdpProgram didn't clear the client's pid after it quit, got %v", session.clientPid)
+	}
+}
+
+// endingWebSocket returns a websocket that sends the end command for the instance and records what is written
+func endingWebSocket(instance string, written *[]socketMessage) mockWebSocket {
+	end, _ := json.Marshal(socketCmd{Cmd: endRdpSocketCmd, InstanceName: instance})
+	return newMockWebSocket(func() (int, []byte, error) {
+		return websocket.TextMessage, end, nil
+	}, func(v interface{}) error {
+		*written = append(*written, *(v.(*socketMessage)))
+		return nil
+	}, func() error { return nil })
+}
+
+func TestAttachSession(t *testing.T) {
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project", Protocol: rdpProtocol, RemotePort: rdpPort}
+	session := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+	session.owner = "user@google.com"
+
+	if _, ok := activeSessions.find(instanceToUse, "user@google.com"); ok {
+		t.Errorf("find returned a session without attached clients")
+	}
+
+	var ownerOutput []socketMessage
+	ownerID, _ := session.clients.attach(endingWebSocket("vm", &ownerOutput))
+
+	if found, ok := activeSessions.find(&Instance{Name: "vm", ProjectName: "test-project", Protocol: rdpProtocol, RemotePort: rdpPort}, "user@google.com"); !ok || found != session {
+		t.Errorf("find didn't return the session for the same instance and owner")
+	}
+	if _, ok := activeSessions.find(instanceToUse, "other@google.com"); ok {
+		t.Errorf("find returned a session started by another user")
+	}
+	if _, ok := activeSessions.find(&Instance{Name: "vm", ProjectName: "test-project", Protocol: rdpProtocol, RemotePort: rdpPort, LocalPort: 1234}, "user@google.com"); ok {
+		t.Errorf("find returned a session on a different local port than requested")
+	}
+
+	supervisor := newTunnelSupervisor(session.clients, instanceToUse, 9999, session.settings, nil, func() {}, nil)
+	session.setSupervisor(supervisor)
+	supervisor.setLost(true)
+	if _, ok := activeSessions.find(instanceToUse, "user@google.com"); ok {
+		t.Errorf("find returned a session whose tunnel is being restarted")
+	}
+	supervisor.setLost(false)
+
+	var attachedOutput []socketMessage
+	g := NewGcloudExecutor(&mockShell{})
+	if !g.attachSession(endingWebSocket("vm", &attachedOutput), session) {
+		t.Fatal("attachSession didn't attach to the session")
+	}
+	if len(attachedOutput) == 0 || attachedOutput[0].Event == nil || attachedOutput[0].Event.Type != sessionAttachedEvent || attachedOutput[0].Event.Port != 9999 {
+		t.Errorf("attachSession didn't return the existing port, got %v", attachedOutput)
+	}
+	select {
+	case <-session.detached:
+		t.Errorf("attachSession ended the session while another client was attached")
+	default:
+	}
+
+	session.clients.detach(ownerID)
+	attachedOutput = nil
+	g.attachSession(endingWebSocket("vm", &attachedOutput), session)
+	select {
+	case <-session.detached:
+	default:
+		t.Errorf("attachSession didn't end the session when the last client left")
+	}
+	select {
+	case <-session.closed:
+		t.Errorf("attachSession ended the session as if it was closed through the sessions API")
+	default:
+	}
+
+	session.clients.Close()
+	if g.attachSession(endingWebSocket("vm", &attachedOutput), session) {
+		t.Errorf("attachSession attached to a session that was torn down")
+	}
+}
+
+// firewallShell is a mock shell that records the firewall rules created and deleted, no rules exist beforehand
+type firewallShell struct {
+	mockShell
+	mu      sync.Mutex
+	created int
+	deleted int
+}
+
+func (s *firewallShell) ExecuteCmd(cmd string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(cmd, "gcloud compute firewall-rules create"):
+		s.created++
+	case strings.HasPrefix(cmd, "gcloud compute firewall-rules delete"):
+		s.deleted++
+	case strings.HasPrefix(cmd, "gcloud compute firewall-rules list"):
+		return []byte("[]"), nil
+	}
+	return nil, nil
+}
+
+func (s *firewallShell) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.created, s.deleted
+}
+
+func TestAttachSessionAfterFirewallTimeout(t *testing.T) {
+	instanceToUse := &Instance{Name: "attach-vm", ProjectName: "test-project", Protocol: rdpProtocol, RemotePort: rdpPort,
+		NetworkInterfaces: []networkInterfaces{{Network: "default"}}}
+	session := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+	var ownerOutput []socketMessage
+	session.clients.attach(endingWebSocket("attach-vm", &ownerOutput))
+
+	// The lease of the client that started the tunnel ends with the firewall timer
+	shell := &firewallShell{}
+	starter := NewGcloudExecutor(shell)
+	starter.settings.firewallTimeout = 20 * time.Millisecond
+	if _, err := starter.leaseFirewall(quietConn{}, instanceToUse); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, deleted := shell.counts(); deleted == 0; _, deleted = shell.counts() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the firewall rule wasn't deleted when its lease expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	g := NewGcloudExecutor(shell)
+	var attachedOutput []socketMessage
+	if !g.attachSession(endingWebSocket("attach-vm", &attachedOutput), session) {
+		t.Fatal("attachSession didn't attach to the session")
+	}
+	if created, deleted := shell.counts(); created != 2 || deleted != 2 {
+		t.Errorf("attachSession didn't open the firewall for the client and close it when it left, got %v created and %v deleted", created, deleted)
+	}
+	if firewallLeases.leased(firewallLeaseKey(instanceToUse)) {
+		t.Errorf("attachSession kept its lease after the client left")
+	}
+}
+
+func TestSessionLeaseFirewall(t *testing.T) {
+	instanceToUse := &Instance{Name: "lease-vm", ProjectName: "test-project", Protocol: rdpProtocol, RemotePort: rdpPort,
+		NetworkInterfaces: []networkInterfaces{{Network: "default"}}}
+	session := activeSessions.add(instanceToUse, 9999, newRdpSettings(nil), lifetimeEnding(time.Hour))
+	defer activeSessions.remove(session.id)
+
+	if err := session.leaseFirewall(quietConn{}); err != nil {
+		t.Errorf("leaseFirewall failed without an executor, got %v", err)
+	}
+
+	shell := &firewallShell{}
+	session.executor = NewGcloudExecutor(shell)
+	if err := session.leaseFirewall(quietConn{}); err != nil {
+		t.Fatal(err)
+	}
+	if !firewallLeases.leased(firewallLeaseKey(instanceToUse)) || session.info().Firewall != firewallCreated {
+		t.Errorf("leaseFirewall didn't open the firewall for the session")
+	}
+	session.releaseFirewall(quietConn{})
+	if created, deleted := shell.counts(); created != 1 || deleted != 1 || firewallLeases.leased(firewallLeaseKey(instanceToUse)) {
+		t.Errorf("releaseFirewall didn't close the firewall with the session, got %v created and %v deleted", created, deleted)
+	}
+}
+
+func TestSessionClientsWriteJSON(t *testing.T) {
+	var first, second []socketMessage
+	clients := newSessionClients()
+	clients.attach(endingWebSocket("vm", &first))
+	id, _ := clients.attach(endingWebSocket("vm", &second))
+
+	writeToSocket(clients, "to all", nil)
+	clients.detach(id)
+	writeToSocket(clients, "to first", nil)
+
+	if len(first) != 2 || len(second) != 1 || second[0].Message != "to all" {
+		t.Errorf("WriteJSON didn't write to the attached websockets, got %v and %v", first, second)
+	}
+}
@@ -0,0 +1,154 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"log"
+	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
+)
+
+const (
+	defaultReadyTimeout time.Duration = 30 * time.Second
+	defaultLauncher     string        = "xfreerdp"
+)
+
+// rdpSettings are the session settings read from the config with defaults filled in
+type rdpSettings struct {
+	tunnel       string
+	relayURL     string
+	readyTimeout time.Duration
+	probeRDP     bool
+	launcher     string
+	launchers    map[string]admin.LauncherConfig
+	rdpFileCert  string
+	rdpFileKey   string
+	// session lifetime
+	sessionTimeout    time.Duration
+	maxSessionTimeout time.Duration
+	extendBy          time.Duration
+	sessionWarnings   []time.Duration
+	firewallTimeout   time.Duration
+	// tunnel proxy
+	idleTimeout   time.Duration
+	statsInterval time.Duration
+	// resumable sockets
+	resumeGrace time.Duration
+	// tunnel supervisor
+	healthInterval    time.Duration
+	restartAttempts   int
+	restartMaxBackoff time.Duration
+	// local port range, 0 picks any free port
+	portRangeMin int
+	portRangeMax int
+	// stopped instances
+	startStopped         bool
+	instanceStartTimeout time.Duration
+	// IAM preflight
+	checkPermissions bool
+	// just in time IAP access
+	jitGrant bool
+}
+
+// newRdpSettings reads the rdp section of the config, a nil config uses the defaults
+func newRdpSettings(config *admin.Config) rdpSettings {
+	settings := rdpSettings{
+		readyTimeout:      defaultReadyTimeout,
+		launcher:          defaultLauncher,
+		sessionTimeout:    rdpContextTimeout,
+		maxSessionTimeout: defaultMaxSessionTime,
+		extendBy:          defaultSessionExtendBy,
+		sessionWarnings:   defaultSessionWarnings,
+		firewallTimeout:   firewallContextTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		statsInterval:     defaultStatsInterval,
+		resumeGrace:       defaultResumeGrace,
+		healthInterval:    defaultHealthInterval,
+		restartAttempts:   defaultRestartAttempts,
+		restartMaxBackoff: defaultRestartMaxBackoff,
+
+		instanceStartTimeout: defaultInstanceStartTimeout,
+		checkPermissions:     true,
+	}
+	if config == nil {
+		return settings
+	}
+
+	settings.tunnel = config.RDP.Tunnel
+	settings.relayURL = config.RDP.RelayURL
+	settings.probeRDP = config.RDP.ProbeRDP
+	settings.launchers = config.RDP.Launchers
+	settings.rdpFileCert = config.RDP.RdpFileCert
+	settings.rdpFileKey = config.RDP.RdpFileKey
+	settings.portRangeMin, settings.portRangeMax = portRange(config.RDP.LocalPorts)
+	settings.startStopped = config.RDP.StartStoppedInstances
+	settings.checkPermissions = !config.RDP.SkipPermissionCheck
+	settings.jitGrant = config.RDP.JitIapGrant
+	if config.RDP.InstanceStartTimeout > 0 {
+		settings.instanceStartTimeout = config.RDP.InstanceStartTimeout
+	}
+	if config.RDP.Launcher != "" {
+		settings.launcher = config.RDP.Launcher
+	}
+	if config.RDP.SessionTimeout > 0 {
+		settings.sessionTimeout = config.RDP.SessionTimeout
+	}
+	if config.RDP.MaxSessionTimeout > 0 {
+		settings.maxSessionTimeout = config.RDP.MaxSessionTimeout
+	}
+	if settings.maxSessionTimeout < settings.sessionTimeout {
+		log.Printf(maxLifetimeRaised, settings.maxSessionTimeout, settings.sessionTimeout)
+		settings.maxSessionTimeout = settings.sessionTimeout
+	}
+	if config.RDP.ExtendBy > 0 {
+		settings.extendBy = config.RDP.ExtendBy
+	}
+	if config.RDP.SessionWarnings != nil {
+		settings.sessionWarnings = config.RDP.SessionWarnings
+	}
+	if config.RDP.FirewallTimeout > 0 {
+		settings.firewallTimeout = config.RDP.FirewallTimeout
+	}
+	if config.RDP.IdleTimeout != 0 {
+		settings.idleTimeout = config.RDP.IdleTimeout
+	}
+	if config.RDP.StatsInterval > 0 {
+		settings.statsInterval = config.RDP.StatsInterval
+	}
+	if config.RDP.ResumeGrace != 0 {
+		settings.resumeGrace = config.RDP.ResumeGrace
+	}
+	if config.RDP.HealthInterval != 0 {
+		settings.healthInterval = config.RDP.HealthInterval
+	}
+	if config.RDP.RestartAttempts != 0 {
+		settings.restartAttempts = config.RDP.RestartAttempts
+	}
+	if config.RDP.RestartMaxBackoff > 0 {
+		settings.restartMaxBackoff = config.RDP.RestartMaxBackoff
+	}
+	if config.RDP.ReadyTimeout > 0 {
+		settings.readyTimeout = config.RDP.ReadyTimeout
+	}
+	return settings
+}
+
+// SetConfig applies the rdp settings of the config outside of a session, such as when checking permissions
+func (gcloudExecutor *GcloudExecutor) SetConfig(config *admin.Config) {
+	gcloudExecutor.settings = newRdpSettings(config)
+}
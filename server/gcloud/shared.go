@@ -0,0 +1,162 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// shared session consts
+const (
+	sessionAttachedEvent  string = "session_attached"
+	sessionAttachedOutput string = "Attached to session %v for %v on port %v, %v clients connected"
+	clientDetachedOutput  string = "Disconnected from %v, the tunnel stays open for %v other clients"
+	clientsClosed         string = "Session clients are closed"
+	attachFirewallError   string = "Could not open the firewall for new connections to %v: %v"
+)
+
+// sessionClients is every websocket attached to a session. It implements conn so messages about the whole
+// session, such as stats and expiry warnings, reach all of them.
+type sessionClients struct {
+	mu     sync.Mutex
+	next   int
+	conns  map[int]conn
+	closed bool
+}
+
+func newSessionClients() *sessionClients {
+	return &sessionClients{conns: make(map[int]conn)}
+}
+
+// attach adds the websocket and returns its id, it fails once the session has been torn down
+func (c *sessionClients) attach(ws conn) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, false
+	}
+	c.next++
+	c.conns[c.next] = ws
+	return c.next, true
+}
+
+// detach removes the websocket and returns how many are still attached
+func (c *sessionClients) detach(id int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, id)
+	return len(c.conns)
+}
+
+// count returns how many websockets are attached
+func (c *sessionClients) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// ReadMessage isn't supported, each attached websocket is read by its own runner
+func (c *sessionClients) ReadMessage() (int, []byte, error) {
+	return 0, nil, errors.New(clientsClosed)
+}
+
+// WriteJSON writes to every attached websocket and returns the first error
+func (c *sessionClients) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for _, ws := range c.conns {
+		if err := ws.WriteJSON(v); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SetPhase sets the phase on every attached websocket
+func (c *sessionClients) SetPhase(phase string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ws := range c.conns {
+		protocol.SetPhase(ws, phase)
+	}
+}
+
+// Close closes every attached websocket and stops new ones attaching
+func (c *sessionClients) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, ws := range c.conns {
+		ws.Close()
+		delete(c.conns, id)
+	}
+	return nil
+}
+
+// attachSession serves the websocket from a tunnel another websocket already started. The tunnel is closed
+// when the last attached websocket leaves. The client takes its own lease on the firewall rule since the lease
+// of the client that started the tunnel may already be released.
+func (gcloudExecutor *GcloudExecutor) attachSession(ws conn, session *tunnelSession) bool {
+	resumable := newResumableConn(ws, gcloudExecutor.owner, session.instance, session.settings.resumeGrace)
+	ws = resumable
+	protocol.SetPhase(ws, phaseConnected)
+	id, ok := session.clients.attach(ws)
+	if !ok {
+		resumableConns.remove(resumable.token)
+		return false
+	}
+
+	instance := session.instance
+	gcloudExecutor.session = session
+	gcloudExecutor.settings = session.settings
+	log.Printf("Attaching to session %v for %v", session.id, instance.Name)
+
+	clients := session.clients.count()
+	writeEventToSocket(ws, fmt.Sprintf(sessionAttachedOutput, session.id, instance.Name, session.port, clients), nil,
+		&tunnelEvent{Type: sessionAttachedEvent, Port: session.port, Detail: session.id, ResumeToken: resumable.token})
+
+	// Connections the tunnel already carries don't need the rule, so the client stays attached without it
+	lease, err := gcloudExecutor.leaseFirewall(ws, instance)
+	if err != nil {
+		writeToSocket(ws, "", fmt.Errorf(attachFirewallError, instance.Name, err))
+	} else if lease != nil {
+		session.setFirewall(firewallCreated)
+	}
+	writeReadyForCommand(ws)
+
+	endChan := make(chan bool)
+	go gcloudExecutor.listenForCmd(ws, instance, session.port, endChan)
+	<-endChan
+
+	remaining := session.clients.detach(id)
+	if lease != nil {
+		gcloudExecutor.releaseFirewall(ws, instance, lease)
+	}
+	if remaining == 0 {
+		session.detach()
+	} else {
+		writeToSocket(ws, fmt.Sprintf(clientDetachedOutput, instance.Name, remaining), nil)
+	}
+	ws.Close()
+	return true
+}
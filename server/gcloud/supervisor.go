@@ -0,0 +1,201 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	pshell "github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
+)
+
+// tunnel supervisor consts
+const (
+	tunnelLostEvent          string        = "tunnel_lost"
+	tunnelRestoredEvent      string        = "tunnel_restored"
+	tunnelLostOutput         string        = "IAP tunnel for %v was lost, restarting it"
+	tunnelRestoredOutput     string        = "IAP tunnel for %v was restored after %v attempts"
+	tunnelRestoreFailed      string        = "Could not restore the IAP tunnel for %v after %v attempts"
+	tunnelProbeFailures      int           = 2
+	restartInitialBackoff    time.Duration = time.Second
+	defaultHealthInterval    time.Duration = 30 * time.Second
+	defaultRestartAttempts   int           = 5
+	defaultRestartMaxBackoff time.Duration = time.Minute
+)
+
+// tunnelSupervisor watches a ready tunnel and restarts it on the same port when it is lost. The client facing
+// port is served by the proxy so it never changes. A tunnel is lost when it exits, which the native tunnel
+// does once the relay keeps refusing connections, or, for RDP sessions with probe_rdp set, when X.224
+// requests sent through IAP fail. Other tunnels aren't probed since connecting to the tunnel's local listener
+// succeeds without reaching IAP.
+type tunnelSupervisor struct {
+	ws       conn
+	instance *Instance
+	port     int
+	settings rdpSettings
+	tunneler iapTunneler
+
+	// cancel stops the current tunnel, exited is closed if it exits
+	cancel context.CancelFunc
+	exited <-chan struct{}
+	// failed is closed once the tunnel couldn't be restored
+	failed chan struct{}
+	// leaseFirewall opens the firewall again before the tunnel is restarted, the lease is released with the session
+	leaseFirewall func(ws conn) error
+
+	// lost is set from the tunnel being lost until it is restored
+	mu   sync.Mutex
+	lost bool
+}
+
+func newTunnelSupervisor(ws conn, instance *Instance, port int, settings rdpSettings, tunneler iapTunneler, cancel context.CancelFunc, exited <-chan struct{}) *tunnelSupervisor {
+	return &tunnelSupervisor{
+		ws:       ws,
+		instance: instance,
+		port:     port,
+		settings: settings,
+		tunneler: tunneler,
+		cancel:   cancel,
+		exited:   exited,
+		failed:   make(chan struct{}),
+	}
+}
+
+// healthy returns false while the tunnel is lost or being restarted
+func (s *tunnelSupervisor) healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.lost
+}
+
+func (s *tunnelSupervisor) setLost(lost bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lost = lost
+}
+
+// run supervises the tunnel until ctx is done or the tunnel can't be restored
+func (s *tunnelSupervisor) run(ctx context.Context) {
+	var probes <-chan time.Time
+	if s.settings.healthInterval > 0 && s.instance.Protocol == rdpProtocol && s.settings.probeRDP {
+		ticker := time.NewTicker(s.settings.healthInterval)
+		defer ticker.Stop()
+		probes = ticker.C
+	}
+
+	failures := 0
+	for {
+		var reason error
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.exited:
+			reason = errors.New(tunnelExited)
+		case <-probes:
+			if err := probeTunnelPort(s.port, true); err != nil {
+				failures++
+				if failures < tunnelProbeFailures {
+					continue
+				}
+				reason = err
+			} else {
+				failures = 0
+				continue
+			}
+		}
+
+		log.Printf("IAP tunnel for %v was lost: %v", s.instance.Name, reason)
+		s.setLost(true)
+		writeEventToSocket(s.ws, fmt.Sprintf(tunnelLostOutput, s.instance.Name), nil,
+			&tunnelEvent{Type: tunnelLostEvent, Port: s.instance.proxyPort, Detail: reason.Error()})
+		s.cancel()
+		failures = 0
+
+		if !s.restore(ctx) {
+			close(s.failed)
+			return
+		}
+	}
+}
+
+// restore restarts the tunnel on its port, backing off exponentially between attempts. The firewall lease
+// taken at the start may have been released by now, so the rule is leased again for the restored tunnel.
+func (s *tunnelSupervisor) restore(ctx context.Context) bool {
+	if s.leaseFirewall != nil {
+		if err := s.leaseFirewall(quietConn{}); err != nil {
+			log.Printf("Could not open the firewall to restart the tunnel for %v: %v", s.instance.Name, err)
+		}
+	}
+
+	backoff := restartInitialBackoff
+	for attempt := 1; attempt <= s.settings.restartAttempts; attempt++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > s.settings.restartMaxBackoff {
+			backoff = s.settings.restartMaxBackoff
+		}
+
+		listener, err := pshell.ListenOnPort(s.port)
+		if err != nil {
+			log.Printf("Could not listen on %v to restart the tunnel for %v: %v", s.port, s.instance.Name, err)
+			continue
+		}
+
+		// Each attempt is reported once it is known whether the tunnel was restored, not by the tunneler
+		tunnelCtx, tunnelCancel := context.WithCancel(ctx)
+		outputChan := make(chan iapResult)
+		go s.tunneler.startIapTunnel(tunnelCtx, quietConn{}, s.instance, listener, outputChan)
+		output := <-outputChan
+		if !output.tunnelCreated || output.err != nil {
+			log.Printf("Attempt %v to restart the tunnel for %v failed: %v", attempt, s.instance.Name, strings.Join(output.cmdOutput, "\n"))
+			tunnelCancel()
+			continue
+		}
+
+		s.cancel, s.exited = tunnelCancel, output.exited
+		s.setLost(false)
+		writeEventToSocket(s.ws, fmt.Sprintf(tunnelRestoredOutput, s.instance.Name, attempt), nil,
+			&tunnelEvent{Type: tunnelRestoredEvent, Port: s.instance.proxyPort})
+		return true
+	}
+	return false
+}
+
+// quietConn drops what is written to it, it stands in for the clients while the tunnel is restarted
+type quietConn struct{}
+
+func (quietConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, errors.New(clientsClosed)
+}
+
+func (quietConn) WriteJSON(v interface{}) error {
+	return nil
+}
+
+func (quietConn) Close() error {
+	return nil
+}
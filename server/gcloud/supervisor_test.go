@@ -0,0 +1,146 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	pshell "github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
+)
+
+// fakeTunneler accepts connections on the listener it is given until its context is done
+type fakeTunneler struct {
+	fail   bool
+	starts chan int
+}
+
+func (f *fakeTunneler) startIapTunnel(ctx context.Context, ws conn, instance *Instance, portListener *net.TCPListener, outputChan chan<- iapResult) {
+	f.starts <- portListener.Addr().(*net.TCPAddr).Port
+	if f.fail {
+		portListener.Close()
+		outputChan <- iapResult{err: errors.New("failed")}
+		return
+	}
+	writeEventToSocket(ws, "", nil, &tunnelEvent{Type: tunnelReadyEvent})
+	outputChan <- iapResult{tunnelCreated: true}
+	<-ctx.Done()
+	portListener.Close()
+}
+
+func TestTunnelSupervisorRestart(t *testing.T) {
+	ws, written := recordingWebSocket(nil)
+	listener, err := pshell.FindOpenPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	settings := newRdpSettings(nil)
+	settings.healthInterval = -1
+	tunneler := &fakeTunneler{starts: make(chan int, 1)}
+	exited := make(chan struct{})
+	cancelled := false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	supervisor := newTunnelSupervisor(ws, &Instance{Name: "vm", proxyPort: 9999}, port, settings, tunneler, func() { cancelled = true }, exited)
+	leased := make(chan struct{}, 1)
+	supervisor.leaseFirewall = func(ws conn) error {
+		leased <- struct{}{}
+		return nil
+	}
+	go supervisor.run(ctx)
+
+	close(exited)
+	select {
+	case restartedOn := <-tunneler.starts:
+		if restartedOn != port {
+			t.Errorf("supervisor restarted the tunnel on port %v, expected %v", restartedOn, port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor didn't restart the tunnel after its process exited")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(written()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	output := written()
+	if len(output) != 2 || output[0].Event.Type != tunnelLostEvent || output[1].Event.Type != tunnelRestoredEvent || output[1].Event.Port != 9999 {
+		t.Errorf("supervisor didn't report only the lost and restored tunnel, got %v", output)
+	}
+	if !cancelled {
+		t.Errorf("supervisor didn't stop the lost tunnel")
+	}
+	if len(leased) != 1 {
+		t.Errorf("supervisor didn't open the firewall again to restore the tunnel")
+	}
+}
+
+func TestTunnelSupervisorFailed(t *testing.T) {
+	ws, _ := recordingWebSocket(nil)
+	listener, err := pshell.FindOpenPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	settings := newRdpSettings(nil)
+	settings.healthInterval = 10 * time.Millisecond
+	settings.probeRDP = true
+	settings.restartAttempts = 1
+	tunneler := &fakeTunneler{fail: true, starts: make(chan int, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Nothing listens on the port so the probes fail
+	supervisor := newTunnelSupervisor(ws, &Instance{Name: "vm", Protocol: rdpProtocol}, port, settings, tunneler, func() {}, nil)
+	go supervisor.run(ctx)
+
+	select {
+	case <-supervisor.failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor didn't give up after the restart attempts failed")
+	}
+	if len(tunneler.starts) != 1 {
+		t.Errorf("supervisor didn't try to restart the tunnel")
+	}
+}
+
+func TestTunnelSupervisorNoProbe(t *testing.T) {
+	ws, _ := recordingWebSocket(nil)
+	settings := newRdpSettings(nil)
+	settings.healthInterval = 10 * time.Millisecond
+	tunneler := &fakeTunneler{starts: make(chan int, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Probes would fail since nothing listens on the port, without probe_rdp they aren't sent
+	supervisor := newTunnelSupervisor(ws, &Instance{Name: "vm", Protocol: rdpProtocol}, 1, settings, tunneler, func() {}, nil)
+	go supervisor.run(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	if len(tunneler.starts) != 0 || !supervisor.healthy() {
+		t.Errorf("supervisor probed the tunnel's local port without probe_rdp")
+	}
+}
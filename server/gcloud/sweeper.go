@@ -0,0 +1,327 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweeper consts
+const (
+	sweepRetryBase       time.Duration = 30 * time.Second
+	sweepRetryMax        time.Duration = 1 * time.Hour
+	firewallDeletionKind string        = "firewall"
+	iapGrantDeletionKind string        = "iap_grant"
+)
+
+// firewallExpiryPattern reads the expiry embedded in the description of the firewall rules the server creates
+var firewallExpiryPattern = regexp.MustCompile(`admin-extension-private-rdp-expires=(\S+)`)
+
+// timeNow is used for timestamps that end up in gcloud commands so tests can fix them
+var timeNow = time.Now
+
+// sweeper is started by StartSweeper and cleans up resources left behind by sessions, it is nil if not running
+var sweeper *Sweeper
+
+// pendingDeletion is a resource that the server failed to delete and keeps retrying, or a grant that is
+// deleted once its session's deadline passes
+type pendingDeletion struct {
+	Kind     string    `json:"kind"`
+	Project  string    `json:"project"`
+	Name     string    `json:"name"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+	// Resource and Member identify the binding of an IAP grant
+	Resource string `json:"resource,omitempty"`
+	Member   string `json:"member,omitempty"`
+}
+
+// sweeperState is persisted to disk so pending deletions survive restarts
+type sweeperState struct {
+	Projects []string          `json:"projects"`
+	Pending  []pendingDeletion `json:"pending"`
+}
+
+// Sweeper deletes expired IAP firewall rules in projects the server has touched, removes IAP grants left by
+// sessions that didn't end cleanly and retries failed deletions.
+type Sweeper struct {
+	mu        sync.Mutex
+	executor  *GcloudExecutor
+	statePath string
+	state     sweeperState
+}
+
+// firewallDescription returns the description of a new firewall rule with its expiry embedded
+func firewallDescription(expires time.Time) string {
+	return fmt.Sprintf(firewallExpiryDescription, expires.UTC().Format(time.RFC3339))
+}
+
+// firewallExpiry reads the expiry embedded in a firewall rule description
+func firewallExpiry(description string) (time.Time, bool) {
+	match := firewallExpiryPattern.FindStringSubmatch(description)
+	if len(match) < 2 {
+		return time.Time{}, false
+	}
+	expires, err := time.Parse(time.RFC3339, match[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expires, true
+}
+
+// NewSweeper creates a sweeper that runs gcloud commands with the shell and loads its state from statePath
+func NewSweeper(shell shell, statePath string) (*Sweeper, error) {
+	s := &Sweeper{executor: NewGcloudExecutor(shell), statePath: statePath}
+
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// StartSweeper sweeps once and then every interval in the background, it is used by sessions to queue deletions
+func StartSweeper(shell shell, statePath string, interval time.Duration) error {
+	s, err := NewSweeper(shell, statePath)
+	if err != nil {
+		return err
+	}
+	sweeper = s
+
+	go func() {
+		s.Sweep()
+		for range time.Tick(interval) {
+			s.Sweep()
+		}
+	}()
+	return nil
+}
+
+// save writes the state to disk, the mutex must be held
+func (s *Sweeper) save() {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := ioutil.WriteFile(s.statePath, data, 0600); err != nil {
+		log.Println(err)
+	}
+}
+
+// trackProject adds the project to the ones that are swept
+func (s *Sweeper) trackProject(project string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tracked := range s.state.Projects {
+		if tracked == project {
+			return
+		}
+	}
+	s.state.Projects = append(s.state.Projects, project)
+	s.save()
+}
+
+// enqueue adds a resource to the pending deletion queue, it returns false if the sweeper isn't running
+func (s *Sweeper) enqueue(kind, project, name string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pending := range s.state.Pending {
+		if pending.Kind == kind && pending.Project == project && pending.Name == name {
+			return true
+		}
+	}
+	s.state.Pending = append(s.state.Pending, pendingDeletion{Kind: kind, Project: project, Name: name, NextTry: timeNow()})
+	s.save()
+	return true
+}
+
+// schedule records a deletion that is due at its next try, replacing the record of the same resource
+func (s *Sweeper) schedule(deletion pendingDeletion) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, pending := range s.state.Pending {
+		if pending.Kind == deletion.Kind && pending.Project == deletion.Project && pending.Name == deletion.Name {
+			s.state.Pending[i] = deletion
+			s.save()
+			return
+		}
+	}
+	s.state.Pending = append(s.state.Pending, deletion)
+	s.save()
+}
+
+// forget drops a pending deletion once the resource was deleted elsewhere
+func (s *Sweeper) forget(kind, project, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var remaining []pendingDeletion
+	for _, pending := range s.state.Pending {
+		if pending.Kind != kind || pending.Project != project || pending.Name != name {
+			remaining = append(remaining, pending)
+		}
+	}
+	s.state.Pending = remaining
+	s.save()
+}
+
+// Sweep queues expired firewall rules of tracked projects and then retries every pending deletion that is due
+func (s *Sweeper) Sweep() {
+	s.mu.Lock()
+	projects := append([]string(nil), s.state.Projects...)
+	s.mu.Unlock()
+
+	for _, project := range projects {
+		rules, err := s.executor.listFirewallRules(project)
+		if err != nil {
+			log.Printf("sweeper couldn't list firewall rules for %v: %v", project, err)
+			continue
+		}
+		for _, rule := range rules {
+			if !strings.HasPrefix(rule.Name, firewallRulePrefix) {
+				continue
+			}
+			if expires, ok := firewallExpiry(rule.Description); ok && timeNow().After(expires) {
+				s.enqueue(firewallDeletionKind, project, rule.Name)
+			}
+		}
+	}
+
+	s.retryPending()
+}
+
+// retryPending deletes the pending resources that are due, backing off exponentially on failure. The
+// deletions run without the mutex so sessions aren't held up by a sweep.
+func (s *Sweeper) retryPending() {
+	s.mu.Lock()
+	var due []pendingDeletion
+	for _, pending := range s.state.Pending {
+		if !timeNow().Before(pending.NextTry) {
+			due = append(due, pending)
+		}
+	}
+	s.mu.Unlock()
+
+	// tried maps each record that was due to what replaces it, nil once the resource is deleted
+	tried := make(map[pendingDeletion]*pendingDeletion)
+	for _, pending := range due {
+		if s.deletePending(pending) {
+			tried[pending] = nil
+			continue
+		}
+		retry := pending
+		retry.Attempts++
+		retry.NextTry = timeNow().Add(sweepBackoff(retry.Attempts))
+		tried[pending] = &retry
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Records that changed or were added while deleting are kept as they are now
+	var remaining []pendingDeletion
+	for _, pending := range s.state.Pending {
+		retry, ok := tried[pending]
+		if !ok {
+			remaining = append(remaining, pending)
+		} else if retry != nil {
+			remaining = append(remaining, *retry)
+		}
+	}
+	s.state.Pending = remaining
+	s.save()
+}
+
+// deletePending deletes one resource, returning true if it is gone or no longer needs deleting
+func (s *Sweeper) deletePending(pending pendingDeletion) bool {
+	switch pending.Kind {
+	case firewallDeletionKind:
+		// A new session may have created the rule again since it was queued, it is deleted under the lease lock
+		// so no session starts using it in the meantime
+		var output []byte
+		key := fmt.Sprintf("%s/%s", pending.Project, strings.TrimPrefix(pending.Name, firewallRulePrefix))
+		unleased, err := firewallLeases.ifUnleased(key, func() error {
+			var err error
+			output, err = s.executor.shell.ExecuteCmd(fmt.Sprintf(firewallDeleteByNameCmd, pending.Name, pending.Project))
+			if err != nil && !strings.Contains(string(output), firewallNotFoundOutput) {
+				return err
+			}
+			return nil
+		})
+		if !unleased {
+			return true
+		}
+		if err != nil {
+			log.Printf("sweeper couldn't delete firewall rule %v: %v", pending.Name, string(output))
+			return false
+		}
+		log.Printf("sweeper deleted firewall rule %v in %v", pending.Name, pending.Project)
+		return true
+	case iapGrantDeletionKind:
+		if err := removeIapGrant(s.executor.shell, pending.Resource, pending.Member, pending.Name); err != nil {
+			log.Printf("sweeper couldn't remove IAP grant %v on %v: %v", pending.Name, pending.Resource, err)
+			return false
+		}
+		log.Printf("sweeper removed IAP grant %v on %v", pending.Name, pending.Resource)
+		return true
+	default:
+		log.Printf("sweeper dropping pending deletion of unknown kind %v", pending.Kind)
+		return true
+	}
+}
+
+// sweepBackoff returns the delay before retrying a deletion that failed attempts times
+func sweepBackoff(attempts int) time.Duration {
+	backoff := sweepRetryBase
+	for i := 1; i < attempts && backoff < sweepRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > sweepRetryMax {
+		backoff = sweepRetryMax
+	}
+	return backoff
+}
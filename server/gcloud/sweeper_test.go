@@ -0,0 +1,231 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sweepFirewallListOutput = []byte(`[
+  {"name": "admin-extension-private-rdp-expired", "description": "admin-extension-private-rdp-expires=2020-06-19T00:00:00Z"},
+  {"name": "admin-extension-private-rdp-active", "description": "admin-extension-private-rdp-expires=2020-06-21T00:00:00Z"},
+  {"name": "admin-extension-private-rdp-legacy", "description": ""},
+  {"name": "allow-iap", "description": "admin-extension-private-rdp-expires=2020-06-19T00:00:00Z"}
+]`)
+
+func TestFirewallExpiry(t *testing.T) {
+	expires := time.Date(2020, time.June, 20, 1, 2, 3, 0, time.UTC)
+	if got, ok := firewallExpiry(firewallDescription(expires)); !ok || !got.Equal(expires) {
+		t.Errorf("firewallExpiry didn't read expiry from description, got %v, expected %v", got, expires)
+	}
+
+	if _, ok := firewallExpiry("a rule created by hand"); ok {
+		t.Errorf("firewallExpiry read expiry from description without one")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sweeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	s, err := NewSweeper(&mockShell{}, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.trackProject("sweep")
+	s.enqueue(firewallDeletionKind, "sweep", "admin-extension-private-rdp-failing")
+	s.Sweep()
+
+	if len(s.state.Pending) != 1 || s.state.Pending[0].Name != "admin-extension-private-rdp-failing" {
+		t.Fatalf("Sweep didn't delete only the expired rules, got pending %v", s.state.Pending)
+	}
+	if pending := s.state.Pending[0]; pending.Attempts != 1 || !pending.NextTry.Equal(testTime.Add(sweepRetryBase)) {
+		t.Errorf("Sweep didn't back off failed deletion, got attempts %v, next try %v", pending.Attempts, pending.NextTry)
+	}
+
+	restored, err := NewSweeper(&mockShell{}, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.state.Pending) != 1 || len(restored.state.Projects) != 1 {
+		t.Errorf("NewSweeper didn't restore state from disk, got %v", restored.state)
+	}
+
+	restored.Sweep()
+	if pending := restored.state.Pending[0]; pending.Attempts != 1 {
+		t.Errorf("Sweep retried deletion before its backoff passed, got attempts %v", pending.Attempts)
+	}
+}
+
+// sessionEndingShell queues a deletion while the sweeper deletes, as a session ending during a sweep would
+type sessionEndingShell struct {
+	mockShell
+	s *Sweeper
+}
+
+func (sh *sessionEndingShell) ExecuteCmd(cmd string) ([]byte, error) {
+	sh.s.enqueue(firewallDeletionKind, "sweep", "admin-extension-private-rdp-queued")
+	return sh.mockShell.ExecuteCmd(cmd)
+}
+
+func TestSweepDoesNotBlockSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sweeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shell := &sessionEndingShell{}
+	s, err := NewSweeper(shell, filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shell.s = s
+	s.enqueue(firewallDeletionKind, "sweep", "admin-extension-private-rdp-failing")
+
+	swept := make(chan struct{})
+	go func() {
+		s.Sweep()
+		close(swept)
+	}()
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sweep held the sweeper while deleting")
+	}
+
+	if len(s.state.Pending) != 2 || s.state.Pending[0].Attempts != 1 || s.state.Pending[1].Name != "admin-extension-private-rdp-queued" {
+		t.Errorf("Sweep didn't keep the deletion queued while it ran, got %v", s.state.Pending)
+	}
+}
+
+// blockingDeleteShell holds the firewall deletion until release is closed
+type blockingDeleteShell struct {
+	mockShell
+	deleting chan struct{}
+	release  chan struct{}
+}
+
+func (sh *blockingDeleteShell) ExecuteCmd(cmd string) ([]byte, error) {
+	if strings.HasPrefix(cmd, "gcloud compute firewall-rules delete") {
+		close(sh.deleting)
+		<-sh.release
+	}
+	return nil, nil
+}
+
+func TestSweepDeleteHoldsLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sweeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shell := &blockingDeleteShell{deleting: make(chan struct{}), release: make(chan struct{})}
+	s, err := NewSweeper(shell, filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.enqueue(firewallDeletionKind, "sweep", "admin-extension-private-rdp-blocked")
+	swept := make(chan struct{})
+	go func() {
+		s.Sweep()
+		close(swept)
+	}()
+	<-shell.deleting
+
+	// A session taking the lease during the deletion waits for it and then creates the rule again
+	acquired := make(chan bool)
+	go func() {
+		created := false
+		lease, _, err := firewallLeases.acquire("sweep/blocked", time.Hour, func() error {
+			created = true
+			return nil
+		}, nil)
+		if err == nil {
+			firewallLeases.release(lease, func() {})
+		}
+		acquired <- created
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire took a lease on the rule while the sweeper was deleting it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(shell.release)
+	if created := <-acquired; !created {
+		t.Errorf("acquire didn't create the rule the sweeper deleted")
+	}
+	<-swept
+}
+
+func TestSweepGrants(t *testing.T) {
+	grant := iamBinding{Role: iapTunnelRole, Members: []string{"user:user@example.com"}, Condition: grantCondition("admin-extension-jit-left", rdpPort, testTime)}
+	server := newPolicyServer(grant)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sweeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSweeper(&mockShell{}, filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := &iapGrant{project: "test-project", resource: testTunnelResource, member: "user:user@example.com", title: "admin-extension-jit-left"}
+	s.schedule(left.pendingDeletion(testTime.Add(time.Hour)))
+	s.Sweep()
+	if len(server.bindings()) != 1 || len(s.state.Pending) != 1 {
+		t.Errorf("Sweep removed a grant before its session's deadline, got pending %v", s.state.Pending)
+	}
+
+	s.schedule(left.pendingDeletion(testTime))
+	if len(s.state.Pending) != 1 {
+		t.Fatalf("schedule didn't replace the grant's record, got %v", s.state.Pending)
+	}
+	s.Sweep()
+	if len(server.bindings()) != 0 || len(s.state.Pending) != 0 {
+		t.Errorf("Sweep didn't remove the grant left by a session, got bindings %v, pending %v", server.bindings(), s.state.Pending)
+	}
+
+	s.schedule(left.pendingDeletion(testTime.Add(time.Hour)))
+	s.forget(iapGrantDeletionKind, "test-project", left.title)
+	if len(s.state.Pending) != 0 {
+		t.Errorf("forget didn't drop the grant's record, got %v", s.state.Pending)
+	}
+}
+
+func TestSweepBackoff(t *testing.T) {
+	if backoff := sweepBackoff(3); backoff != 4*sweepRetryBase {
+		t.Errorf("sweepBackoff didn't back off exponentially, got %v, expected %v", backoff, 4*sweepRetryBase)
+	}
+	if backoff := sweepBackoff(100); backoff != sweepRetryMax {
+		t.Errorf("sweepBackoff didn't cap backoff, got %v, expected %v", backoff, sweepRetryMax)
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"context"
 	"io"
 	"time"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
 )
 
 // consts containing possible errors from running gcloud commands
@@ -35,7 +37,7 @@ const (
 
 // iap firewall consts
 const (
-	iapFirewallCreateCmd            string = "gcloud compute firewall-rules create admin-extension-private-rdp-%v --direction=INGRESS   --action=allow   --rules=tcp:3389   --source-ranges=35.235.240.0/20 --source-tags=%s --project=%s --network=%s"
+	iapFirewallCreateCmd            string = "gcloud compute firewall-rules create admin-extension-private-rdp-%v --direction=INGRESS   --action=allow   --rules=tcp:%v   --source-ranges=35.235.240.0/20 --source-tags=%s --project=%s --network=%s --description=%s"
 	firewallDeleteCmd               string = "gcloud compute firewall-rules delete admin-extension-private-rdp-%v -q --project=%s"
 	firewallRuleExistsCmdOutput     string = "resource 'projects/%s/global/firewalls/admin-extension-private-rdp-%v' already exists"
 	firewallRuleAlreadyExistsOutput string = "Firewall rule already exists for %v"
@@ -44,21 +46,53 @@ const (
 	multipleNetworksError           string = "%v has 0 or more than 1 network interface"
 	deleteFirewallAuthError         string = "Couldn't delete IAP firewall rule: admin-extension-private-rdp-%v due to auth error, please delete it manually"
 	deleteFirewallProjectError      string = "Couldn't delete IAP firewall rule: admin-extension-private-rdp-%v due to project error, please delete it manually"
+	sharedFirewallOutput            string = "Firewall rule for %v is shared with %v other session(s)"
+	firewallStillLeasedOutput       string = "Not deleting firewall for %v, still used by %v other session(s)"
+	firewallRulePrefix              string = "admin-extension-private-rdp-"
+	firewallExpiryDescription       string = "admin-extension-private-rdp-expires=%s"
+	firewallDeleteByNameCmd         string = "gcloud compute firewall-rules delete %v -q --project=%s"
+	firewallNotFoundOutput          string = "was not found"
+	queuedFirewallDeletion          string = "Queued IAP firewall rule admin-extension-private-rdp-%v for deletion, the server will keep retrying"
+	firewallListCmd                 string = "gcloud compute firewall-rules list --format=json --project=%s"
+	firewallListError               string = "Could not list firewall rules for %v, will try to create one"
+	existingFirewallRuleOutput      string = "Existing firewall rule %v allows IAP to %v on port %v, skipping firewall creation"
+	noExistingFirewallRuleOutput    string = "No existing firewall rule allows IAP to %v on port %v"
+	iapSourceRange                  string = "35.235.240.0/20"
+	rdpPort                         int    = 3389
+)
+
+// port forward session consts
+const (
+	rdpProtocol            string = "rdp"
+	defaultForwardProtocol string = "tcp"
+	invalidRemotePort      string = "Remote port %v is invalid, it needs to be between 1 and 65535"
+	localPortUnavailable   string = "Local port %v is not available"
+	forwardingPortOutput   string = "Forwarding %v port %v of %v to localhost:%v"
+	rdpOnlyCmd             string = "%v is only available for RDP sessions"
 )
 
 // iap tunnel and websocket consts
 const (
-	getComputeInstancesForProjectPrefix string = "gcloud compute instances list --format=json --project="
-	missingInstanceValues               string = "Missing value from instance data sent"
-	iapTunnelCmd                        string = "gcloud compute start-iap-tunnel %v 3389 --project=%v --local-host-port=localhost:%v --zone=%s --verbosity=debug"
-	tunnelCreatedOutput                 string = "DEBUG: CLOSE"
-	iapTunnelError                      string = "Could not start IAP tunnel for %v"
-	iapTunnelStarted                    string = "Started IAP tunnel for %v on port: %v. Will close in %v"
-	receivedEndCmd                      string = "Received end RDP command from connection"
-	receivedStartRdpCmd                 string = "Received command to start RDP program with credentials"
-	endingIapTunnel                     string = "Ending IAP tunnel for %v"
-	createIapFailed                     string = "Creating IAP tunnel failed"
+	getComputeInstancesForProjectPrefix string        = "gcloud compute instances list --format=json --project="
+	missingInstanceValues               string        = "Missing value from instance data sent"
+	iapTunnelCmd                        string        = "gcloud compute start-iap-tunnel %v %v --project=%v --local-host-port=127.0.0.1:%v --zone=%s --verbosity=debug"
+	iapTunnelListening                  string        = "Listening on port [%d]."
+	tunnelNotListening                  string        = "IAP tunnel hasn't reported listening on port %v"
+	tunnelHost                          string        = "127.0.0.1"
+	tunnelReadyEvent                    string        = "tunnel_ready"
+	tunnelFailedEvent                   string        = "tunnel_failed"
+	tunnelNotReady                      string        = "Tunnel port %v was not ready after %v: %v"
+	tunnelExited                        string        = "IAP tunnel command exited"
+	tunnelProbeInterval                 time.Duration = 250 * time.Millisecond
+	tunnelDialTimeout                   time.Duration = 2 * time.Second
+	iapTunnelError                      string        = "Could not start IAP tunnel for %v"
+	iapTunnelStarted                    string        = "Started IAP tunnel for %v on port: %v. Will close in %v"
+	receivedEndCmd                      string        = "Received end RDP command from connection"
+	receivedStartRdpCmd                 string        = "Received command to start RDP program with credentials"
+	endingIapTunnel                     string        = "Ending IAP tunnel for %v"
+	createIapFailed                     string        = "Creating IAP tunnel failed"
 	// IMPORTANT: IF CHANGED, NEEDS TO BE CHANGED IN EXTENSION AS WELL
+	// Clients on the versioned protocol get a ready message instead of matching it
 	readyForCommandOutput string = "Ready for command"
 	shutDownRdp           string = "Shutdown private RDP for %v"
 	deletingFirewall      string = "Deleting firewall for %v"
@@ -66,7 +100,6 @@ const (
 
 // automated rdp program consts
 const (
-	rdpProgramCmd   string = "xfreerdp /v:localhost /port:%v /u:%v /p:%v +sec-rdp /cert-ignore"
 	rdpProgramError string = "Unable to start RDP program for %v"
 	rdpProgramQuit  string = "Quit RDP program for %v"
 )
@@ -95,6 +128,14 @@ type networkInterfaces struct {
 	IP      string `json:"networkIP"`
 }
 
+type instanceTags struct {
+	Items []string `json:"items"`
+}
+
+type serviceAccount struct {
+	Email string `json:"email"`
+}
+
 // Instance is used as a structure for gcloud compute instances.
 type Instance struct {
 	ID                string              `json:"id"`
@@ -104,32 +145,81 @@ type Instance struct {
 	Zone              string              `json:"zone"`
 	Disk              []disk              `json:"disks"`
 	NetworkInterfaces []networkInterfaces `json:"networkInterfaces"`
+	Tags              instanceTags        `json:"tags"`
+	ServiceAccounts   []serviceAccount    `json:"serviceAccounts"`
 	ProjectName       string              `json:"project"`
+	RemotePort        int                 `json:"remotePort"`
+	LocalPort         int                 `json:"localPort"`
+	Protocol          string              `json:"protocol"`
 	FirewallNetwork   string              `json:"firewallNetwork"`
 	PreRDPParams      map[string]string   `json:"params"`
+	// ResumeToken reattaches the socket to a session whose previous socket was lost
+	ResumeToken string `json:"resume_token,omitempty"`
+	// DryRun sends the plan of the session over the socket without running or changing anything
+	DryRun   bool `json:"dry_run,omitempty"`
+	security *rdpSecurity
+	// proxyPort is the client facing port when the tunnel listens behind the proxy
+	proxyPort int
+	// bootWait is how long the first start of the tunnel waits for the guest of an instance that was just started
+	bootWait time.Duration
 }
 
 type shell interface {
 	ExecuteCmd(string) ([]byte, error)
 	ExecuteCmdWithContext(context.Context, string) ([]byte, error)
+	ExecuteCmdWithStdin([]string, []byte, func(int)) ([]byte, error)
 	ExecuteCmdReader(string) ([]io.ReadCloser, context.CancelFunc, error)
 }
 
 // GcloudExecutor is used to call gcloud functions with the shell passed in.
 type GcloudExecutor struct {
-	shell shell
+	shell    shell
+	settings rdpSettings
+	session  *tunnelSession
+	// owner is the account that started the session, shown in the sessions API
+	owner string
+	// grant is the IAP access granted for the session, it is removed when the session is cleaned up
+	grant *iapGrant
+	// config and started are used to run the post RDP operations once the session ends
+	config  *admin.Config
+	started time.Time
 }
 
 // socketMessage is the struct that is sent to the websockets
 type socketMessage struct {
-	Message string `json:"message"`
-	Err     string `json:"error"`
+	Message string       `json:"message"`
+	Err     string       `json:"error"`
+	Event   *tunnelEvent `json:"event,omitempty"`
+	// Credentials is only set on the reply to reset-password
+	Credentials *credentials `json:"credentials,omitempty"`
+	// err keeps the error's code for the versioned protocol
+	err error
+}
+
+// tunnelEvent is a structured event about the tunnel sent along with a socket message
+type tunnelEvent struct {
+	Type      string       `json:"type"`
+	Port      int          `json:"port"`
+	ElapsedMs int64        `json:"elapsed_ms"`
+	Detail    string       `json:"detail,omitempty"`
+	Security  *rdpSecurity `json:"security,omitempty"`
+	// RemainingMs is the time left in the session for lifetime events
+	RemainingMs int64       `json:"remaining_ms,omitempty"`
+	Stats       *proxyStats `json:"stats,omitempty"`
+	// ResumeToken is given when a session starts so the client can resume it after losing the socket
+	ResumeToken string `json:"resume_token,omitempty"`
+	// Operations are the results of the pre or post RDP operations
+	Operations []operationResult `json:"operations,omitempty"`
+	// Plan is a step the session would take, sent during a dry run
+	Plan *planStep `json:"plan,omitempty"`
 }
 
 // credentials struct is used for the automated rdp program
 type credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	security *rdpSecurity
+	display  *displayOptions
 }
 
 // iapResult struct is returned from starting the IAP tunnel
@@ -137,6 +227,8 @@ type iapResult struct {
 	tunnelCreated bool
 	cmdOutput     []string
 	err           error
+	// exited is closed if the tunnel exits, for tunnels that run in process it is when the relay is lost
+	exited <-chan struct{}
 }
 
 // conn interface is used to mock websocket connections
@@ -148,8 +240,16 @@ type conn interface {
 
 // socketCmd struct is used to read commands such as start-rdp and login from the websocket
 type socketCmd struct {
-	Cmd          string `json:"cmd"`
-	InstanceName string `json:"name"`
-	Username     string `json:"username"`
-	Password     string `json:"password"`
+	Cmd          string          `json:"cmd"`
+	InstanceName string          `json:"name"`
+	Username     string          `json:"username"`
+	Password     string          `json:"password"`
+	Display      *displayOptions `json:"display"`
+	Launch       bool            `json:"launch"`
+	// Credential references a credential saved in the vault instead of sending the password
+	Credential string `json:"credential"`
+	// Duration is how long extend pushes the session out, the configured default is used if empty
+	Duration string `json:"duration"`
+	// StopAfter asks start-instance to stop the instance again when the session ends
+	StopAfter bool `json:"stop_after"`
 }
@@ -0,0 +1,373 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
+)
+
+// credential vault consts
+const (
+	vaultVersion         int    = 1
+	vaultKeyLength       int    = 32
+	vaultSaltLength      int    = 16
+	vaultCheckValue      string = "admin-extension-credential-vault"
+	vaultMissingKey      string = "The credential vault needs a passphrase or a key file"
+	vaultWrongKey        string = "Unable to unlock the credential vault, the passphrase or key file is wrong"
+	vaultInvalidRef      string = "Credential reference %q must be project/instance/username"
+	vaultCredentialError string = "No saved credential %v"
+	vaultWrongInstance   string = "Saved credential %v is not for %v"
+	// VaultNotEnabled is returned if the server was started without a credential vault
+	VaultNotEnabled string = "The credential vault is not enabled on the server"
+)
+
+// vaultIterations is the PBKDF2 iteration count used for new vaults, existing vaults keep theirs
+var vaultIterations = 200000
+
+// vault is opened by StartVault, it is nil while the vault isn't enabled
+var vault *Vault
+
+// CredentialRef names a saved credential, it is written as project/instance/username
+type CredentialRef struct {
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+	Username string `json:"username"`
+}
+
+// String returns the reference used as the vault key and in socket commands
+func (ref CredentialRef) String() string {
+	return strings.Join([]string{ref.Project, ref.Instance, ref.Username}, "/")
+}
+
+func (ref CredentialRef) validate() error {
+	for _, part := range []string{ref.Project, ref.Instance, ref.Username} {
+		if part == "" || strings.ContainsAny(part, "/\r\n") {
+			return protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf(vaultInvalidRef, ref.String()))
+		}
+	}
+	return nil
+}
+
+// parseCredentialRef reads a project/instance/username reference
+func parseCredentialRef(reference string) (CredentialRef, error) {
+	parts := strings.Split(reference, "/")
+	if len(parts) != 3 {
+		return CredentialRef{}, protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf(vaultInvalidRef, reference))
+	}
+	ref := CredentialRef{Project: parts[0], Instance: parts[1], Username: parts[2]}
+	return ref, ref.validate()
+}
+
+// sealedSecret is a password encrypted with AES-GCM, the owner and reference are the additional data so entries
+// can't be swapped between references or owners
+type sealedSecret struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// vaultFile is the encrypted vault on disk, only the owners and references are readable without the key.
+// Entries are keyed by the account that saved them and then by reference.
+type vaultFile struct {
+	Version    int                                `json:"version"`
+	Iterations int                                `json:"iterations"`
+	Salt       []byte                             `json:"salt"`
+	Check      sealedSecret                       `json:"check"`
+	Entries    map[string]map[string]sealedSecret `json:"entries"`
+}
+
+// Vault keeps saved RDP credentials encrypted at rest
+type Vault struct {
+	mu   sync.Mutex
+	path string
+	aead cipher.AEAD
+	file vaultFile
+}
+
+// pbkdf2SHA256 derives a key from the secret as specified in RFC 8018 with HMAC-SHA256
+func pbkdf2SHA256(secret, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, secret)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	key := make([]byte, 0, blocks*hashLength)
+	counter := make([]byte, 4)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		prf.Write(counter)
+		key = prf.Sum(key)
+		t := key[len(key)-hashLength:]
+		copy(u, t)
+
+		for i := 2; i <= iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:keyLength]
+}
+
+func newVaultCipher(secret, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256(secret, salt, iterations, vaultKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// vaultSecret returns the passphrase, or the contents of the key file if no passphrase is given
+func vaultSecret(passphrase, keyFile string) ([]byte, error) {
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if keyFile == "" {
+		return nil, errors.New(vaultMissingKey)
+	}
+	secret, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New(vaultMissingKey)
+	}
+	return secret, nil
+}
+
+// OpenVault unlocks the vault at path with the passphrase or key file, a new vault is created if none exists
+func OpenVault(path, passphrase, keyFile string) (*Vault, error) {
+	secret, err := vaultSecret(passphrase, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		salt := make([]byte, vaultSaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		v.file = vaultFile{Version: vaultVersion, Iterations: vaultIterations, Salt: salt, Entries: make(map[string]map[string]sealedSecret)}
+		if v.aead, err = newVaultCipher(secret, salt, vaultIterations); err != nil {
+			return nil, err
+		}
+		if v.file.Check, err = v.seal("check", []byte(vaultCheckValue)); err != nil {
+			return nil, err
+		}
+		return v, v.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &v.file); err != nil {
+		return nil, err
+	}
+	if v.file.Entries == nil {
+		v.file.Entries = make(map[string]map[string]sealedSecret)
+	}
+	if v.aead, err = newVaultCipher(secret, v.file.Salt, v.file.Iterations); err != nil {
+		return nil, err
+	}
+	if check, err := v.open("check", v.file.Check); err != nil || string(check) != vaultCheckValue {
+		return nil, errors.New(vaultWrongKey)
+	}
+	return v, nil
+}
+
+// StartVault opens the vault used by the credential endpoints and socket commands
+func StartVault(path, passphrase, keyFile string) error {
+	v, err := OpenVault(path, passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	vault = v
+	return nil
+}
+
+// sealedAs returns the additional data an owner's entry is sealed with
+func sealedAs(owner string, ref CredentialRef) string {
+	return owner + "\n" + ref.String()
+}
+
+func (v *Vault) seal(reference string, plaintext []byte) (sealedSecret, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return sealedSecret{}, err
+	}
+	return sealedSecret{Nonce: nonce, Ciphertext: v.aead.Seal(nil, nonce, plaintext, []byte(reference))}, nil
+}
+
+func (v *Vault) open(reference string, secret sealedSecret) ([]byte, error) {
+	return v.aead.Open(nil, secret.Nonce, secret.Ciphertext, []byte(reference))
+}
+
+// save writes the vault to a temp file and renames it over the old one so a crash can't leave it half written
+func (v *Vault) save() error {
+	data, err := json.Marshal(v.file)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(v.path), ".vault-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
+
+// Save encrypts and stores the password under the owner's reference, replacing any saved one
+func (v *Vault) Save(owner string, ref CredentialRef, password string) error {
+	if err := ref.validate(); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	secret, err := v.seal(sealedAs(owner, ref), []byte(password))
+	if err != nil {
+		return err
+	}
+	if v.file.Entries[owner] == nil {
+		v.file.Entries[owner] = make(map[string]sealedSecret)
+	}
+	v.file.Entries[owner][ref.String()] = secret
+	return v.save()
+}
+
+// List returns the references of the owner's saved credentials, passwords are never returned
+func (v *Vault) List(owner string) []CredentialRef {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	refs := make([]CredentialRef, 0, len(v.file.Entries[owner]))
+	for reference := range v.file.Entries[owner] {
+		if ref, err := parseCredentialRef(reference); err == nil {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+// Delete removes the owner's saved credential, the credentials of other owners are never found
+func (v *Vault) Delete(owner string, ref CredentialRef) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.file.Entries[owner][ref.String()]; !ok {
+		return protocol.WithCode(protocol.CodeNotFound, fmt.Errorf(vaultCredentialError, ref.String()))
+	}
+	delete(v.file.Entries[owner], ref.String())
+	if len(v.file.Entries[owner]) == 0 {
+		delete(v.file.Entries, owner)
+	}
+	return v.save()
+}
+
+// get decrypts the owner's saved password for the reference
+func (v *Vault) get(owner string, ref CredentialRef) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	secret, ok := v.file.Entries[owner][ref.String()]
+	if !ok {
+		return "", protocol.WithCode(protocol.CodeNotFound, fmt.Errorf(vaultCredentialError, ref.String()))
+	}
+	password, err := v.open(sealedAs(owner, ref), secret)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// SaveCredential stores a credential for the owner in the server's vault
+func SaveCredential(owner string, ref CredentialRef, password string) error {
+	if vault == nil {
+		return errors.New(VaultNotEnabled)
+	}
+	return vault.Save(owner, ref, password)
+}
+
+// ListCredentials returns the references the owner saved in the server's vault
+func ListCredentials(owner string) ([]CredentialRef, error) {
+	if vault == nil {
+		return nil, errors.New(VaultNotEnabled)
+	}
+	return vault.List(owner), nil
+}
+
+// DeleteCredential removes one of the owner's credentials from the server's vault
+func DeleteCredential(owner string, ref CredentialRef) error {
+	if vault == nil {
+		return errors.New(VaultNotEnabled)
+	}
+	return vault.Delete(owner, ref)
+}
+
+// savedCredentials returns the owner's credentials for a reference sent in a socket command, the reference must
+// be for the session's instance so a session can't read credentials saved for other instances.
+func savedCredentials(owner string, instance *Instance, reference string) (*credentials, error) {
+	if vault == nil {
+		return nil, errors.New(VaultNotEnabled)
+	}
+	ref, err := parseCredentialRef(reference)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Project != instance.ProjectName || ref.Instance != instance.Name {
+		return nil, fmt.Errorf(vaultWrongInstance, reference, instance.Name)
+	}
+
+	password, err := vault.get(owner, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{Username: ref.Username, Password: password}, nil
+}
@@ -0,0 +1,177 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package gcloud
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPbkdf2SHA256(t *testing.T) {
+	tests := []struct {
+		secret, salt string
+		iterations   int
+		expected     string
+	}{
+		// Test vectors from RFC 7914 section 11, both derive two blocks
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		// A key that ends part way through its second block
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	}
+	for _, test := range tests {
+		expected, _ := hex.DecodeString(test.expected)
+		if key := pbkdf2SHA256([]byte(test.secret), []byte(test.salt), test.iterations, len(expected)); !bytes.Equal(key, expected) {
+			t.Errorf("pbkdf2SHA256(%q, %q, %v) got %x, expected %x", test.secret, test.salt, test.iterations, key, expected)
+		}
+	}
+}
+
+func TestVault(t *testing.T) {
+	vaultIterations = 1000
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vault.json")
+
+	if _, err := OpenVault(path, "", ""); err == nil {
+		t.Errorf("OpenVault opened a vault without a passphrase or key file")
+	}
+
+	v, err := OpenVault(path, "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := CredentialRef{Project: "test-project", Instance: "vm", Username: "admin"}
+	if err := v.Save("user@google.com", ref, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save("user@google.com", CredentialRef{Project: "test-project", Instance: "vm/other", Username: "admin"}, "x"); err == nil {
+		t.Errorf("Save accepted a reference with a slash in a part")
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Errorf("vault stored the password in plain text")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("vault has permissions %v, expected 0600", info.Mode().Perm())
+	}
+
+	if _, err := OpenVault(path, "wrong", ""); err == nil || err.Error() != vaultWrongKey {
+		t.Errorf("OpenVault didn't reject the wrong passphrase, got %v", err)
+	}
+
+	reopened, err := OpenVault(path, "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := reopened.List("user@google.com"); !reflect.DeepEqual(refs, []CredentialRef{ref}) {
+		t.Errorf("List got %v, expected %v", refs, []CredentialRef{ref})
+	}
+	if password, err := reopened.get("user@google.com", ref); err != nil || password != "hunter2" {
+		t.Errorf("get got %v, %v, expected hunter2", password, err)
+	}
+
+	// Another owner can't see, read or delete the credential
+	if refs := reopened.List("other@google.com"); len(refs) != 0 {
+		t.Errorf("List returned another owner's credentials, got %v", refs)
+	}
+	if _, err := reopened.get("other@google.com", ref); err == nil {
+		t.Errorf("get returned another owner's credential")
+	}
+	if err := reopened.Delete("other@google.com", ref); err == nil {
+		t.Errorf("Delete removed another owner's credential")
+	}
+	reopened.file.Entries["other@google.com"] = reopened.file.Entries["user@google.com"]
+	if _, err := reopened.get("other@google.com", ref); err == nil {
+		t.Errorf("get opened an entry moved to another owner")
+	}
+	delete(reopened.file.Entries, "other@google.com")
+
+	if err := reopened.Delete("user@google.com", ref); err != nil {
+		t.Errorf("Delete failed, got %v", err)
+	}
+	if err := reopened.Delete("user@google.com", ref); err == nil {
+		t.Errorf("Delete didn't error for a missing credential")
+	}
+	if refs := reopened.List("user@google.com"); len(refs) != 0 {
+		t.Errorf("List returned deleted credential, got %v", refs)
+	}
+}
+
+func TestVaultKeyFile(t *testing.T) {
+	vaultIterations = 1000
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef"), 0600)
+	path := filepath.Join(dir, "vault.json")
+
+	if _, err := OpenVault(path, "", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenVault(path, "", keyFile); err != nil {
+		t.Errorf("OpenVault couldn't reopen vault with the key file, got %v", err)
+	}
+}
+
+func TestSavedCredentials(t *testing.T) {
+	vaultIterations = 1000
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	instanceToUse := &Instance{Name: "vm", ProjectName: "test-project"}
+	if _, err := savedCredentials("user@google.com", instanceToUse, "test-project/vm/admin"); err == nil || err.Error() != VaultNotEnabled {
+		t.Errorf("savedCredentials didn't error without a vault, got %v", err)
+	}
+
+	if err := StartVault(filepath.Join(dir, "vault.json"), "passphrase", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { vault = nil }()
+	SaveCredential("user@google.com", CredentialRef{Project: "test-project", Instance: "vm", Username: "admin"}, "hunter2")
+	SaveCredential("user@google.com", CredentialRef{Project: "test-project", Instance: "other", Username: "admin"}, "secret")
+
+	creds, err := savedCredentials("user@google.com", instanceToUse, "test-project/vm/admin")
+	if err != nil || creds.Username != "admin" || creds.Password != "hunter2" {
+		t.Errorf("savedCredentials got %v, %v", creds, err)
+	}
+	if _, err := savedCredentials("user@google.com", instanceToUse, "test-project/other/admin"); err == nil {
+		t.Errorf("savedCredentials returned a credential saved for another instance")
+	}
+	if _, err := savedCredentials("other@google.com", instanceToUse, "test-project/vm/admin"); err == nil {
+		t.Errorf("savedCredentials returned a credential another owner saved")
+	}
+	if _, err := savedCredentials("user@google.com", instanceToUse, "admin"); err == nil {
+		t.Errorf("savedCredentials accepted an invalid reference")
+	}
+}
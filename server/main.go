@@ -29,11 +29,13 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/admin"
 	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/gcloud"
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/protocol"
 	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/shell"
 
 	"github.com/gorilla/mux"
@@ -75,17 +77,44 @@ func main() {
 	enableLogs := flag.Bool("v", false, "Enable logging")
 	certFile = flag.String("certFile", "./localhost.pem", "Full name of certificate file")
 	keyFile = flag.String("keyFile", "./localhost-key.pem", "Full name of key file")
+	statePath := flag.String("statePath", "./server-state.json", "Path of the file that keeps resources pending deletion")
+	sweepInterval := flag.Duration("sweepInterval", 10*time.Minute, "How often expired IAP firewall rules are cleaned up")
+	vaultPath := flag.String("vaultPath", "", "Path of the encrypted credential vault, the vault is disabled if empty")
+	vaultKeyFile := flag.String("vaultKeyFile", "", "Key file that unlocks the vault if VAULT_PASSPHRASE isn't set")
+	portsPath := flag.String("portsPath", "./ports.json", "Path of the file that keeps the local port each instance was given")
 	flag.Parse()
 
 	if !*enableLogs {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	if err := gcloud.StartSweeper(&shell.CmdShell{}, *statePath, *sweepInterval); err != nil {
+		log.Println("Could not start sweeper for orphaned firewall rules:", err)
+	}
+
+	if err := gcloud.StartPortTable(*portsPath); err != nil {
+		log.Println("Could not load local port assignments:", err)
+	}
+
+	if *vaultPath != "" {
+		if err := gcloud.StartVault(*vaultPath, os.Getenv("VAULT_PASSPHRASE"), *vaultKeyFile); err != nil {
+			log.Fatal("Could not open credential vault: ", err)
+		}
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/health", health).Methods("GET")
 	router.HandleFunc("/verifyidtoken", verifyIdToken).Methods("POST")
 	router.HandleFunc("/gcloud/compute-instances", sessionMiddleware(getComputeInstances)).Methods("POST")
 	router.HandleFunc("/gcloud/start-private-rdp", sessionMiddleware(startPrivateRdp))
+	router.HandleFunc("/gcloud/start-port-forward", sessionMiddleware(startPortForward))
+	router.HandleFunc("/gcloud/check-permissions", sessionMiddleware(checkPermissions)).Methods("POST")
+	router.HandleFunc("/gcloud/sessions", sessionMiddleware(listSessions)).Methods("GET")
+	router.HandleFunc("/gcloud/sessions/{id}", sessionMiddleware(closeSession)).Methods("DELETE")
+	router.HandleFunc("/gcloud/sessions/{id}/rdp-file", sessionMiddleware(getRdpFile)).Methods("GET")
+	router.HandleFunc("/vault/credentials", sessionMiddleware(listCredentials)).Methods("GET")
+	router.HandleFunc("/vault/credentials", sessionMiddleware(saveCredential)).Methods("POST")
+	router.HandleFunc("/vault/credentials/{project}/{instance}/{username}", sessionMiddleware(deleteCredential)).Methods("DELETE")
 	router.HandleFunc("/admin/get-config", sessionMiddleware(getConfigFileAndSendJson)).Methods("GET")
 	router.HandleFunc("/admin/get-project", sessionMiddleware(getProjectFromParameters)).Methods("POST")
 	router.HandleFunc("/admin/operation-to-run", sessionMiddleware(validateAdminOperationParams)).Methods("POST")
@@ -94,6 +123,7 @@ func main() {
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   allowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
 		AllowCredentials: true,
 	})
 
@@ -182,6 +212,7 @@ func verifyIdToken(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "adminops")
 	session.Options = &sessions.Options{SameSite: http.SameSiteNoneMode, Secure: true}
 	session.Values["auth"] = true
+	session.Values["email"] = tokenInfo.Email
 	session.Save(r, w)
 	return
 }
@@ -362,35 +393,25 @@ func validateInstanceOperationParams(w http.ResponseWriter, r *http.Request) {
 }
 
 func runAdminOperation(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		if origin := r.Header.Get("Origin"); origin != "" {
-			log.Println(origin)
-			for _, allowedOrigin := range allowedOrigins {
-				if allowedOrigin == origin {
-					return true
-				}
-			}
-		}
-		return false
-	}
-
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := upgradeSocket(w, r)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 
 	log.Println("Starting operation socket connection")
 	defer ws.Close()
 
-	operationToRun, err := admin.ReadOperationHashFromConn(ws, &operationPool)
+	// Clients that start with a hello get versioned messages, older ones the legacy messages
+	conn := protocol.NewConn(ws)
+	operationToRun, err := admin.ReadOperationHashFromConn(conn, &operationPool)
 	if err != nil {
-		admin.WriteToSocket(ws, "", "", "", err)
+		admin.WriteToSocket(conn, "", "", "", err)
 	}
 
 	shell := &shell.CmdShell{}
 	adminExecutor := admin.NewAdminExecutor(shell)
-	adminExecutor.RunOperation(ws, operationToRun)
+	adminExecutor.RunOperation(conn, operationToRun)
 
 	// Remove finished operation from pool
 	for i, operation := range operationPool {
@@ -440,7 +461,75 @@ func getComputeInstances(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(instances)
 }
 
+// checkPermissions reports which of the permissions a session needs the caller is missing on the instance
+func checkPermissions(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var instance gcloud.Instance
+	if err := json.Unmarshal(body, &instance); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	shell := &shell.CmdShell{}
+	gcloudExecutor := gcloud.NewGcloudExecutor(shell)
+	gcloudExecutor.SetConfig(loadedConfig)
+
+	w.Header().Set("Content-Type", "application/json")
+	report, err := gcloudExecutor.CheckPermissions(&instance)
+	if err != nil {
+		log.Println(err)
+		if err.Error() == gcloud.SdkAuthError {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(newErrorRequest(err))
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
 func startPrivateRdp(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeSocket(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println("Starting RDP socket connection")
+	defer ws.Close()
+
+	shell := &shell.CmdShell{}
+	gcloudExecutor := gcloud.NewGcloudExecutor(shell)
+	gcloudExecutor.SetOwner(sessionOwner(r))
+
+	gcloudExecutor.StartPrivateRdp(ws, loadedConfig)
+}
+
+func startPortForward(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeSocket(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println("Starting port forward socket connection")
+	defer ws.Close()
+
+	shell := &shell.CmdShell{}
+	gcloudExecutor := gcloud.NewGcloudExecutor(shell)
+	gcloudExecutor.SetOwner(sessionOwner(r))
+
+	gcloudExecutor.StartPortForward(ws, loadedConfig)
+}
+
+// upgradeSocket upgrades the request to a websocket if it comes from an allowed origin
+func upgradeSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	upgrader := websocket.Upgrader{}
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		if origin := r.Header.Get("Origin"); origin != "" {
@@ -453,18 +542,146 @@ func startPrivateRdp(w http.ResponseWriter, r *http.Request) {
 		}
 		return false
 	}
+	return upgrader.Upgrade(w, r, nil)
+}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+// sessionOwner returns the email the request's cookie session was verified with
+func sessionOwner(r *http.Request) string {
+	session, err := store.Get(r, "adminops")
 	if err != nil {
-		log.Println(err)
+		return ""
+	}
+	email, _ := session.Values["email"].(string)
+	return email
+}
+
+// listSessions returns the caller's tunnel sessions that are active on the server
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Sessions []gcloud.SessionInfo `json:"sessions"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response{Sessions: gcloud.ListSessions(sessionOwner(r))})
+}
+
+// closeSession ends one of the caller's sessions, its tunnel and firewall rule are cleaned up as if the client sent end-rdp
+func closeSession(w http.ResponseWriter, r *http.Request) {
+	if err := gcloud.CloseSession(mux.Vars(r)["id"], sessionOwner(r)); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(newErrorRequest(err))
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	log.Println("Starting RDP socket connection")
-	defer ws.Close()
+// getRdpFile serves a .rdp file for an active RDP session of the caller so any native client can connect through the tunnel
+func getRdpFile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	width, _ := strconv.Atoi(query.Get("width"))
+	height, _ := strconv.Atoi(query.Get("height"))
+	options := gcloud.RdpFileOptions{
+		Username:     query.Get("username"),
+		Width:        width,
+		Height:       height,
+		Fullscreen:   query.Get("fullscreen") == "true",
+		MultiMonitor: query.Get("multimon") == "true",
+		Clipboard:    query.Get("clipboard") == "true",
+	}
+
+	id, owner := mux.Vars(r)["id"], sessionOwner(r)
+	rdpFile, err := gcloud.NewRdpFile(id, owner, options)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if gcloud.SessionActive(id, owner) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(w).Encode(newErrorRequest(err))
+		return
+	}
 
-	shell := &shell.CmdShell{}
-	gcloudExecutor := gcloud.NewGcloudExecutor(shell)
+	w.Header().Set("Content-Type", gcloud.RdpFileContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rdpFile.Name))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Expires", rdpFile.Expires.UTC().Format(http.TimeFormat))
+	if !rdpFile.ConnectBy.IsZero() {
+		w.Header().Set("X-Rdp-Connect-By", rdpFile.ConnectBy.UTC().Format(http.TimeFormat))
+	}
+	w.Write(rdpFile.Content)
+}
 
-	gcloudExecutor.StartPrivateRdp(ws, loadedConfig)
+// listCredentials returns the references of the credentials the caller saved in the vault, never the passwords
+func listCredentials(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Credentials []gcloud.CredentialRef `json:"credentials"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	refs, err := gcloud.ListCredentials(sessionOwner(r))
+	if err != nil {
+		w.WriteHeader(credentialErrorStatus(err))
+		json.NewEncoder(w).Encode(newErrorRequest(err))
+		return
+	}
+	json.NewEncoder(w).Encode(response{Credentials: refs})
+}
+
+// saveCredential encrypts a credential into the vault so start-rdp can use it by reference
+func saveCredential(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		gcloud.CredentialRef
+		Password string `json:"password"`
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var reqBody request
+	if err := json.Unmarshal(body, &reqBody); err != nil || reqBody.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := gcloud.SaveCredential(sessionOwner(r), reqBody.CredentialRef, reqBody.Password); err != nil {
+		w.WriteHeader(credentialErrorStatus(err))
+		json.NewEncoder(w).Encode(newErrorRequest(err))
+		return
+	}
+	json.NewEncoder(w).Encode(reqBody.CredentialRef)
+}
+
+// deleteCredential removes one of the caller's credentials from the vault
+func deleteCredential(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ref := gcloud.CredentialRef{Project: vars["project"], Instance: vars["instance"], Username: vars["username"]}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := gcloud.DeleteCredential(sessionOwner(r), ref); err != nil {
+		w.WriteHeader(credentialErrorStatus(err))
+		json.NewEncoder(w).Encode(newErrorRequest(err))
+		return
+	}
+	json.NewEncoder(w).Encode(ref)
+}
+
+// credentialErrorStatus returns the HTTP status for an error from the credential vault
+func credentialErrorStatus(err error) int {
+	if err.Error() == gcloud.VaultNotEnabled {
+		return http.StatusServiceUnavailable
+	}
+	switch protocol.ErrorCode(err) {
+	case protocol.CodeInvalidRequest:
+		return http.StatusBadRequest
+	case protocol.CodeNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
 }
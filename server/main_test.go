@@ -23,6 +23,8 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+
+	"github.com/googleinterns/RDP-GCP-VMs-without-publicIP/server/gcloud"
 )
 
 // TestHealth tests the /health HTTP response with a GET Request using the health function
@@ -55,3 +57,25 @@ func TestHealth(t *testing.T) {
 		t.Errorf("HEALTH failed, got: %v, expected: %v", gotResp, expectedResp)
 	}
 }
+
+// TestDeleteCredentialDisabled tests that credential requests fail with an error status without a vault
+func TestDeleteCredentialDisabled(t *testing.T) {
+	req, err := http.NewRequest("DELETE", "/vault/credentials/project/vm/admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(deleteCredential)
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("deleteCredential got status %v, expected %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	var gotResp map[string]string
+	json.NewDecoder(rr.Body).Decode(&gotResp)
+	if gotResp["error"] != gcloud.VaultNotEnabled {
+		t.Errorf("deleteCredential got %v, expected the vault error", gotResp)
+	}
+}
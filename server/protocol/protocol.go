@@ -0,0 +1,299 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+// Package protocol provides the versioned message envelope sent over the websockets and the handshake that
+// negotiates it. Clients that don't send the handshake keep getting the legacy messages.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// protocol versions
+const (
+	// VersionLegacy is the free-form message each runner writes, used by clients that don't send hello
+	VersionLegacy int = 1
+	// VersionEnvelope wraps every message in an Envelope with a typed payload
+	VersionEnvelope int = 2
+	// CurrentVersion is the newest version the server speaks
+	CurrentVersion int = VersionEnvelope
+)
+
+// HelloCmd is the first message a client sends to negotiate the protocol version
+const HelloCmd string = "hello"
+
+// message types
+const (
+	TypeHello       string = "hello"
+	TypeProgress    string = "progress"
+	TypeOutput      string = "output"
+	TypeEvent       string = "event"
+	TypeReady       string = "ready"
+	TypeTunnelReady string = "tunnel_ready"
+	TypeCredentials string = "credentials"
+	TypeError       string = "error"
+	TypeEnded       string = "ended"
+)
+
+// error codes
+const (
+	CodeUnknown          string = "unknown"
+	CodeInvalidRequest   string = "invalid_request"
+	CodeNotFound         string = "not_found"
+	CodePermissionDenied string = "permission_denied"
+	CodeOperationFailed  string = "operation_failed"
+	CodeTunnelFailed     string = "tunnel_failed"
+)
+
+// output streams
+const (
+	StreamStdout string = "stdout"
+	StreamStderr string = "stderr"
+)
+
+// timeNow is replaced in tests
+var timeNow = time.Now
+
+// Envelope is a message sent to clients that negotiated VersionEnvelope. Seq counts up from 1 on each socket.
+type Envelope struct {
+	Version   int         `json:"version"`
+	Type      string      `json:"type"`
+	Phase     string      `json:"phase,omitempty"`
+	Seq       uint64      `json:"seq"`
+	Timestamp time.Time   `json:"timestamp"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+// Hello is the client's handshake and the payload of the server's reply
+type Hello struct {
+	Cmd      string `json:"cmd,omitempty"`
+	Versions []int  `json:"versions,omitempty"`
+	Version  int    `json:"version,omitempty"`
+}
+
+// Progress is a message about what the server is doing
+type Progress struct {
+	Message string `json:"message"`
+}
+
+// Output is a line of output from a command
+type Output struct {
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// Event is a structured event, Detail is the runner's own event
+type Event struct {
+	Message string      `json:"message,omitempty"`
+	Detail  interface{} `json:"detail"`
+}
+
+// TunnelReady is sent once the tunnel accepts connections on the local port
+type TunnelReady struct {
+	Message   string `json:"message,omitempty"`
+	Port      int    `json:"port"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// Error is a failure, Code lets clients handle it without matching the message
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// Ended is the last message of a session or operation
+type Ended struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
+
+// Message is implemented by the runners' messages to give their envelope type and payload
+type Message interface {
+	Envelope() (string, interface{})
+}
+
+// codedError is an error with the code sent to clients
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// WithCode attaches the code sent to clients to the error, the message is unchanged
+func WithCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// ErrorCode returns the code attached to the error, CodeUnknown if there is none
+func ErrorCode(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return CodeUnknown
+}
+
+// conn is the websocket the envelopes are written to
+type conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+// Conn negotiates the protocol version from the first message the client sends and writes each message in
+// the negotiated version. Writes are serialized since websockets allow only one writer at a time.
+type Conn struct {
+	ws conn
+
+	mu         sync.Mutex
+	negotiated bool
+	version    int
+	phase      string
+	seq        uint64
+}
+
+// NewConn wraps the websocket, it speaks VersionLegacy until a client negotiates another version
+func NewConn(ws conn) *Conn {
+	return &Conn{ws: ws, version: VersionLegacy}
+}
+
+// ReadMessage reads from the websocket. A hello sent as the first message is answered here and the
+// message after it is returned.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType, message, err := c.ws.ReadMessage()
+	if err != nil {
+		return messageType, message, err
+	}
+
+	c.mu.Lock()
+	first := !c.negotiated
+	c.negotiated = true
+	c.mu.Unlock()
+	if !first {
+		return messageType, message, nil
+	}
+
+	var hello Hello
+	if json.Unmarshal(message, &hello) != nil || hello.Cmd != HelloCmd {
+		return messageType, message, nil
+	}
+	version := negotiate(hello.Versions)
+	c.mu.Lock()
+	c.version = version
+	c.mu.Unlock()
+	if err := c.write(TypeHello, Hello{Version: version, Versions: supportedVersions()}); err != nil {
+		return messageType, message, err
+	}
+	return c.ws.ReadMessage()
+}
+
+// negotiate picks the newest version both sides speak, falling back to the legacy messages
+func negotiate(versions []int) int {
+	chosen := VersionLegacy
+	for _, version := range versions {
+		if version > chosen && version <= CurrentVersion {
+			chosen = version
+		}
+	}
+	return chosen
+}
+
+func supportedVersions() []int {
+	var versions []int
+	for version := VersionLegacy; version <= CurrentVersion; version++ {
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// WriteJSON writes the message as is for legacy clients and in an envelope for the others
+func (c *Conn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version == VersionLegacy {
+		return c.ws.WriteJSON(v)
+	}
+
+	if message, ok := v.(Message); ok {
+		messageType, payload := message.Envelope()
+		return c.writeLocked(messageType, payload)
+	}
+	return c.writeLocked(TypeEvent, Event{Detail: v})
+}
+
+func (c *Conn) write(messageType string, payload interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(messageType, payload)
+}
+
+// writeLocked writes the envelope, the mutex must be held
+func (c *Conn) writeLocked(messageType string, payload interface{}) error {
+	c.seq++
+	return c.ws.WriteJSON(&Envelope{
+		Version:   c.version,
+		Type:      messageType,
+		Phase:     c.phase,
+		Seq:       c.seq,
+		Timestamp: timeNow().UTC(),
+		Payload:   payload,
+	})
+}
+
+// phaser is a socket that sends the phase with its messages
+type phaser interface {
+	SetPhase(phase string)
+}
+
+// SetPhase sets the phase of the messages written to the socket after it, if it sends phases
+func SetPhase(ws interface{}, phase string) {
+	if p, ok := ws.(phaser); ok {
+		p.SetPhase(phase)
+	}
+}
+
+// SetPhase sets the phase sent with the following messages
+func (c *Conn) SetPhase(phase string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phase = phase
+}
+
+// Version returns the negotiated protocol version
+func (c *Conn) Version() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// Close closes the websocket
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
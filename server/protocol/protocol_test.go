@@ -0,0 +1,168 @@
+/***
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+***/
+
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var testTime = time.Date(2020, time.June, 20, 0, 0, 0, 0, time.UTC)
+
+// scriptedSocket returns the reads in order and keeps what is written
+type scriptedSocket struct {
+	reads   []string
+	written []interface{}
+}
+
+func (s *scriptedSocket) ReadMessage() (int, []byte, error) {
+	if len(s.reads) == 0 {
+		return 0, nil, errors.New("closed")
+	}
+	read := s.reads[0]
+	s.reads = s.reads[1:]
+	return websocket.TextMessage, []byte(read), nil
+}
+
+func (s *scriptedSocket) WriteJSON(v interface{}) error {
+	s.written = append(s.written, v)
+	return nil
+}
+
+func (s *scriptedSocket) Close() error {
+	return nil
+}
+
+// legacyMessage stands in for a runner's message
+type legacyMessage struct {
+	Message string `json:"message"`
+	Err     string `json:"error"`
+}
+
+func (m *legacyMessage) Envelope() (string, interface{}) {
+	if m.Err != "" {
+		return TypeError, Error{Code: CodeUnknown, Message: m.Err}
+	}
+	return TypeProgress, Progress{Message: m.Message}
+}
+
+func TestLegacyConn(t *testing.T) {
+	ws := &scriptedSocket{reads: []string{`{"name": "vm"}`}}
+	c := NewConn(ws)
+
+	_, message, err := c.ReadMessage()
+	if err != nil || string(message) != `{"name": "vm"}` {
+		t.Fatalf("ReadMessage didn't return the first message of a legacy client, got %s %v", message, err)
+	}
+	c.SetPhase("starting")
+	legacy := &legacyMessage{Message: "Server received instance vm"}
+	c.WriteJSON(legacy)
+	if c.Version() != VersionLegacy || len(ws.written) != 1 || ws.written[0] != legacy {
+		t.Errorf("WriteJSON didn't write the legacy message as is, got %v", ws.written)
+	}
+}
+
+func TestEnvelopeConn(t *testing.T) {
+	timeNow = func() time.Time { return testTime }
+	defer func() { timeNow = time.Now }()
+
+	ws := &scriptedSocket{reads: []string{`{"cmd": "hello", "versions": [1, 2, 3]}`, `{"name": "vm"}`}}
+	c := NewConn(ws)
+	c.SetPhase("starting")
+
+	_, message, err := c.ReadMessage()
+	if err != nil || string(message) != `{"name": "vm"}` {
+		t.Fatalf("ReadMessage didn't return the message after hello, got %s %v", message, err)
+	}
+	if c.Version() != VersionEnvelope {
+		t.Fatalf("hello negotiated version %v, expected %v", c.Version(), VersionEnvelope)
+	}
+
+	c.WriteJSON(&legacyMessage{Message: "Server received instance vm"})
+	c.SetPhase("tunnel")
+	c.WriteJSON(&legacyMessage{Err: "tunnel failed"})
+	c.WriteJSON(map[string]string{"other": "value"})
+
+	expected := []*Envelope{
+		{Version: VersionEnvelope, Type: TypeHello, Phase: "starting", Seq: 1, Timestamp: testTime, Payload: Hello{Version: VersionEnvelope, Versions: []int{1, 2}}},
+		{Version: VersionEnvelope, Type: TypeProgress, Phase: "starting", Seq: 2, Timestamp: testTime, Payload: Progress{Message: "Server received instance vm"}},
+		{Version: VersionEnvelope, Type: TypeError, Phase: "tunnel", Seq: 3, Timestamp: testTime, Payload: Error{Code: CodeUnknown, Message: "tunnel failed"}},
+		{Version: VersionEnvelope, Type: TypeEvent, Phase: "tunnel", Seq: 4, Timestamp: testTime, Payload: Event{Detail: map[string]string{"other": "value"}}},
+	}
+	if len(ws.written) != len(expected) {
+		t.Fatalf("conn wrote %v messages, expected %v", len(ws.written), len(expected))
+	}
+	for i, envelope := range expected {
+		if !reflect.DeepEqual(ws.written[i], envelope) {
+			t.Errorf("conn wrote %+v, expected %+v", ws.written[i], envelope)
+		}
+	}
+
+	data, _ := json.Marshal(ws.written[1])
+	if expected := `{"version":2,"type":"progress","phase":"starting","seq":2,"timestamp":"2020-06-20T00:00:00Z","payload":{"message":"Server received instance vm"}}`; string(data) != expected {
+		t.Errorf("envelope encoded as %s, expected %s", data, expected)
+	}
+}
+
+func TestSetPhase(t *testing.T) {
+	c := NewConn(&scriptedSocket{})
+	SetPhase(c, "tunnel")
+	if c.phase != "tunnel" {
+		t.Errorf("SetPhase didn't set the phase of the conn, got %v", c.phase)
+	}
+	SetPhase(&scriptedSocket{}, "tunnel")
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		versions []int
+		expected int
+	}{
+		{nil, VersionLegacy},
+		{[]int{1}, VersionLegacy},
+		{[]int{2}, VersionEnvelope},
+		{[]int{3, 4}, VersionLegacy},
+		{[]int{1, 2, 3}, VersionEnvelope},
+	}
+	for _, test := range tests {
+		if version := negotiate(test.versions); version != test.expected {
+			t.Errorf("negotiate(%v) got %v, expected %v", test.versions, version, test.expected)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	err := WithCode(CodeNotFound, errors.New("operation with hash 1 not found"))
+	if err.Error() != "operation with hash 1 not found" {
+		t.Errorf("WithCode changed the message to %v", err.Error())
+	}
+	if code := ErrorCode(fmt.Errorf("wrapped: %w", err)); code != CodeNotFound {
+		t.Errorf("ErrorCode got %v for a wrapped coded error", code)
+	}
+	if code := ErrorCode(errors.New("plain")); code != CodeUnknown {
+		t.Errorf("ErrorCode got %v for a plain error", code)
+	}
+	if WithCode(CodeNotFound, nil) != nil {
+		t.Errorf("WithCode didn't keep a nil error nil")
+	}
+}
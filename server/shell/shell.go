@@ -26,6 +26,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/google/shlex"
@@ -33,6 +34,25 @@ import (
 
 const cmdReaderContextTimeout time.Duration = 1 * time.Hour
 
+// lockedBuffer is a buffer the output so far can be read from while the command is still writing to it
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+// Bytes returns a copy of what was written
+func (l *lockedBuffer) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.b.Bytes()...)
+}
+
 // CmdShell implements Shell interface, contains functions that run commands.
 type CmdShell struct{}
 
@@ -59,7 +79,32 @@ func (*CmdShell) ExecuteCmd(cmd string) ([]byte, error) {
 	return out, err
 }
 
-// ExecuteCmd runs a shell command and waits for its output before returning the output
+// ExecuteCmdWithStdin runs a program with the input written to its stdin and waits for its output, it is
+// used to hand secrets to programs without putting them in the command line. The arguments are passed as
+// they are, without splitting or expanding environment variables. started, if set, is called with the
+// process id once the command is running.
+func (*CmdShell) ExecuteCmdWithStdin(args []string, stdin []byte, started func(pid int)) ([]byte, error) {
+	if len(args) == 0 {
+		return []byte("Operation invalid"), errors.New("Invalid operation")
+	}
+
+	var output bytes.Buffer
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = bytes.NewReader(stdin)
+	c.Stdout = &output
+	c.Stderr = &output
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	if started != nil {
+		started(c.Process.Pid)
+	}
+	err := c.Wait()
+	return output.Bytes(), err
+}
+
+// ExecuteCmdWithContext runs a shell command and waits for its output, if endContext is done first the
+// command is killed and an error is returned with the output so far without waiting for it to exit
 func (*CmdShell) ExecuteCmdWithContext(endContext context.Context, cmd string) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), cmdReaderContextTimeout)
 	parsedCmd, err := shlex.Split(cmd)
@@ -68,6 +113,10 @@ func (*CmdShell) ExecuteCmdWithContext(endContext context.Context, cmd string) (
 		cancel()
 		return nil, err
 	}
+	if len(parsedCmd) == 0 {
+		cancel()
+		return nil, errors.New("Invalid operation")
+	}
 
 	for i := 0; i < len(parsedCmd); i++ {
 		parsedCmd[i] = os.ExpandEnv(parsedCmd[i])
@@ -75,7 +124,7 @@ func (*CmdShell) ExecuteCmdWithContext(endContext context.Context, cmd string) (
 
 	c := exec.CommandContext(ctx, parsedCmd[0], parsedCmd[1:]...)
 
-	var b bytes.Buffer
+	var b lockedBuffer
 	c.Stdout = &b
 	c.Stderr = &b
 	err = c.Start()
@@ -84,26 +133,21 @@ func (*CmdShell) ExecuteCmdWithContext(endContext context.Context, cmd string) (
 		return nil, err
 	}
 
-	var returnErr error
-	// Use a channel to signal completion so we can use a select statement
-	done := make(chan bool)
+	// The channel is buffered so the goroutine can exit once the command does, even after endContext is done
+	done := make(chan error, 1)
 	go func() {
-		if err = c.Wait(); err != nil {
-			returnErr = err
-		}
-		done <- true
+		done <- c.Wait()
 	}()
 
-	go func() {
-		// Wait for context to be done
-		<-endContext.Done()
-		returnErr = errors.New("Operation timed out")
+	select {
+	case err := <-done:
 		cancel()
-		done <- true
-	}()
-
-	<-done
-	return b.Bytes(), returnErr
+		return b.Bytes(), err
+	case <-endContext.Done():
+		// A child holding the pipes open would keep Wait from returning, so the output isn't waited for
+		cancel()
+		return b.Bytes(), errors.New("Operation timed out")
+	}
 }
 
 // ExecuteCmdReader runs a shell command and pipes the stdout and stderr into ReadClosers
@@ -156,3 +200,12 @@ func FindOpenPort() (*net.TCPListener, error) {
 
 	return listener, nil
 }
+
+// ListenOnPort listens on the given local port and returns the listener, it errors if the port is in use
+func ListenOnPort(port int) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", addr)
+}
@@ -64,6 +64,49 @@ func TestExecuteCmdWithContext(t *testing.T) {
 	}
 }
 
+// TestExecuteCmdWithContextChild tests ExecuteCmdWithContext returns on context expiry when a child of the
+// killed command still holds its output open
+func TestExecuteCmdWithContextChild(t *testing.T) {
+	shell := CmdShell{}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	returned := make(chan error, 1)
+	go func() {
+		_, err := shell.ExecuteCmdWithContext(ctx, `bash -c 'sleep 10 & wait'`)
+		returned <- err
+	}()
+	select {
+	case err := <-returned:
+		if err == nil {
+			t.Errorf("ExecuteCmdWithContext didn't error on context expiry")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("ExecuteCmdWithContext waited for a child holding its output open")
+	}
+}
+
+// TestExecuteCmdWithStdin tests the ExecuteCmdWithStdin method which writes input to the command's stdin
+func TestExecuteCmdWithStdin(t *testing.T) {
+	shell := CmdShell{}
+	if _, err := shell.ExecuteCmdWithStdin([]string{invalidCmd}, nil, nil); err == nil {
+		t.Errorf("ExecuteCmdWithStdin didn't error on invalid cmd")
+	}
+
+	var pid int
+	output, err := shell.ExecuteCmdWithStdin([]string{"cat"}, []byte("secret\n"), func(started int) { pid = started })
+	if err != nil || string(output) != "secret\n" {
+		t.Errorf("ExecuteCmdWithStdin failed, expected %v, got %v, %v", "secret", string(output), err)
+	}
+	if pid == 0 {
+		t.Errorf("ExecuteCmdWithStdin didn't report the process id")
+	}
+
+	if output, err := shell.ExecuteCmdWithStdin([]string{"echo", "$HOME", "it's"}, nil, nil); err != nil || string(output) != "$HOME it's\n" {
+		t.Errorf("ExecuteCmdWithStdin didn't pass the arguments as they are, got %q, %v", string(output), err)
+	}
+}
+
 // TestExecuteCmdReader tests the ExecuteCmdReader method which outputs stdout/stderr as a ReadCloser
 func TestExecuteCmdReader(t *testing.T) {
 	shell := CmdShell{}